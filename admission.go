@@ -0,0 +1,200 @@
+package roast
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrHandshakeQueueTimeout is returned when a connection used up its whole
+// handshake timeout waiting for one of the handshake slots set by
+// WithMaxInFlightHandshakes.
+var ErrHandshakeQueueTimeout = errors.New("timed out waiting for a handshake slot")
+
+// AdmissionStats are counters describing the admission control a Listener
+// applies to new connections. See WithMaxInFlightHandshakes,
+// WithHandshakeQueueDepth and WithPerSourceRateLimit.
+type AdmissionStats struct {
+	// InFlight is how many handshakes are running right now, and Queued how
+	// many connections are waiting to start theirs.
+	InFlight int64
+	Queued   int64
+
+	// RejectedRateLimited, RejectedQueueFull and RejectedQueueTimeout count the
+	// connections that have been closed, without a handshake, because their
+	// source was over its rate limit, the queue was full, or they waited too
+	// long in it.
+	RejectedRateLimited  uint64
+	RejectedQueueFull    uint64
+	RejectedQueueTimeout uint64
+}
+
+// admission limits how much work a Listener takes on for connections that
+// haven't authenticated yet.
+type admission struct {
+	// slots holds a token for every running handshake, it is nil when they
+	// aren't limited.
+	slots      chan struct{}
+	queueDepth int
+
+	// sources rate limits new connections by source IP, it is nil when they
+	// aren't limited.
+	sources *sourceLimiter
+
+	inFlight, queued atomic.Int64
+
+	rateLimited, queueFull, queueTimeout atomic.Uint64
+}
+
+// admit decides whether to go ahead with `conn` at all. Rejecting it here
+// costs nothing more than closing it.
+func (a *admission) admit(conn net.Conn) bool {
+	if a.sources != nil && !a.sources.allow(conn.RemoteAddr()) {
+		a.rateLimited.Add(1)
+		return false
+	}
+
+	if a.slots == nil {
+		return true
+	}
+
+	// Handshakes that are running or waiting to run share one budget, so a
+	// connection is only queued if there's room for it.
+	if a.inFlight.Load()+a.queued.Add(1) > int64(cap(a.slots)+a.queueDepth) {
+		a.queued.Add(-1)
+		a.queueFull.Add(1)
+		return false
+	}
+
+	return true
+}
+
+// handshake runs `upgrade` once a slot is free, giving up if that isn't
+// before `deadline`. Only connections that were admitted may use it.
+func (a *admission) handshake(ctx context.Context, deadline time.Time, upgrade func() error) error {
+	if a.slots == nil {
+		return upgrade()
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	select {
+	case a.slots <- struct{}{}:
+		a.queued.Add(-1)
+	case <-timer.C:
+		a.queued.Add(-1)
+		a.queueTimeout.Add(1)
+		return ErrHandshakeQueueTimeout
+	case <-ctx.Done():
+		a.queued.Add(-1)
+		return ctx.Err()
+	}
+
+	a.inFlight.Add(1)
+	defer func() {
+		a.inFlight.Add(-1)
+		<-a.slots
+	}()
+
+	return upgrade()
+}
+
+func (a *admission) stats() AdmissionStats {
+	return AdmissionStats{
+		InFlight: a.inFlight.Load(),
+		Queued:   a.queued.Load(),
+
+		RejectedRateLimited:  a.rateLimited.Load(),
+		RejectedQueueFull:    a.queueFull.Load(),
+		RejectedQueueTimeout: a.queueTimeout.Load(),
+	}
+}
+
+// sourceLimiter is a token bucket per source IP, or per /64 for IPv6.
+type sourceLimiter struct {
+	rate  float64 // tokens per second
+	burst float64
+
+	nowFunc func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// sourceSweepInterval is how often buckets that have filled back up, and so
+// are no different from a new one, are dropped.
+const sourceSweepInterval = time.Minute
+
+func newSourceLimiter(rate float64, burst int) *sourceLimiter {
+	return &sourceLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		nowFunc: time.Now,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+func (s *sourceLimiter) allow(addr net.Addr) bool {
+	source := sourceKey(addr)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.nowFunc()
+	if now.Sub(s.lastSweep) > sourceSweepInterval {
+		for k, b := range s.buckets {
+			if s.refill(b, now) >= s.burst {
+				delete(s.buckets, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	b, ok := s.buckets[source]
+	if !ok {
+		b = &tokenBucket{tokens: s.burst, last: now}
+		s.buckets[source] = b
+	}
+
+	if s.refill(b, now) < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sourceKey is what `addr` is rate limited by: its IP, except for IPv6 where
+// a single host is usually given a whole /64 to pick addresses from.
+func sourceKey(addr net.Addr) string {
+	source := addr.String()
+	if host, _, err := net.SplitHostPort(source); err == nil {
+		source = host
+	}
+
+	ip, err := netip.ParseAddr(source)
+	if err != nil {
+		return source
+	}
+	if ip = ip.Unmap(); ip.Is6() {
+		return netip.PrefixFrom(ip.WithZone(""), 64).Masked().String()
+	}
+	return ip.String()
+}
+
+// refill tops `b` up for the time that has passed since it was last used.
+func (s *sourceLimiter) refill(b *tokenBucket, now time.Time) float64 {
+	b.tokens = min(s.burst, b.tokens+now.Sub(b.last).Seconds()*s.rate)
+	b.last = now
+	return b.tokens
+}
@@ -0,0 +1,277 @@
+package roast_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	roast "github.com/thomasdesr/roast"
+	"github.com/thomasdesr/roast/gcisigner"
+)
+
+func TestPerSourceRateLimit(t *testing.T) {
+	l, _ := localValidListenerAndDialer(t)
+	if err := roast.WithPerSourceRateLimit(0.001, 2)(l); err != nil {
+		t.Fatal(err)
+	}
+	accepted := acceptAll(t, l)
+
+	// The first two connections use up the burst, the third is turned away
+	for i := 0; i < 2; i++ {
+		rawDial(t, l)
+		select {
+		case <-accepted:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("connection %d wasn't accepted", i)
+		}
+	}
+
+	checkRejected(t, rawDial(t, l))
+
+	if n := l.AdmissionStats().RejectedRateLimited; n != 1 {
+		t.Errorf("expected 1 connection to be rate limited, got %d", n)
+	}
+}
+
+func TestPerSourceRateLimitGroupsIPv6By64(t *testing.T) {
+	l, _ := localValidListenerAndDialer(t)
+	if err := roast.WithPerSourceRateLimit(0.001, 1)(l); err != nil {
+		t.Fatal(err)
+	}
+	l.Listener = &fakeSourceListener{Listener: l.Listener, sources: []string{
+		"[2001:db8::1]:1000",
+		"[2001:db8::ffff]:1000",  // same /64, so over the limit
+		"[2001:db8:0:1::1]:1000", // the next /64 over
+		"192.0.2.1:1000",
+		"192.0.2.2:1000", // IPv4 is still limited by address
+	}}
+	accepted := acceptAll(t, l)
+
+	var sources []string
+	for range 5 {
+		rawDial(t, l)
+	}
+	for range 4 {
+		select {
+		case c := <-accepted:
+			sources = append(sources, c.RemoteAddr().String())
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only accepted %v", sources)
+		}
+	}
+
+	want := []string{"[2001:db8::1]:1000", "[2001:db8:0:1::1]:1000", "192.0.2.1:1000", "192.0.2.2:1000"}
+	if !slices.Equal(sources, want) {
+		t.Errorf("expected %v to be accepted, got %v", want, sources)
+	}
+	if n := l.AdmissionStats().RejectedRateLimited; n != 1 {
+		t.Errorf("expected 1 connection to be rate limited, got %d", n)
+	}
+}
+
+func TestHandshakeQueue(t *testing.T) {
+	l, _ := localValidListenerAndDialer(t)
+	if err := roast.WithMaxInFlightHandshakes(1)(l); err != nil {
+		t.Fatal(err)
+	}
+	if err := roast.WithHandshakeQueueDepth(1)(l); err != nil {
+		t.Fatal(err)
+	}
+	accepted := acceptAll(t, l)
+
+	// Neither of these clients ever says hello, so the first holds the only
+	// handshake slot and the second waits in the queue.
+	for i := 0; i < 2; i++ {
+		rawDial(t, l)
+		select {
+		case <-accepted:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("connection %d wasn't accepted", i)
+		}
+	}
+
+	waitFor(t, func() bool {
+		stats := l.AdmissionStats()
+		return stats.InFlight == 1 && stats.Queued == 1
+	})
+
+	// Which leaves no room for a third
+	checkRejected(t, rawDial(t, l))
+
+	if n := l.AdmissionStats().RejectedQueueFull; n != 1 {
+		t.Errorf("expected 1 connection to be rejected for a full queue, got %d", n)
+	}
+}
+
+func TestHandshakeQueueTimeout(t *testing.T) {
+	l, d := localValidListenerAndDialer(t)
+	if err := roast.WithHandshakeTimeout[roast.Listener](200 * time.Millisecond)(l); err != nil {
+		t.Fatal(err)
+	}
+	if err := roast.WithMaxInFlightHandshakes(1)(l); err != nil {
+		t.Fatal(err)
+	}
+	if err := roast.WithHandshakeQueueDepth(1)(l); err != nil {
+		t.Fatal(err)
+	}
+
+	// Hold the only slot, verifying the first client, for longer than the
+	// queued connection will wait
+	release := make(chan struct{})
+	defer close(release)
+	serverVerifier := l.Verifier
+	l.Verifier = verifierFunc(func(ctx context.Context, msg *gcisigner.UnverifiedMessage) (*gcisigner.VerifiedMessage, error) {
+		<-release
+		return serverVerifier.Verify(ctx, msg)
+	})
+	accepted := acceptAll(t, l)
+
+	go d.DialContext(context.Background(), l.Addr().Network(), l.Addr().String())
+	<-accepted
+	waitFor(t, func() bool { return l.AdmissionStats().InFlight == 1 })
+
+	rawDial(t, l)
+	queued := <-accepted
+
+	if _, err := queued.Read(make([]byte, 1)); !errors.Is(err, roast.ErrHandshakeQueueTimeout) {
+		t.Errorf("expected %v, got %v", roast.ErrHandshakeQueueTimeout, err)
+	}
+	if n := l.AdmissionStats().RejectedQueueTimeout; n != 1 {
+		t.Errorf("expected 1 connection to time out in the queue, got %d", n)
+	}
+}
+
+func TestHandshakeQueueWaitCountsAgainstTimeout(t *testing.T) {
+	const timeout = time.Second
+
+	l, d := localValidListenerAndDialer(t)
+	if err := roast.WithHandshakeTimeout[roast.Listener](timeout)(l); err != nil {
+		t.Fatal(err)
+	}
+	if err := roast.WithMaxInFlightHandshakes(1)(l); err != nil {
+		t.Fatal(err)
+	}
+	if err := roast.WithHandshakeQueueDepth(1)(l); err != nil {
+		t.Fatal(err)
+	}
+
+	// Hold the only slot for most of the timeout
+	release := make(chan struct{})
+	serverVerifier := l.Verifier
+	l.Verifier = verifierFunc(func(ctx context.Context, msg *gcisigner.UnverifiedMessage) (*gcisigner.VerifiedMessage, error) {
+		<-release
+		return serverVerifier.Verify(ctx, msg)
+	})
+	accepted := acceptAll(t, l)
+
+	go d.DialContext(context.Background(), l.Addr().Network(), l.Addr().String())
+	<-accepted
+	waitFor(t, func() bool { return l.AdmissionStats().InFlight == 1 })
+
+	// This client gets the slot once it's freed, but never says hello, so it
+	// only has what's left of its timeout to do so
+	started := time.Now()
+	rawDial(t, l)
+	queued := <-accepted
+	time.AfterFunc(timeout*7/10, func() { close(release) })
+
+	if _, err := queued.Read(make([]byte, 1)); err == nil || errors.Is(err, roast.ErrHandshakeQueueTimeout) {
+		t.Fatalf("expected the handshake to time out after leaving the queue, got %v", err)
+	}
+	if waited := time.Since(started); waited > timeout*14/10 {
+		t.Errorf("expected the handshake to give up about %v after the connection was accepted, took %v", timeout, waited)
+	}
+}
+
+func TestAdmissionOptionsRejectInvalidLimits(t *testing.T) {
+	for name, opt := range map[string]roast.Option[roast.Listener]{
+		"no handshakes":  roast.WithMaxInFlightHandshakes(0),
+		"negative queue": roast.WithHandshakeQueueDepth(-1),
+		"zero rate":      roast.WithPerSourceRateLimit(0, 1),
+		"zero burst":     roast.WithPerSourceRateLimit(1, 0),
+	} {
+		if err := opt(&roast.Listener{}); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+// fakeSourceListener is a net.Listener whose connections claim to come from
+// each of `sources` in turn.
+type fakeSourceListener struct {
+	net.Listener
+	sources []string
+
+	accepted int
+}
+
+func (l *fakeSourceListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	remote, err := net.ResolveTCPAddr("tcp", l.sources[l.accepted%len(l.sources)])
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	l.accepted++
+
+	return &remoteAddrConn{Conn: c, remote: remote}, nil
+}
+
+// acceptAll accepts connections from `l` until the test ends.
+func acceptAll(t *testing.T, l *roast.Listener) <-chan net.Conn {
+	accepted := make(chan net.Conn, 16)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { c.Close() })
+			accepted <- c
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+
+	return accepted
+}
+
+// rawDial opens a TCP connection to `l` without doing a handshake.
+func rawDial(t *testing.T, l *roast.Listener) net.Conn {
+	t.Helper()
+
+	c, err := net.Dial(l.Addr().Network(), l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	return c
+}
+
+// checkRejected checks that the Listener closed `c` without a word.
+func checkRejected(t *testing.T, c net.Conn) {
+	t.Helper()
+
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := c.Read(make([]byte, 1)); n != 0 || !errors.Is(err, io.EOF) {
+		t.Errorf("expected the connection to be closed, got %d bytes and %v", n, err)
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package roast
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/thomasdesr/roast/gcisigner"
+	"github.com/thomasdesr/roast/internal/errorutil"
+)
+
+// AlertCategory describes why a peer rejected a handshake.
+//
+// Alerts are sent to peers that have not (successfully) authenticated, so
+// categories are deliberately coarse: they say what kind of thing went wrong,
+// never anything about the configuration that caused it, e.g. which roles are
+// allowed.
+type AlertCategory uint8
+
+const (
+	// AlertHandshakeFailure is sent when no more specific category applies.
+	AlertHandshakeFailure AlertCategory = iota + 1
+
+	// AlertMalformedHello is sent when a hello couldn't be parsed.
+	AlertMalformedHello
+
+	// AlertSignatureInvalid is sent when STS refused to vouch for a hello, or
+	// the hello was a replay.
+	AlertSignatureInvalid
+
+	// AlertStaleHello is sent when a hello was signed too long ago (or too far
+	// in the future), which usually means one side's clock is off.
+	AlertStaleHello
+
+	// AlertPeerRoleNotAllowed is sent when a hello was validly signed, but by
+	// a principal the receiver doesn't accept.
+	AlertPeerRoleNotAllowed
+
+	// AlertVerifierUnavailable is sent when a hello couldn't be checked at
+	// all, e.g. because STS was unreachable.
+	AlertVerifierUnavailable
+
+	// AlertVersionUnsupported is sent when there is no protocol version both
+	// peers speak.
+	AlertVersionUnsupported
+
+	// AlertAlgorithmUnsupported is sent when a peer's certificates use an
+	// algorithm the receiver doesn't accept, or the peers have no TLS key
+	// exchange in common.
+	AlertAlgorithmUnsupported
+)
+
+func (c AlertCategory) String() string {
+	switch c {
+	case AlertHandshakeFailure:
+		return "handshake failure"
+	case AlertMalformedHello:
+		return "malformed hello"
+	case AlertSignatureInvalid:
+		return "signature invalid"
+	case AlertStaleHello:
+		return "hello is stale, check both peers' clocks"
+	case AlertPeerRoleNotAllowed:
+		return "peer role not allowed"
+	case AlertVerifierUnavailable:
+		return "verifier unavailable"
+	case AlertVersionUnsupported:
+		return "version unsupported"
+	case AlertAlgorithmUnsupported:
+		return "algorithm unsupported"
+	default:
+		return fmt.Sprintf("unknown alert (%d)", uint8(c))
+	}
+}
+
+// AlertError is returned when the peer rejected the handshake and told us why.
+//
+// Alerts aren't signed, so they are only ever used to explain a failure, never
+// to decide anything. Anyone able to forge one could just as well have closed
+// the connection.
+type AlertError struct {
+	Category AlertCategory
+
+	// Versions lists the protocol versions the peer supports. It is only set
+	// for AlertVersionUnsupported.
+	Versions []ProtocolVersion
+}
+
+func (e *AlertError) Error() string {
+	if e.Category == AlertVersionUnsupported && len(e.Versions) > 0 {
+		return fmt.Sprintf("handshake rejected by peer: %v (peer supports %v)", e.Category, e.Versions)
+	}
+	return fmt.Sprintf("handshake rejected by peer: %v", e.Category)
+}
+
+// Unwrap lets errors.Is match an AlertVersionUnsupported alert against
+// ErrNoCommonProtocolVersion, the same as if we'd failed to negotiate locally.
+func (e *AlertError) Unwrap() error {
+	if e.Category == AlertVersionUnsupported {
+		return ErrNoCommonProtocolVersion
+	}
+	return nil
+}
+
+// alert is the payload of an alert frame.
+type alert struct {
+	Category AlertCategory
+	Versions []ProtocolVersion `json:",omitempty"`
+}
+
+// alertFor picks the alert to send a peer whose handshake failed with `err`.
+func alertFor(err error, hc *handshakeConfig) alert {
+	switch {
+	case errors.Is(err, ErrNoCommonProtocolVersion):
+		return alert{Category: AlertVersionUnsupported, Versions: hc.protocolVersions()}
+	case errors.Is(err, ErrCertificateAlgorithmNotAccepted), errors.Is(err, ErrNoCommonKeyExchange):
+		return alert{Category: AlertAlgorithmUnsupported}
+	case errors.Is(err, ErrMalformedFrame), errors.Is(err, ErrFrameTooLarge), errors.Is(err, ErrInvalidClaims):
+		return alert{Category: AlertMalformedHello}
+	case errors.Is(err, gcisigner.ErrStaleMessage):
+		return alert{Category: AlertStaleHello}
+	case errors.Is(err, gcisigner.ErrSignatureInvalid),
+		errors.Is(err, gcisigner.ErrReplayedMessage),
+		errors.Is(err, ErrTranscriptMismatch):
+		return alert{Category: AlertSignatureInvalid}
+	case errors.Is(err, gcisigner.ErrInvalidSource):
+		return alert{Category: AlertPeerRoleNotAllowed}
+	case errors.Is(err, gcisigner.ErrVerifierUnavailable):
+		return alert{Category: AlertVerifierUnavailable}
+	default:
+		return alert{Category: AlertHandshakeFailure}
+	}
+}
+
+// sendAlert tells the peer why we're rejecting its handshake. It's best
+// effort, we're about to hang up on the peer either way.
+func sendAlert(w io.Writer, err error, hc *handshakeConfig) {
+	// There is no one left to tell
+	if hungUp(err) {
+		return
+	}
+
+	// Don't answer an alert with an alert
+	var alertErr *AlertError
+	if errors.As(err, &alertErr) {
+		return
+	}
+
+	payload, mErr := json.Marshal(alertFor(err, hc))
+	if mErr != nil {
+		return
+	}
+
+	writeFrame(w, frameTypeAlert, payload)
+}
+
+// parseAlert turns the payload of an alert frame into an *AlertError.
+func parseAlert(payload []byte) error {
+	var a alert
+	if err := json.Unmarshal(payload, &a); err != nil {
+		return errorutil.Wrap(fmt.Errorf("%w: %w", ErrMalformedFrame, err), "failed to unmarshal alert")
+	}
+
+	return &AlertError{Category: a.Category, Versions: a.Versions}
+}
+
+// alertConn surfaces an alert a peer sent in place of its first TLS record as
+// an *AlertError, rather than leaving crypto/tls to choke on it. TLS records
+// never start with frameMagic's first byte, so there's no ambiguity.
+type alertConn struct {
+	net.Conn
+
+	sniffed bool
+}
+
+func (c *alertConn) Read(p []byte) (int, error) {
+	if c.sniffed || len(p) == 0 {
+		return c.Conn.Read(p)
+	}
+
+	n, err := c.Conn.Read(p[:1])
+	if n == 0 {
+		return 0, err
+	}
+	c.sniffed = true
+
+	if p[0] != frameMagic[0] {
+		return n, err
+	}
+
+	typ, payload, err := readFrame(io.MultiReader(bytes.NewReader(p[:1]), c.Conn))
+	if err != nil {
+		return 0, err
+	}
+	if typ != frameTypeAlert {
+		return 0, errorutil.Wrapf(ErrMalformedFrame, "expected TLS or an alert, got frame type %d", typ)
+	}
+
+	return 0, parseAlert(payload)
+}
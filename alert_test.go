@@ -0,0 +1,113 @@
+package roast_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	roast "github.com/thomasdesr/roast"
+	"github.com/thomasdesr/roast/gcisigner"
+)
+
+// secretRole stands in for allowlist contents, which must never end up in an
+// alert.
+const secretRole = "arn:aws:iam::1234567890:role/SecretlyAllowedRole"
+
+func TestServerAlertsRejectedClients(t *testing.T) {
+	for name, tc := range map[string]struct {
+		err  error
+		want roast.AlertCategory
+	}{
+		"role not allowed": {
+			err:  fmt.Errorf("%w: only %s is allowed", gcisigner.ErrInvalidSource, secretRole),
+			want: roast.AlertPeerRoleNotAllowed,
+		},
+		"bad signature": {
+			err:  fmt.Errorf("%w: 403 Forbidden", gcisigner.ErrSignatureInvalid),
+			want: roast.AlertSignatureInvalid,
+		},
+		"stale": {
+			err:  &gcisigner.ReplayError{Reason: gcisigner.ErrStaleMessage},
+			want: roast.AlertStaleHello,
+		},
+		"sts down": {
+			err:  fmt.Errorf("%w: 503 Service Unavailable", gcisigner.ErrVerifierUnavailable),
+			want: roast.AlertVerifierUnavailable,
+		},
+		"anything else": {
+			err:  errors.New("something went wrong"),
+			want: roast.AlertHandshakeFailure,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			l, d := localValidListenerAndDialer(t)
+			l.Verifier = failingVerifier{tc.err}
+
+			server, client := upgradePair(t, l.UpgradeServerConn, d.UpgradeClientConn)
+			if !errors.Is(server.err, tc.err) {
+				t.Errorf("expected server to fail with %v, got %v", tc.err, server.err)
+			}
+
+			var alertErr *roast.AlertError
+			if !errors.As(client.err, &alertErr) {
+				t.Fatalf("expected client to be sent an alert, got %v", client.err)
+			}
+			if alertErr.Category != tc.want {
+				t.Errorf("expected a %q alert, got %q", tc.want, alertErr.Category)
+			}
+			if strings.Contains(client.err.Error(), secretRole) {
+				t.Errorf("alert leaked the server's allowlist: %v", client.err)
+			}
+		})
+	}
+}
+
+func TestUnsupportedVersionsFailBothSides(t *testing.T) {
+	l, d := localValidListenerAndDialer(t)
+
+	v1Only, err := roast.NewListener(nil, nil, roast.WithProtocolVersions[roast.Listener](roast.ProtocolVersion1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1Only.Signer, v1Only.Verifier = l.Signer, l.Verifier
+
+	server, client := upgradePair(t, v1Only.UpgradeServerConn, pinnedDialer(t, d, roast.ProtocolVersion2).UpgradeClientConn)
+
+	// Framed servers say which versions they support, so the client can tell
+	// the user what it would've needed without being sent an alert.
+	if !errors.Is(client.err, roast.ErrNoCommonProtocolVersion) {
+		t.Errorf("expected client to fail with %v, got %v", roast.ErrNoCommonProtocolVersion, client.err)
+	} else if !strings.Contains(client.err.Error(), roast.ProtocolVersion1.String()) {
+		t.Errorf("expected client error to list the server's versions, got %v", client.err)
+	}
+
+	if !errors.Is(server.err, roast.ErrNoCommonProtocolVersion) {
+		t.Errorf("expected server to fail with %v, got %v", roast.ErrNoCommonProtocolVersion, server.err)
+	}
+}
+
+func TestClientAlertsRejectedServers(t *testing.T) {
+	l, d := localValidListenerAndDialer(t)
+	d.Verifier = failingVerifier{fmt.Errorf("%w: only %s is allowed", gcisigner.ErrInvalidSource, secretRole)}
+
+	server, client := upgradePair(t, l.UpgradeServerConn, d.UpgradeClientConn)
+	if !errors.Is(client.err, gcisigner.ErrInvalidSource) {
+		t.Errorf("expected client to fail with %v, got %v", gcisigner.ErrInvalidSource, client.err)
+	}
+
+	var alertErr *roast.AlertError
+	if !errors.As(server.err, &alertErr) || alertErr.Category != roast.AlertPeerRoleNotAllowed {
+		t.Fatalf("expected server to be sent a %q alert, got %v", roast.AlertPeerRoleNotAllowed, server.err)
+	}
+}
+
+// failingVerifier rejects every message with `err`.
+type failingVerifier struct {
+	err error
+}
+
+func (f failingVerifier) Verify(context.Context, *gcisigner.UnverifiedMessage) (*gcisigner.VerifiedMessage, error) {
+	return nil, f.err
+}
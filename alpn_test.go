@@ -0,0 +1,75 @@
+package roast_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	roast "github.com/thomasdesr/roast"
+)
+
+func TestNextProtos(t *testing.T) {
+	for name, tc := range map[string]struct {
+		client []string
+		want   string
+	}{
+		"h2":                 {client: []string{"h2", "http/1.1"}, want: "h2"},
+		"http/1.1":           {client: []string{"http/1.1"}, want: "http/1.1"},
+		"custom":             {client: []string{"custom/1"}, want: "custom/1"},
+		"client offers none": {client: nil, want: ""},
+	} {
+		t.Run(name, func(t *testing.T) {
+			l, d := localValidListenerAndDialer(t)
+			if err := roast.WithNextProtos[roast.Listener]("h2", "http/1.1", "custom/1")(l); err != nil {
+				t.Fatal(err)
+			}
+			if tc.client != nil {
+				if err := roast.WithNextProtos[roast.Dialer](tc.client...)(d); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			server, client := dialPair(t, l, d)
+
+			if got := server.(*roast.Conn).NegotiatedProtocol(); got != tc.want {
+				t.Errorf("expected server to negotiate %q, got %q", tc.want, got)
+			}
+			if got := client.(*roast.Conn).NegotiatedProtocol(); got != tc.want {
+				t.Errorf("expected client to negotiate %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestNextProtosWithNothingInCommon(t *testing.T) {
+	l, d := localValidListenerAndDialer(t)
+	if err := roast.WithNextProtos[roast.Listener]("h2")(l); err != nil {
+		t.Fatal(err)
+	}
+	if err := roast.WithNextProtos[roast.Dialer]("custom/2")(d); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			defer c.Close()
+			c.(*roast.Conn).HandshakeContext(context.Background())
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if c, err := d.DialContext(ctx, l.Addr().Network(), l.Addr().String()); err == nil {
+		c.Close()
+		t.Fatal("expected the handshake to fail")
+	}
+}
+
+func TestNextProtosRejectsInvalidNames(t *testing.T) {
+	for _, protos := range [][]string{nil, {""}, {string(make([]byte, 256))}} {
+		if err := roast.WithNextProtos[roast.Dialer](protos...)(&roast.Dialer{}); err == nil {
+			t.Errorf("expected %q to be rejected", protos)
+		}
+	}
+}
@@ -1,22 +1,52 @@
 package roast
 
 import (
+	"errors"
+
 	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/thomasdesr/roast/gcisigner/source_verifiers"
 	"github.com/thomasdesr/roast/gcisigner/source_verifiers/sources"
 	"github.com/thomasdesr/roast/internal/errorutil"
 )
 
-func parseRolesToSources(maybeRoles []arn.ARN) ([]sources.Role, error) {
-	srcs := make([]sources.Role, 0, len(maybeRoles))
+// describePrincipal fills in what the peer's Role says about it: what type of
+// principal it is, and for assumed roles the session name and any IAM
+// Identity Center user. The role's name alone can't show the peer is an IAM
+// Identity Center user (see sources.SSOSessionOf), so that is only filled in
+// if source_verifiers.MatchesAnyPermissionSet admitted it, which checked.
+func (p *PeerMetadata) describePrincipal() {
+	principal, err := sources.PrincipalFromARN(p.Role)
+	if err != nil {
+		return
+	}
+	p.PrincipalType = principal.Type()
+
+	assumedRole, ok := principal.(sources.AssumedRole)
+	if !ok {
+		return
+	}
+	p.SessionName = assumedRole.SessionName()
+
+	if session, ok := sources.SSOSessionOf(assumedRole); ok && p.identity.matchedRule == session.PermissionSet().String() {
+		p.SSOUserName = session.UserName()
+		p.PermissionSet = session.PermissionSet().Name()
+	}
+}
 
-	for _, arn := range maybeRoles {
-		role, err := sources.FromARN[sources.Role](arn)
-		if err != nil {
-			return nil, errorutil.Wrap(err, "failed to create server role from ARN")
+// defaultSourceVerifier returns the source verifier for the default Verifier:
+// the one set by WithSourceVerifier, or else one accepting `allowedRoles`.
+func (hc *handshakeConfig) defaultSourceVerifier(allowedRoles []arn.ARN) (source_verifiers.Verifier, error) {
+	if hc.sourceVerifier != nil {
+		if len(allowedRoles) > 0 {
+			return nil, errors.New("allowed roles can't be given along with a source verifier")
 		}
+		return hc.sourceVerifier, nil
+	}
 
-		srcs = append(srcs, role)
+	v, err := source_verifiers.MatchesAnyPrincipal(allowedRoles)
+	if err != nil {
+		return nil, errorutil.Wrap(err, "failed to create source verifier from ARNs")
 	}
 
-	return srcs, nil
+	return v, nil
 }
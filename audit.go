@@ -0,0 +1,129 @@
+package roast
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/thomasdesr/roast/gcisigner"
+)
+
+// AuditDecision is whether a handshake let the peer in.
+type AuditDecision string
+
+const (
+	AuditDecisionAllow AuditDecision = "allow"
+	AuditDecisionDeny  AuditDecision = "deny"
+)
+
+// AuditRecord describes the authorization decision made by one handshake.
+type AuditRecord struct {
+	Time time.Time
+
+	// ConnectionID matches the PeerMetadata.ConnectionID of the connection.
+	ConnectionID string
+
+	// Side is "client" for handshakes we dialed and "server" for those we
+	// accepted.
+	Side       string
+	LocalAddr  string
+	RemoteAddr string
+
+	// CallerARN, UserID and Account are who STS verified the peer as, and
+	// STSRequestID the ID of the request it did so in. They are empty if the
+	// handshake failed before the peer was verified.
+	CallerARN    string `json:",omitempty"`
+	UserID       string `json:",omitempty"`
+	Account      string `json:",omitempty"`
+	STSRequestID string `json:",omitempty"`
+
+	Decision AuditDecision
+
+	// MatchedRule is the rule that allowed the peer in, or that denied it, if
+	// the Verifier says (see source_verifiers.Matcher).
+	MatchedRule string `json:",omitempty"`
+
+	// Resumed is set when the peer was allowed in by resuming an earlier
+	// session, which the rest of the record describes.
+	Resumed bool `json:",omitempty"`
+
+	// Stage and Reason say where and why a denied handshake failed.
+	Stage  HandshakeStage `json:",omitempty"`
+	Reason string         `json:",omitempty"`
+}
+
+// AuditSink records the outcome of every handshake, see WithAuditSink. It is
+// called from each handshake's goroutine, so must be safe to call
+// concurrently.
+type AuditSink interface {
+	Record(AuditRecord) error
+}
+
+// verifiedIdentity is what STS told us about a peer beyond its ARN and
+// account.
+type verifiedIdentity struct {
+	userID      string
+	requestID   string
+	matchedRule string
+}
+
+func verifiedIdentityOf(msg *gcisigner.VerifiedMessage) verifiedIdentity {
+	return verifiedIdentity{
+		userID:      msg.CallerIdentity.UserId,
+		requestID:   msg.RequestID,
+		matchedRule: msg.MatchedRule,
+	}
+}
+
+// newConnectionID returns a random ID for a connection.
+func newConnectionID() string {
+	id := make([]byte, 12)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// audit records the outcome of a handshake over `c` with the audit sink, if
+// there is one.
+func (hc *handshakeConfig) audit(ctx context.Context, side, connID string, c net.Conn, stage HandshakeStage, peer *PeerMetadata, err error) {
+	if hc.auditSink == nil {
+		return
+	}
+
+	r := AuditRecord{
+		Time:         time.Now(),
+		ConnectionID: connID,
+		Side:         side,
+		LocalAddr:    c.LocalAddr().String(),
+		RemoteAddr:   c.RemoteAddr().String(),
+	}
+
+	var srcErr *gcisigner.SourceError
+	switch {
+	case err == nil:
+		r.Decision = AuditDecisionAllow
+		r.CallerARN, r.Account = peer.Role.String(), peer.AccountID
+		r.UserID, r.STSRequestID = peer.identity.userID, peer.identity.requestID
+		r.MatchedRule, r.Resumed = peer.identity.matchedRule, peer.Resumed
+
+	case errors.As(err, &srcErr):
+		// The peer proved who it is, we just don't accept it
+		r.Decision, r.Stage, r.Reason = AuditDecisionDeny, stage, err.Error()
+		r.CallerARN, r.Account = srcErr.CallerIdentity.Arn, srcErr.CallerIdentity.Account
+		r.UserID, r.STSRequestID = srcErr.CallerIdentity.UserId, srcErr.RequestID
+		r.MatchedRule = srcErr.Rule
+
+	default:
+		r.Decision, r.Stage, r.Reason = AuditDecisionDeny, stage, err.Error()
+	}
+
+	if err := hc.auditSink.Record(r); err != nil {
+		hc.log().LogAttrs(ctx, slog.LevelError, "failed to record audit record",
+			slog.String("connection_id", connID),
+			slog.Any("error", err),
+		)
+	}
+}
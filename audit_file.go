@@ -0,0 +1,155 @@
+package roast
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/thomasdesr/roast/internal/errorutil"
+)
+
+// FileAuditSink is an AuditSink that appends records to a file as JSON lines,
+// rotating it once it grows past a maximum size.
+type FileAuditSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+var _ AuditSink = &FileAuditSink{}
+
+// NewFileAuditSink opens `path` for appending audit records to. Once adding
+// a record would take it past `maxSize` bytes it is renamed to `path`.1, with
+// any older files shifted along to `path`.2 and so on, keeping up to
+// `maxBackups` of them. A `maxSize` of zero never rotates the file.
+func NewFileAuditSink(path string, maxSize int64, maxBackups int) (*FileAuditSink, error) {
+	if maxSize < 0 || maxBackups < 0 {
+		return nil, fmt.Errorf("audit log size and backups must not be negative: %d, %d", maxSize, maxBackups)
+	}
+
+	s := &FileAuditSink{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Record writes `r` to the file as a line of JSON, and syncs it to disk
+// before returning: there's at most one record per handshake, and a record
+// that's lost in a crash is worse than a slower handshake.
+//
+// If the file is due to be rotated but can't be, the record is written to it
+// anyway and the error returned, and rotation is tried again with the next
+// record.
+func (s *FileAuditSink) Record(r AuditRecord) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return errorutil.Wrap(err, "failed to marshal audit record")
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.f == nil {
+		return os.ErrClosed
+	}
+
+	var rotateErr error
+	if s.maxSize > 0 && s.size > 0 && s.size+int64(len(line)) > s.maxSize {
+		rotateErr = s.rotate()
+	}
+
+	n, err := s.f.Write(line)
+	s.size += int64(n)
+	if err != nil {
+		return errorutil.Wrap(err, "failed to write audit record")
+	}
+	if err := s.f.Sync(); err != nil {
+		return errorutil.Wrap(err, "failed to sync audit log")
+	}
+
+	return rotateErr
+}
+
+// Close closes the file, after which records can't be written.
+func (s *FileAuditSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.f == nil {
+		return nil
+	}
+
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
+
+func (s *FileAuditSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return errorutil.Wrap(err, "failed to open audit log")
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errorutil.Wrap(err, "failed to stat audit log")
+	}
+
+	s.f, s.size = f, info.Size()
+	return nil
+}
+
+// rotate moves the current file out of the way and starts a new one. If it
+// fails, the current file is left open so records can still be written. The
+// caller must hold s.mu.
+func (s *FileAuditSink) rotate() error {
+	if s.maxBackups == 0 {
+		if err := s.f.Truncate(0); err != nil {
+			return errorutil.Wrap(err, "failed to truncate audit log")
+		}
+		s.size = 0
+		return nil
+	}
+
+	for i := s.maxBackups - 1; i > 0; i-- {
+		err := os.Rename(s.backup(i), s.backup(i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return errorutil.Wrap(err, "failed to rotate audit log")
+		}
+	}
+	if err := os.Rename(s.path, s.backup(1)); err != nil {
+		return errorutil.Wrap(err, "failed to rotate audit log")
+	}
+
+	old := s.f
+	if err := s.open(); err != nil {
+		// Put the file we still have open back, so the next rotation starts
+		// from where this one did
+		if renameErr := os.Rename(s.backup(1), s.path); renameErr != nil {
+			return fmt.Errorf("%w, then failed to move audit log back: %w", err, renameErr)
+		}
+		return err
+	}
+
+	if err := old.Close(); err != nil {
+		return errorutil.Wrap(err, "failed to close rotated audit log")
+	}
+	return nil
+}
+
+func (s *FileAuditSink) backup(i int) string {
+	return fmt.Sprintf("%s.%d", s.path, i)
+}
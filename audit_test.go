@@ -0,0 +1,210 @@
+package roast_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	roast "github.com/thomasdesr/roast"
+	"github.com/thomasdesr/roast/gcisigner"
+)
+
+func TestAuditSink(t *testing.T) {
+	l, d := localValidListenerAndDialer(t)
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := roast.NewFileAuditSink(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	if err := roast.WithAuditSink[roast.Listener](sink)(l); err != nil {
+		t.Fatal(err)
+	}
+
+	verifier := &stsVerifier{Verifier: l.Verifier, requestID: "allowed-request", rule: "ClientRole"}
+	l.Verifier = verifier
+	server, client := upgradePair(t, l.UpgradeServerConn, d.UpgradeClientConn)
+	if server.err != nil || client.err != nil {
+		t.Fatalf("handshake failed: server=%v client=%v", server.err, client.err)
+	}
+
+	verifier.requestID, verifier.deny = "denied-request", true
+	upgradePair(t, l.UpgradeServerConn, d.UpgradeClientConn)
+
+	records := readAuditLog(t, path)
+	if len(records) != 2 {
+		t.Fatalf("expected 2 audit records, got %+v", records)
+	}
+
+	allowed, denied := records[0], records[1]
+	if allowed.Decision != roast.AuditDecisionAllow || allowed.Side != "server" {
+		t.Errorf("expected an allow record for the server, got %+v", allowed)
+	}
+	if allowed.ConnectionID == "" || allowed.ConnectionID != server.peer.ConnectionID {
+		t.Errorf("expected the record's connection ID %q to match the connection's %q", allowed.ConnectionID, server.peer.ConnectionID)
+	}
+	if allowed.CallerARN != server.peer.Role.String() || allowed.UserID != "AROACLIENT:ClientRoleSession" || allowed.STSRequestID != "allowed-request" || allowed.MatchedRule != "ClientRole" {
+		t.Errorf("expected the record to describe the verified peer, got %+v", allowed)
+	}
+
+	if denied.Decision != roast.AuditDecisionDeny || denied.Stage != roast.HandshakeStageSource || denied.Reason == "" {
+		t.Errorf("expected a deny record at source verification, got %+v", denied)
+	}
+	if denied.CallerARN != allowed.CallerARN || denied.STSRequestID != "denied-request" || denied.MatchedRule != "" {
+		t.Errorf("expected the deny record to say who was denied, got %+v", denied)
+	}
+	if denied.ConnectionID == allowed.ConnectionID {
+		t.Errorf("expected each connection to get its own ID, got %q twice", denied.ConnectionID)
+	}
+}
+
+func TestFileAuditSinkRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	const maxSize = 300
+	sink, err := roast.NewFileAuditSink(path, maxSize, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	for i := range 20 {
+		if err := sink.Record(roast.AuditRecord{
+			Time:         time.Now(),
+			ConnectionID: fmt.Sprint(i),
+			Side:         "server",
+			Decision:     roast.AuditDecisionAllow,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The newest records are in the current file, then each backup in turn
+	var newest []string
+	for _, p := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > maxSize {
+			t.Errorf("expected %s to be rotated before growing past %d bytes, it's %d", p, maxSize, info.Size())
+		}
+
+		records := readAuditLog(t, p)
+		if len(records) == 0 {
+			t.Fatalf("expected %s to have records in it", p)
+		}
+		newest = append(newest, records[len(records)-1].ConnectionID)
+	}
+	if newest[0] != "19" {
+		t.Errorf("expected the last record in the current file, got %q", newest[0])
+	}
+
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected only 2 backups to be kept, got: %v", err)
+	}
+}
+
+func TestFileAuditSinkKeepsRecordingWhenRotationFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	const maxSize = 300
+	sink, err := roast.NewFileAuditSink(path, maxSize, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	// Nothing can be renamed over a directory that isn't empty
+	if err := os.MkdirAll(filepath.Join(path+".1", "blocker"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	record := func(i int) error {
+		return sink.Record(roast.AuditRecord{
+			Time:         time.Now(),
+			ConnectionID: fmt.Sprint(i),
+			Side:         "server",
+			Decision:     roast.AuditDecisionAllow,
+		})
+	}
+
+	var failed int
+	for i := range 10 {
+		if err := record(i); err != nil {
+			failed++
+		}
+	}
+	if failed == 0 {
+		t.Fatal("expected rotating into a directory to fail")
+	}
+	if records := readAuditLog(t, path); len(records) != 10 {
+		t.Fatalf("expected every record to be written despite failing to rotate, got %d", len(records))
+	}
+
+	// Once the way is clear it's tried again
+	if err := os.RemoveAll(path + ".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := record(10); err != nil {
+		t.Fatalf("expected rotation to recover, got %v", err)
+	}
+
+	if rotated := readAuditLog(t, path+".1"); len(rotated) != 10 {
+		t.Errorf("expected the oversized file to be rotated, got %d records in the backup", len(rotated))
+	}
+	if current := readAuditLog(t, path); len(current) != 1 || current[0].ConnectionID != "10" {
+		t.Errorf("expected only the newest record in the current file, got %+v", current)
+	}
+}
+
+// stsVerifier wraps a Verifier with the extra details a real STS response
+// would add, or rejects the verified caller as a source verifier would.
+type stsVerifier struct {
+	gcisigner.Verifier
+
+	requestID, rule string
+	deny            bool
+}
+
+func (v *stsVerifier) Verify(ctx context.Context, msg *gcisigner.UnverifiedMessage) (*gcisigner.VerifiedMessage, error) {
+	verified, err := v.Verifier.Verify(ctx, msg)
+	if err != nil {
+		return nil, err
+	}
+	verified.CallerIdentity.UserId = "AROACLIENT:ClientRoleSession"
+
+	if v.deny {
+		return nil, &gcisigner.SourceError{CallerIdentity: verified.CallerIdentity, RequestID: v.requestID}
+	}
+
+	verified.RequestID, verified.MatchedRule = v.requestID, v.rule
+	return verified, nil
+}
+
+func readAuditLog(t *testing.T, path string) []roast.AuditRecord {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var records []roast.AuditRecord
+	for s := bufio.NewScanner(f); s.Scan(); {
+		var r roast.AuditRecord
+		if err := json.Unmarshal(s.Bytes(), &r); err != nil {
+			t.Fatalf("invalid audit record %q: %v", s.Text(), err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
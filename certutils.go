@@ -1,8 +1,7 @@
 package roast
 
 import (
-	"crypto/ecdsa"
-	"crypto/elliptic"
+	"crypto"
 	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
@@ -16,14 +15,17 @@ import (
 )
 
 type caBundle struct {
-	priv *ecdsa.PrivateKey
+	priv crypto.Signer
 	cert *x509.Certificate
 
 	certPEM []byte
+
+	// algorithm is used for the CA and every leaf certificate it signs
+	algorithm CertificateAlgorithm
 }
 
-func makeLocalCA() (*caBundle, error) {
-	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+func makeLocalCA(alg CertificateAlgorithm) (*caBundle, error) {
+	priv, err := alg.generateKey()
 	if err != nil {
 		return nil, errorutil.Wrap(err, "generate keys")
 	}
@@ -34,7 +36,7 @@ func makeLocalCA() (*caBundle, error) {
 	template.BasicConstraintsValid = true
 
 	// Self-sign ourselves
-	certDERBytes, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	certDERBytes, err := x509.CreateCertificate(rand.Reader, template, template, priv.Public(), priv)
 	if err != nil {
 		return nil, errorutil.Wrap(err, "create certificate")
 	}
@@ -54,6 +56,8 @@ func makeLocalCA() (*caBundle, error) {
 		priv: priv,
 
 		certPEM: certPEM,
+
+		algorithm: alg,
 	}, nil
 }
 
@@ -76,9 +80,28 @@ func baseX509Cert() *x509.Certificate {
 type clientHello struct {
 	ClientCA        []byte   // PEM-encoded
 	ServerHostnames []string // DNS names or IP addresses
+
+	// Versions and Capabilities are what the client is willing to speak. They
+	// are absent from the hellos of clients that predate version negotiation.
+	Versions     []ProtocolVersion `json:",omitempty"`
+	Capabilities []Capability      `json:",omitempty"`
+
+	// CertificateAlgorithms are the algorithms the client accepts for the
+	// server's certificates, and KeyExchanges the TLS key exchange groups it
+	// supports. Both are absent from the hellos of clients that predate
+	// algorithm negotiation.
+	CertificateAlgorithms []CertificateAlgorithm `json:",omitempty"`
+	KeyExchanges          []tls.CurveID          `json:",omitempty"`
+
+	// Claims are application-defined metadata about the client, see WithClaims.
+	Claims Claims `json:",omitempty"`
+
+	// Nonce makes every client hello unique, even if everything else about it
+	// is the same.
+	Nonce []byte `json:",omitempty"`
 }
 
-func makeServerConfig(localCA caBundle, ch clientHello) (*tls.Config, error) {
+func makeServerConfig(localCA caBundle, ch clientHello, params tlsParams) (*tls.Config, error) {
 	serverCert, err := generateServerCert(localCA, ch.ServerHostnames)
 	if err != nil {
 		return nil, errorutil.Wrap(err, "generate server cert")
@@ -94,7 +117,11 @@ func makeServerConfig(localCA caBundle, ch clientHello) (*tls.Config, error) {
 		ClientCAs:    caCertPool,
 		ClientAuth:   tls.RequireAndVerifyClientCert,
 
-		MinVersion: tls.VersionTLS13,
+		MinVersion:       tls.VersionTLS13,
+		CurvePreferences: params.keyExchanges,
+		VerifyConnection: params.verifyConnection,
+
+		NextProtos: params.nextProtos,
 	}
 
 	return serverConfig, nil
@@ -114,7 +141,7 @@ func generateServerCert(localCA caBundle, serverHostnames []string) (*tls.Certif
 		}
 	}
 
-	serverPriv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	serverPriv, err := localCA.algorithm.generateKey()
 	if err != nil {
 		return nil, errorutil.Wrap(err, "generate server keys")
 	}
@@ -123,7 +150,7 @@ func generateServerCert(localCA caBundle, serverHostnames []string) (*tls.Certif
 		rand.Reader,
 		serverCertTemplate,
 		localCA.cert,
-		&serverPriv.PublicKey,
+		serverPriv.Public(),
 		localCA.priv,
 	)
 	if err != nil {
@@ -144,9 +171,41 @@ func generateServerCert(localCA caBundle, serverHostnames []string) (*tls.Certif
 
 type serverHello struct {
 	ServerCA []byte // PEM-encoded
+
+	// Version is what the server selected from the client's hello. It is only
+	// sent to unframed clients, and is absent from the hellos of servers that
+	// predate version negotiation.
+	Version ProtocolVersion `json:",omitempty"`
+
+	// Versions is every version the server supports. Framed clients are sent
+	// this instead of Version, as the server answers them before it has
+	// verified (and so can act on) their hello. Both sides then make the same
+	// choice independently.
+	Versions []ProtocolVersion `json:",omitempty"`
+
+	// Capabilities are the capabilities the server selected for unframed
+	// clients, or all the capabilities it supports for framed ones.
+	Capabilities []Capability `json:",omitempty"`
+
+	// CertificateAlgorithms are the algorithms the server accepts for the
+	// client's certificates, and KeyExchanges the TLS key exchange groups it
+	// supports. Both are absent from the hellos of servers that predate
+	// algorithm negotiation.
+	CertificateAlgorithms []CertificateAlgorithm `json:",omitempty"`
+	KeyExchanges          []tls.CurveID          `json:",omitempty"`
+
+	// Claims are application-defined metadata about the server, see WithClaims.
+	Claims Claims `json:",omitempty"`
+
+	// Nonce is the server's contribution of randomness to the handshake and
+	// ClientHelloHash is the transcriptHash of the signed client hello this is
+	// a response to. Together they stop a captured server hello from being
+	// replayed to another client.
+	Nonce           []byte `json:",omitempty"`
+	ClientHelloHash []byte `json:",omitempty"`
 }
 
-func makeClientConfig(localCA caBundle, hostname string, sh serverHello) (*tls.Config, error) {
+func makeClientConfig(localCA caBundle, hostname string, sh serverHello, params tlsParams) (*tls.Config, error) {
 	clientCert, err := generateClientCert(localCA)
 	if err != nil {
 		return nil, errorutil.Wrap(err, "generate client cert")
@@ -164,7 +223,11 @@ func makeClientConfig(localCA caBundle, hostname string, sh serverHello) (*tls.C
 		// Who are we talking to? This should be the hostname of the server
 		ServerName: hostname,
 
-		MinVersion: tls.VersionTLS13,
+		MinVersion:       tls.VersionTLS13,
+		CurvePreferences: params.keyExchanges,
+		VerifyConnection: params.verifyConnection,
+
+		NextProtos: params.nextProtos,
 	}
 
 	return clientConfig, nil
@@ -176,7 +239,7 @@ func generateClientCert(localCA caBundle) (*tls.Certificate, error) {
 	clientCertTemplate.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
 
 	// TODO: Figure out if we should use some sort of local name for the client cert
-	clientPriv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	clientPriv, err := localCA.algorithm.generateKey()
 	if err != nil {
 		return nil, errorutil.Wrap(err, "generate client keys")
 	}
@@ -185,7 +248,7 @@ func generateClientCert(localCA caBundle) (*tls.Certificate, error) {
 		rand.Reader,
 		clientCertTemplate,
 		localCA.cert,
-		&clientPriv.PublicKey,
+		clientPriv.Public(),
 		localCA.priv,
 	)
 	if err != nil {
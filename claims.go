@@ -0,0 +1,122 @@
+package roast
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Claims are small pieces of application-defined metadata, such as a service
+// name, build version or deployment environment, that a peer attaches to its
+// hello with WithClaims. They are signed along with the rest of the hello, so
+// once the handshake has verified the peer they can be relied on as much as
+// its role.
+type Claims map[string]string
+
+const (
+	// MaxClaims is the most claims a hello may carry.
+	MaxClaims = 32
+
+	// MaxClaimKeySize and MaxClaimValueSize limit the size of each claim, and
+	// MaxClaimsSize all of them together.
+	MaxClaimKeySize   = 64
+	MaxClaimValueSize = 1024
+	MaxClaimsSize     = 4096
+)
+
+// ErrInvalidClaims is returned when claims break the limits above, whether
+// they are being set with WithClaims or were received from a peer.
+var ErrInvalidClaims = errors.New("invalid claims")
+
+// Get returns the value of the claim `key` and whether the peer made it.
+func (c Claims) Get(key string) (string, bool) {
+	v, ok := c[key]
+	return v, ok
+}
+
+// Int returns the claim `key` parsed as an integer. It fails if the peer
+// didn't make the claim or it isn't an integer.
+func (c Claims) Int(key string) (int64, error) {
+	v, err := c.lookup(key)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(v, 10, 64)
+}
+
+// Bool returns the claim `key` parsed with strconv.ParseBool. It fails if the
+// peer didn't make the claim or it isn't a boolean.
+func (c Claims) Bool(key string) (bool, error) {
+	v, err := c.lookup(key)
+	if err != nil {
+		return false, err
+	}
+	return strconv.ParseBool(v)
+}
+
+func (c Claims) lookup(key string) (string, error) {
+	v, ok := c[key]
+	if !ok {
+		return "", fmt.Errorf("peer made no %q claim", key)
+	}
+	return v, nil
+}
+
+// validate checks `c` against the size limits. Claims are made to be carried
+// in places like HTTP headers, so keys are restricted to letters, digits, '-',
+// '_' and '.' and must differ in more than case, and values must be valid
+// UTF-8 without control characters such as CR or LF.
+func (c Claims) validate() error {
+	if len(c) > MaxClaims {
+		return fmt.Errorf("%w: %d claims, at most %d are allowed", ErrInvalidClaims, len(c), MaxClaims)
+	}
+
+	var total int
+	folded := make(map[string]string, len(c))
+	for k, v := range c {
+		if len(k) == 0 || len(k) > MaxClaimKeySize {
+			return fmt.Errorf("%w: claim keys must be 1 to %d bytes long: %q", ErrInvalidClaims, MaxClaimKeySize, k)
+		}
+		for _, r := range k {
+			if !isClaimKeyChar(r) {
+				return fmt.Errorf("%w: claim key %q contains %q", ErrInvalidClaims, k, r)
+			}
+		}
+		if other, ok := folded[strings.ToLower(k)]; ok {
+			return fmt.Errorf("%w: claim keys %q and %q only differ in case", ErrInvalidClaims, k, other)
+		}
+		folded[strings.ToLower(k)] = k
+
+		if len(v) > MaxClaimValueSize {
+			return fmt.Errorf("%w: claim %q is %d bytes, at most %d are allowed", ErrInvalidClaims, k, len(v), MaxClaimValueSize)
+		}
+		if !utf8.ValidString(v) {
+			return fmt.Errorf("%w: claim %q isn't valid UTF-8", ErrInvalidClaims, k)
+		}
+		if i := strings.IndexFunc(v, unicode.IsControl); i >= 0 {
+			return fmt.Errorf("%w: claim %q contains control character %q", ErrInvalidClaims, k, v[i])
+		}
+
+		total += len(k) + len(v)
+	}
+
+	if total > MaxClaimsSize {
+		return fmt.Errorf("%w: claims total %d bytes, at most %d are allowed", ErrInvalidClaims, total, MaxClaimsSize)
+	}
+
+	return nil
+}
+
+func isClaimKeyChar(r rune) bool {
+	switch {
+	case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+		return true
+	case r == '-', r == '_', r == '.':
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,77 @@
+package roast_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	roast "github.com/thomasdesr/roast"
+)
+
+func TestClaims(t *testing.T) {
+	l, d := localValidListenerAndDialer(t)
+	if err := roast.WithClaims[roast.Listener](roast.Claims{"service": "api", "env": "prod"})(l); err != nil {
+		t.Fatal(err)
+	}
+	if err := roast.WithClaims[roast.Dialer](roast.Claims{"service": "worker", "build": "42", "canary": "true"})(d); err != nil {
+		t.Fatal(err)
+	}
+
+	server, client := upgradePair(t, l.UpgradeServerConn, d.UpgradeClientConn)
+	if server.err != nil || client.err != nil {
+		t.Fatalf("handshake failed: server=%v client=%v", server.err, client.err)
+	}
+
+	// The server sees the client's claims, and vice versa
+	if got, _ := server.peer.Claims.Get("service"); got != "worker" {
+		t.Errorf("expected the client to claim service %q, got %q", "worker", got)
+	}
+	if build, err := server.peer.Claims.Int("build"); err != nil || build != 42 {
+		t.Errorf("expected the client to claim build 42, got %v (%v)", build, err)
+	}
+	if canary, err := server.peer.Claims.Bool("canary"); err != nil || !canary {
+		t.Errorf("expected the client to claim to be a canary, got %v (%v)", canary, err)
+	}
+	if _, err := server.peer.Claims.Int("missing"); err == nil {
+		t.Error("expected a missing claim to be an error")
+	}
+
+	if got, _ := client.peer.Claims.Get("env"); got != "prod" {
+		t.Errorf("expected the server to claim env %q, got %q", "prod", got)
+	}
+	if _, ok := client.peer.Claims.Get("build"); ok {
+		t.Error("expected the server not to have made the client's claims")
+	}
+}
+
+func TestClaimsLimits(t *testing.T) {
+	tooMany := roast.Claims{}
+	for i := 0; i <= roast.MaxClaims; i++ {
+		tooMany[strings.Repeat("k", i+1)] = ""
+	}
+
+	tooBig := roast.Claims{}
+	for i := 0; i < roast.MaxClaimsSize/roast.MaxClaimValueSize+1; i++ {
+		tooBig[strings.Repeat("k", i+1)] = strings.Repeat("v", roast.MaxClaimValueSize)
+	}
+
+	for name, claims := range map[string]roast.Claims{
+		"too many claims": tooMany,
+		"empty key":       {"": "value"},
+		"long key":        {strings.Repeat("k", roast.MaxClaimKeySize+1): "value"},
+		"bad key":         {"has space": "value"},
+		"long value":      {"key": strings.Repeat("v", roast.MaxClaimValueSize+1)},
+		"too big":         tooBig,
+		"CRLF in value":   {"key": "value\r\nX-Roast-Peer-Role-ARN: admin"},
+		"NUL in value":    {"key": "val\x00ue"},
+		"tab in value":    {"key": "val\tue"},
+		"invalid UTF-8":   {"key": "val\xffue"},
+		"keys by case":    {"service": "api", "SERVICE": "admin"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if err := roast.WithClaims[roast.Dialer](claims)(&roast.Dialer{}); !errors.Is(err, roast.ErrInvalidClaims) {
+				t.Errorf("expected %v, got %v", roast.ErrInvalidClaims, err)
+			}
+		})
+	}
+}
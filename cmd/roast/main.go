@@ -0,0 +1,104 @@
+// Command roast is a toolbox for working with Roast deployments.
+//
+// Usage:
+//
+//	roast policy test -policy FILE [-source IP] [-role-path PATH] CALLER_ARN
+//
+// `policy test` evaluates a policy file (see the policy package) for a
+// caller's assumed role ARN, as STS would return it, and prints the decision
+// and the statement that made it. It exits 0 if the caller is allowed, 1 if it
+// is denied and 2 if the policy couldn't be evaluated.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/thomasdesr/roast/gcisigner/source_verifiers/policy"
+	"github.com/thomasdesr/roast/gcisigner/source_verifiers/sources"
+	"github.com/thomasdesr/roast/internal/errorutil"
+)
+
+const usage = "usage: roast policy test -policy FILE [-source IP] [-role-path PATH] CALLER_ARN"
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run runs the command with `args`, returning its exit code.
+func run(args []string, stdout, stderr io.Writer) int {
+	if len(args) < 2 || args[0] != "policy" || args[1] != "test" {
+		fmt.Fprintln(stderr, usage)
+		return 2
+	}
+
+	decision, err := policyTest(args[2:], stderr)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+
+	fmt.Fprintln(stdout, decision)
+	if decision.Effect != policy.Allow {
+		return 1
+	}
+	return 0
+}
+
+// policyTest evaluates the policy named by `args` for the caller in them.
+func policyTest(args []string, stderr io.Writer) (policy.Decision, error) {
+	fs := flag.NewFlagSet("roast policy test", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, usage)
+		fs.PrintDefaults()
+	}
+
+	policyPath := fs.String("policy", "", "Policy file to evaluate")
+	sourceIP := fs.String("source", "", "IP address the caller connects from, for policies with SourceCIDR conditions")
+	rolePath := fs.String("role-path", "", "Path of the caller's role, e.g. /service/, for policies with Role conditions scoped to paths")
+
+	if err := fs.Parse(args); err != nil {
+		return policy.Decision{}, err
+	}
+	if *policyPath == "" || fs.NArg() != 1 {
+		fs.Usage()
+		return policy.Decision{}, fmt.Errorf("a policy file and one caller ARN are required")
+	}
+
+	p, err := policy.Load(*policyPath)
+	if err != nil {
+		return policy.Decision{}, err
+	}
+
+	callerARN, err := arn.Parse(fs.Arg(0))
+	if err != nil {
+		return policy.Decision{}, errorutil.Wrapf(err, "invalid caller ARN %q", fs.Arg(0))
+	}
+
+	caller, err := sources.FromARN[sources.AssumedRole](callerARN)
+	if err != nil {
+		return policy.Decision{}, errorutil.Wrap(err, "the caller must be an assumed role, e.g. arn:aws:sts::123456789012:assumed-role/RoleName/SessionName")
+	}
+
+	var source netip.Addr
+	if *sourceIP != "" {
+		source, err = netip.ParseAddr(*sourceIP)
+		if err != nil {
+			return policy.Decision{}, errorutil.Wrapf(err, "invalid source IP %q", *sourceIP)
+		}
+	}
+
+	if *rolePath != "" {
+		p = p.WithRolePaths(func(context.Context, sources.Role) (string, error) {
+			return *rolePath, nil
+		})
+	}
+
+	return p.Evaluate(context.Background(), caller, source)
+}
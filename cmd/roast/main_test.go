@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPolicyTest(t *testing.T) {
+	policyPath := filepath.Join(t.TempDir(), "policy.json")
+	err := os.WriteFile(policyPath, []byte(`{
+		"Version": 1,
+		"Statements": [
+			{"Sid": "vpc", "Effect": "Allow", "Priority": 1, "Condition": {"SourceCIDR": ["10.0.0.0/8"]}}
+		]
+	}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const caller = "arn:aws:sts::123456789012:assumed-role/RoleName/SessionName"
+
+	for _, tt := range []struct {
+		args     []string
+		wantCode int
+		wantOut  string
+	}{
+		{[]string{"policy", "test", "-policy", policyPath, "-source", "10.1.2.3", caller}, 0, `Allow by statement "vpc"`},
+		{[]string{"policy", "test", "-policy", policyPath, "-source", "192.0.2.1", caller}, 1, "Deny (no statement matched)"},
+		{[]string{"policy", "test", "-policy", policyPath, caller}, 2, ""},
+		{[]string{"policy", "test", "-policy", policyPath, "arn:aws:iam::123456789012:role/RoleName"}, 2, ""},
+		{[]string{"policy", "lint"}, 2, ""},
+	} {
+		var stdout, stderr bytes.Buffer
+		code := run(tt.args, &stdout, &stderr)
+
+		if code != tt.wantCode || strings.TrimSpace(stdout.String()) != tt.wantOut {
+			t.Errorf("%q: expected exit %d with %q, got %d with %q (stderr: %s)", tt.args, tt.wantCode, tt.wantOut, code, stdout.String(), stderr.String())
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package roast_test
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	roast "github.com/thomasdesr/roast"
+	"github.com/thomasdesr/roast/internal/errorutil"
+	"github.com/thomasdesr/roast/internal/testutils"
+	"golang.org/x/sync/errgroup"
+)
+
+func TestVersionNegotiation(t *testing.T) {
+	l, d := localValidListenerAndDialer(t)
+
+	server, client := upgradePair(t, l.UpgradeServerConn, d.UpgradeClientConn)
+	if server.err != nil || client.err != nil {
+		t.Fatalf("handshake failed: server=%v client=%v", server.err, client.err)
+	}
+
+	if server.peer.ProtocolVersion != roast.ProtocolVersion2 {
+		t.Errorf("server negotiated %v, expected %v", server.peer.ProtocolVersion, roast.ProtocolVersion2)
+	}
+	if client.peer.ProtocolVersion != roast.ProtocolVersion2 {
+		t.Errorf("client negotiated %v, expected %v", client.peer.ProtocolVersion, roast.ProtocolVersion2)
+	}
+}
+
+func TestDialerToV1OnlyListener(t *testing.T) {
+	l, d := localValidListenerAndDialer(t)
+	if err := roast.WithProtocolVersions[roast.Listener](roast.ProtocolVersion1)(l); err != nil {
+		t.Fatal(err)
+	}
+
+	// The Listener answers unframed, but still binds its hello to ours
+	server, client := upgradePair(t, l.UpgradeServerConn, d.UpgradeClientConn)
+	if server.err != nil || client.err != nil {
+		t.Fatalf("handshake failed: server=%v client=%v", server.err, client.err)
+	}
+
+	if server.peer.ProtocolVersion != roast.ProtocolVersion1 || client.peer.ProtocolVersion != roast.ProtocolVersion1 {
+		t.Errorf("expected both sides to settle on %v, got server=%v client=%v", roast.ProtocolVersion1, server.peer.ProtocolVersion, client.peer.ProtocolVersion)
+	}
+}
+
+func TestLegacyClientToListener(t *testing.T) {
+	l, d := localValidListenerAndDialer(t)
+
+	legacyClient := func(ctx context.Context, c net.Conn) (*tls.Conn, *roast.PeerMetadata, error) {
+		tlsConn, err := roast.LegacyUpgradeClientConn(ctx, c, d.Signer, d.Verifier)
+		return tlsConn, nil, err
+	}
+
+	server, client := upgradePair(t, l.UpgradeServerConn, legacyClient)
+	if server.err != nil || client.err != nil {
+		t.Fatalf("handshake failed: server=%v client=%v", server.err, client.err)
+	}
+
+	if server.peer.ProtocolVersion != roast.ProtocolVersion1 {
+		t.Errorf("server negotiated %v with a legacy client, expected %v", server.peer.ProtocolVersion, roast.ProtocolVersion1)
+	}
+}
+
+func TestDialerToLegacyServer(t *testing.T) {
+	l, d := localValidListenerAndDialer(t)
+
+	legacyServer := func(ctx context.Context, c net.Conn) (*tls.Conn, *roast.PeerMetadata, error) {
+		tlsConn, err := roast.LegacyUpgradeServerConn(ctx, c, l.Signer, l.Verifier)
+		return tlsConn, nil, err
+	}
+
+	// Dialers that still offer ProtocolVersion1 say hello in a way legacy
+	// servers understand, and fall back to it.
+	for name, dialer := range map[string]*roast.Dialer{
+		"default":      d,
+		"pinned to v1": pinnedDialer(t, d, roast.ProtocolVersion1),
+	} {
+		t.Run(name, func(t *testing.T) {
+			server, client := upgradePair(t, legacyServer, dialer.UpgradeClientConn)
+			if server.err != nil || client.err != nil {
+				t.Fatalf("handshake failed: server=%v client=%v", server.err, client.err)
+			}
+
+			if client.peer.ProtocolVersion != roast.ProtocolVersion1 {
+				t.Errorf("client negotiated %v with a legacy server, expected %v", client.peer.ProtocolVersion, roast.ProtocolVersion1)
+			}
+		})
+	}
+
+	// Legacy servers can't parse framed hellos, which Dialers that have
+	// dropped ProtocolVersion1 send.
+	t.Run("pinned to v2", func(t *testing.T) {
+		server, client := upgradePair(t, legacyServer, pinnedDialer(t, d, roast.ProtocolVersion2).UpgradeClientConn)
+		if server.err == nil || client.err == nil {
+			t.Fatalf("expected handshake to fail: server=%v client=%v", server.err, client.err)
+		}
+
+		if !strings.Contains(client.err.Error(), "ProtocolVersion1") {
+			t.Errorf("expected the client to suggest offering ProtocolVersion1, got %v", client.err)
+		}
+	})
+}
+
+func TestStrippedFramingRequestIsRejected(t *testing.T) {
+	l, d := localValidListenerAndDialer(t)
+
+	// Someone in the middle strips the client's request for a framed answer,
+	// hoping to get it to accept an unbound one
+	stripping := func(ctx context.Context, c net.Conn) (*tls.Conn, *roast.PeerMetadata, error) {
+		return d.UpgradeClientConn(ctx, &rewritingConn{Conn: c, old: `,"Framing":true`, new: ""})
+	}
+
+	server, client := upgradePair(t, l.UpgradeServerConn, stripping)
+	if !errors.Is(server.err, roast.ErrMalformedFrame) {
+		t.Errorf("expected server to fail with %v, got %v", roast.ErrMalformedFrame, server.err)
+	}
+	if client.err == nil {
+		t.Error("expected client handshake to fail")
+	}
+}
+
+// rewritingConn replaces `old` with `new` in the first write that has it.
+type rewritingConn struct {
+	net.Conn
+	old, new string
+	done     bool
+}
+
+func (c *rewritingConn) Write(b []byte) (int, error) {
+	if c.done || !strings.Contains(string(b), c.old) {
+		return c.Conn.Write(b)
+	}
+	c.done = true
+
+	if _, err := c.Conn.Write([]byte(strings.Replace(string(b), c.old, c.new, 1))); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func TestNoCommonProtocolVersion(t *testing.T) {
+	l, d := localValidListenerAndDialer(t)
+
+	if err := roast.WithProtocolVersions[roast.Listener](roast.ProtocolVersion2)(l); err != nil {
+		t.Fatal(err)
+	}
+
+	legacyClient := func(ctx context.Context, c net.Conn) (*tls.Conn, *roast.PeerMetadata, error) {
+		tlsConn, err := roast.LegacyUpgradeClientConn(ctx, c, d.Signer, d.Verifier)
+		return tlsConn, nil, err
+	}
+
+	for name, clientUpgrade := range map[string]upgradeFunc{
+		"legacy client": legacyClient,
+		"pinned to v1":  pinnedDialer(t, d, roast.ProtocolVersion1).UpgradeClientConn,
+	} {
+		t.Run(name, func(t *testing.T) {
+			server, client := upgradePair(t, l.UpgradeServerConn, clientUpgrade)
+			if !errors.Is(server.err, roast.ErrNoCommonProtocolVersion) {
+				t.Errorf("expected server to fail with %v, got %v", roast.ErrNoCommonProtocolVersion, server.err)
+			}
+			if client.err == nil {
+				t.Error("expected client handshake to fail")
+			}
+		})
+	}
+}
+
+func TestWithProtocolVersionsValidation(t *testing.T) {
+	for _, versions := range [][]roast.ProtocolVersion{
+		nil,
+		{0},
+		{roast.ProtocolVersion2, 42},
+	} {
+		t.Run(fmt.Sprint(versions), func(t *testing.T) {
+			if err := roast.WithProtocolVersions[roast.Dialer](versions...)(&roast.Dialer{}); err == nil {
+				t.Errorf("expected %v to be rejected", versions)
+			}
+		})
+	}
+}
+
+// pinnedDialer returns a copy of `d` that only speaks `versions`.
+func pinnedDialer(t testing.TB, d *roast.Dialer, versions ...roast.ProtocolVersion) *roast.Dialer {
+	t.Helper()
+
+	pinned, err := roast.NewDialer(nil, roast.WithProtocolVersions[roast.Dialer](versions...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinned.Dialer, pinned.Signer, pinned.Verifier = d.Dialer, d.Signer, d.Verifier
+
+	return pinned
+}
+
+type upgradeFunc func(ctx context.Context, c net.Conn) (*tls.Conn, *roast.PeerMetadata, error)
+
+type upgradeResult struct {
+	peer *roast.PeerMetadata
+	err  error
+}
+
+// upgradePair runs `serverUpgrade` and `clientUpgrade` against either end of
+// a fresh connection and, if both succeed, checks that data makes it across.
+func upgradePair(t testing.TB, serverUpgrade, clientUpgrade upgradeFunc) (server, client upgradeResult) {
+	t.Helper()
+
+	left, right := testutils.ConnPipe(t)
+	return upgradeConns(t, right, left, serverUpgrade, clientUpgrade)
+}
+
+// upgradeConns is upgradePair for an existing pair of connected conns.
+func upgradeConns(t testing.TB, right, left net.Conn, serverUpgrade, clientUpgrade upgradeFunc) (server, client upgradeResult) {
+	t.Helper()
+
+	t.Cleanup(func() { left.Close(); right.Close() })
+
+	const message = "hello across versions"
+
+	var g errgroup.Group
+	g.Go(func() error {
+		tlsConn, peer, err := serverUpgrade(context.Background(), right)
+		server = upgradeResult{peer: peer, err: err}
+		if err != nil {
+			// Unblock the client if it is still waiting on us
+			right.Close()
+			return nil
+		}
+		defer tlsConn.Close()
+
+		_, err = io.Copy(tlsConn, tlsConn)
+		return err
+	})
+
+	g.Go(func() error {
+		tlsConn, peer, err := clientUpgrade(context.Background(), left)
+		client = upgradeResult{peer: peer, err: err}
+		if err != nil {
+			left.Close()
+			return nil
+		}
+		defer tlsConn.Close()
+
+		if _, err := io.WriteString(tlsConn, message); err != nil {
+			return errorutil.Wrap(err, "write failed")
+		}
+
+		buf := make([]byte, len(message))
+		if _, err := io.ReadFull(tlsConn, buf); err != nil {
+			return errorutil.Wrap(err, "read failed")
+		}
+		if string(buf) != message {
+			return fmt.Errorf("unexpected echo: %q", buf)
+		}
+
+		return nil
+	})
+
+	if err := g.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	return server, client
+}
@@ -3,10 +3,16 @@ package roast
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"net"
 	"sync"
+	"time"
 )
 
+// ErrConnectionExpired is returned by reads and writes on a Conn that was
+// closed because it reached the maximum age set by WithMaxConnectionAge.
+var ErrConnectionExpired = errors.New("connection reached its maximum age")
+
 type Conn struct {
 	net.Conn
 
@@ -15,6 +21,22 @@ type Conn struct {
 	handshake     sync.Once
 	handshakeFunc func(ctx context.Context, c net.Conn) (*tls.Conn, *PeerMetadata, error)
 	handshakeErr  error
+
+	// wrap, if set, gets a say in what the TLS conn is replaced with after the
+	// handshake
+	wrap func(tlsConn *tls.Conn, peer *PeerMetadata) net.Conn
+
+	// side is which end of the connection we are, for metrics
+	side string
+
+	mu      sync.Mutex
+	expiry  *time.Timer
+	closed  bool
+	expired bool
+
+	// inactive, once the handshake completes, stops counting the connection
+	// as active
+	inactive func()
 }
 
 func (c *Conn) HandshakeContext(ctx context.Context) error {
@@ -26,6 +48,20 @@ func (c *Conn) HandshakeContext(ctx context.Context) error {
 			return
 		}
 		c.Conn, c.Peer = conn, peer
+		if c.wrap != nil {
+			c.Conn = c.wrap(conn, peer)
+		}
+
+		c.mu.Lock()
+		if !c.closed {
+			if !peer.ExpiresAt.IsZero() {
+				c.expiry = time.AfterFunc(time.Until(peer.ExpiresAt), c.expire)
+			}
+			if c.side != "" {
+				c.inactive = trackActive(c.side, peer)
+			}
+		}
+		c.mu.Unlock()
 	})
 
 	return c.handshakeErr
@@ -36,7 +72,8 @@ func (c *Conn) Read(b []byte) (int, error) {
 		return 0, err
 	}
 
-	return c.Conn.Read(b)
+	n, err := c.Conn.Read(b)
+	return n, c.expiredErr(err)
 }
 
 func (c *Conn) Write(b []byte) (int, error) {
@@ -44,5 +81,79 @@ func (c *Conn) Write(b []byte) (int, error) {
 		return 0, err
 	}
 
-	return c.Conn.Write(b)
+	n, err := c.Conn.Write(b)
+	return n, c.expiredErr(err)
+}
+
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	c.markClosed()
+	if c.expiry != nil {
+		c.expiry.Stop()
+	}
+	c.mu.Unlock()
+
+	return c.Conn.Close()
+}
+
+// expire closes the connection once it reaches its maximum age. Closing the
+// TLS connection sends a close_notify first, so the peer sees a clean EOF
+// rather than a reset.
+func (c *Conn) expire() {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.markClosed()
+	c.expired = true
+	c.mu.Unlock()
+
+	c.Conn.Close()
+}
+
+// markClosed records that the connection has been closed. The caller must
+// hold c.mu.
+func (c *Conn) markClosed() {
+	c.closed = true
+	if c.inactive != nil {
+		c.inactive()
+		c.inactive = nil
+	}
+}
+
+// expiredErr replaces `err` with ErrConnectionExpired if the connection was
+// closed for reaching its maximum age.
+func (c *Conn) expiredErr(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.expired {
+		return ErrConnectionExpired
+	}
+	return err
+}
+
+// ConnectionState returns the state of the connection's TLS session,
+// completing the handshake first if it hasn't been already. It is empty if the
+// handshake failed.
+func (c *Conn) ConnectionState() tls.ConnectionState {
+	if err := c.HandshakeContext(context.Background()); err != nil {
+		return tls.ConnectionState{}
+	}
+
+	if cs, ok := c.Conn.(interface{ ConnectionState() tls.ConnectionState }); ok {
+		return cs.ConnectionState()
+	}
+	return tls.ConnectionState{}
+}
+
+// NegotiatedProtocol returns the application protocol agreed on with ALPN
+// during the handshake (see WithNextProtos), or "" if there wasn't one.
+func (c *Conn) NegotiatedProtocol() string {
+	return c.ConnectionState().NegotiatedProtocol
 }
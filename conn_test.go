@@ -0,0 +1,100 @@
+package roast_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	roast "github.com/thomasdesr/roast"
+)
+
+func TestMaxConnectionAgeClosesConns(t *testing.T) {
+	const maxAge = 200 * time.Millisecond
+
+	l, d := localValidListenerAndDialer(t)
+	if err := roast.WithMaxConnectionAge[roast.Dialer](maxAge)(d); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	server, client := dialPair(t, l, d)
+
+	// Only the Dialer has a maximum age, the Listener leaves it to the peer
+	peer := client.(*roast.Conn).Peer
+	if peer.HandshakeTime.Before(start) || peer.ExpiresAt != peer.HandshakeTime.Add(maxAge) {
+		t.Errorf("unexpected handshake time %v and expiry %v", peer.HandshakeTime, peer.ExpiresAt)
+	}
+	if serverPeer := server.(*roast.Conn).Peer; serverPeer.HandshakeTime.IsZero() || !serverPeer.ExpiresAt.IsZero() {
+		t.Errorf("unexpected server handshake time %v and expiry %v", serverPeer.HandshakeTime, serverPeer.ExpiresAt)
+	}
+
+	// The connection works until it expires
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(server, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// Then the expired side fails with ErrConnectionExpired, and the peer sees
+	// a clean EOF
+	if _, err := client.Read(buf); !errors.Is(err, roast.ErrConnectionExpired) {
+		t.Errorf("expected %v, got %v", roast.ErrConnectionExpired, err)
+	}
+	if age := time.Since(peer.HandshakeTime); age < maxAge {
+		t.Errorf("connection closed after %v, before its maximum age", age)
+	}
+
+	if _, err := server.Read(buf); !errors.Is(err, io.EOF) {
+		t.Errorf("expected the peer to see %v, got %v", io.EOF, err)
+	}
+}
+
+func TestMaxConnectionAgeRejectsNonPositive(t *testing.T) {
+	for _, maxAge := range []time.Duration{0, -time.Second} {
+		if err := roast.WithMaxConnectionAge[roast.Listener](maxAge)(&roast.Listener{}); err == nil {
+			t.Errorf("expected a maximum age of %v to be rejected", maxAge)
+		}
+	}
+}
+
+// dialPair connects `d` to `l` and returns both ends once their handshakes
+// are done.
+func dialPair(t *testing.T, l *roast.Listener, d *roast.Dialer) (server, client net.Conn) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- c
+	}()
+
+	client, err := d.DialContext(ctx, l.Addr().Network(), l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	server, ok := <-accepted
+	if !ok {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() { server.Close() })
+
+	if err := server.(*roast.Conn).HandshakeContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	return server, client
+}
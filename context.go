@@ -4,13 +4,61 @@ import (
 	"context"
 	"crypto/tls"
 	"net"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/thomasdesr/roast/gcisigner/source_verifiers/sources"
 )
 
 type PeerMetadata struct {
 	AccountID string
 	Role      arn.ARN
+
+	// SessionName is the session name the peer assumed its role with, which
+	// often says what it is, e.g. an EC2 instance ID.
+	SessionName string `json:",omitempty"`
+
+	// PrincipalType is what kind of principal the peer authenticated as,
+	// which is usually an assumed role, but see WithSourceVerifier.
+	PrincipalType sources.PrincipalType `json:",omitempty"`
+
+	// SSOUserName and PermissionSet are the IAM Identity Center user the peer
+	// signed in as, and the name of the permission set it signed in with.
+	// They are only set if the peer was let in by
+	// source_verifiers.MatchesAnyPermissionSet, which checks its role really
+	// is one Identity Center provisioned.
+	SSOUserName   string `json:",omitempty"`
+	PermissionSet string `json:",omitempty"`
+
+	// ProtocolVersion is the Roast protocol version negotiated with the peer.
+	ProtocolVersion ProtocolVersion `json:",omitempty"`
+	// Capabilities are the optional protocol features both sides advertised.
+	Capabilities []Capability `json:",omitempty"`
+
+	// Resumed is set when the connection resumed an earlier session instead
+	// of verifying the peer with STS again. Everything else describes the
+	// peer as it was verified for that earlier session.
+	Resumed bool `json:",omitempty"`
+
+	// Claims are the application-defined metadata the peer signed into its
+	// hello, see WithClaims.
+	Claims Claims `json:",omitempty"`
+
+	// HandshakeTime is when the handshake with the peer completed.
+	HandshakeTime time.Time `json:",omitzero"`
+	// ExpiresAt is when the connection will be closed for reaching the
+	// maximum age set by WithMaxConnectionAge. It is zero if there is none.
+	ExpiresAt time.Time `json:",omitzero"`
+
+	// ConnectionID identifies the connection in logs and audit records, see
+	// WithAuditSink.
+	ConnectionID string `json:",omitempty"`
+
+	// verifiedAt is when the peer's identity was last checked with STS.
+	verifiedAt time.Time
+
+	// identity is what else STS told us when it verified the peer.
+	identity verifiedIdentity
 }
 
 type (
@@ -0,0 +1,179 @@
+package roast
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/thomasdesr/roast/internal/errorutil"
+)
+
+// CertificateAlgorithm is a key algorithm used for the ephemeral CA and leaf
+// certificates each side generates for a connection.
+type CertificateAlgorithm string
+
+const (
+	CertificateAlgorithmECDSAP256 CertificateAlgorithm = "ecdsa-p256"
+	CertificateAlgorithmECDSAP384 CertificateAlgorithm = "ecdsa-p384"
+	CertificateAlgorithmEd25519   CertificateAlgorithm = "ed25519"
+)
+
+// defaultCertificateAlgorithms are used unless WithCertificateAlgorithms says
+// otherwise. The first is what we generate, all of them are accepted from
+// peers.
+var defaultCertificateAlgorithms = []CertificateAlgorithm{
+	CertificateAlgorithmECDSAP256,
+	CertificateAlgorithmECDSAP384,
+	CertificateAlgorithmEd25519,
+}
+
+// defaultKeyExchanges are the TLS key exchange groups used unless
+// WithKeyExchanges says otherwise, in order of preference.
+var defaultKeyExchanges = []tls.CurveID{
+	tls.X25519MLKEM768,
+	tls.X25519,
+	tls.CurveP256,
+	tls.CurveP384,
+}
+
+// supportedKeyExchanges are the groups WithKeyExchanges accepts.
+var supportedKeyExchanges = []tls.CurveID{
+	tls.X25519MLKEM768,
+	tls.X25519,
+	tls.CurveP256,
+	tls.CurveP384,
+	tls.CurveP521,
+}
+
+var (
+	// ErrCertificateAlgorithmNotAccepted is returned when one side generates
+	// its certificates with an algorithm the other side doesn't accept.
+	ErrCertificateAlgorithmNotAccepted = errors.New("certificate algorithm not accepted")
+
+	// ErrNoCommonKeyExchange is returned when the peers have no TLS key
+	// exchange group in common.
+	ErrNoCommonKeyExchange = errors.New("no TLS key exchange in common with peer")
+)
+
+func (a CertificateAlgorithm) isKnown() bool {
+	return slices.Contains(defaultCertificateAlgorithms, a)
+}
+
+// generateKey makes a new private key for `a`.
+func (a CertificateAlgorithm) generateKey() (crypto.Signer, error) {
+	switch a {
+	case CertificateAlgorithmECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case CertificateAlgorithmECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case CertificateAlgorithmEd25519:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		return priv, err
+	default:
+		return nil, fmt.Errorf("unsupported certificate algorithm: %q", a)
+	}
+}
+
+// certificateAlgorithmOf works out which CertificateAlgorithm `cert`'s key
+// uses.
+func certificateAlgorithmOf(cert *x509.Certificate) (CertificateAlgorithm, error) {
+	switch pub := cert.PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		switch pub.Curve {
+		case elliptic.P256():
+			return CertificateAlgorithmECDSAP256, nil
+		case elliptic.P384():
+			return CertificateAlgorithmECDSAP384, nil
+		}
+	case ed25519.PublicKey:
+		return CertificateAlgorithmEd25519, nil
+	}
+
+	return "", fmt.Errorf("%w: unsupported %v key", ErrCertificateAlgorithmNotAccepted, cert.PublicKeyAlgorithm)
+}
+
+// checkCertificateAlgorithm fails if `cert` doesn't use one of the `accepted`
+// algorithms.
+func checkCertificateAlgorithm(cert *x509.Certificate, accepted []CertificateAlgorithm) error {
+	alg, err := certificateAlgorithmOf(cert)
+	if err != nil {
+		return err
+	}
+
+	if !slices.Contains(accepted, alg) {
+		return fmt.Errorf("%w: peer uses %v, we only accept %v", ErrCertificateAlgorithmNotAccepted, alg, accepted)
+	}
+	return nil
+}
+
+// tlsParams restricts a connection's TLS handshake to what was agreed on in
+// the hellos.
+type tlsParams struct {
+	// keyExchanges are the groups both sides support, in our order of
+	// preference.
+	keyExchanges []tls.CurveID
+
+	// certificateAlgorithms are the algorithms we accept for the peer's
+	// certificates.
+	certificateAlgorithms []CertificateAlgorithm
+
+	// nextProtos are the ALPN protocols we offer, in order of preference.
+	nextProtos []string
+}
+
+// negotiateTLSParams checks that the algorithms each side generates its
+// certificates with are acceptable to the other, and picks the key exchange
+// groups the TLS handshake may use.
+//
+// Peers that predate algorithm negotiation don't send any lists. They accept
+// whatever crypto/tls does, and we let crypto/tls pick the group.
+func negotiateTLSParams(hc *handshakeConfig, localCA *caBundle, peerCAPEM []byte, peerAccepts []CertificateAlgorithm, peerKeyExchanges []tls.CurveID) (tlsParams, error) {
+	params := hc.localTLSParams()
+
+	if len(peerAccepts) > 0 && !slices.Contains(peerAccepts, localCA.algorithm) {
+		return tlsParams{}, fmt.Errorf("%w: we use %v, peer only accepts %v", ErrCertificateAlgorithmNotAccepted, localCA.algorithm, peerAccepts)
+	}
+
+	block, _ := pem.Decode(peerCAPEM)
+	if block == nil {
+		return tlsParams{}, errors.New("failed to decode peer CA")
+	}
+	peerCA, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return tlsParams{}, errorutil.Wrap(err, "failed to parse peer CA")
+	}
+	if err := checkCertificateAlgorithm(peerCA, params.certificateAlgorithms); err != nil {
+		return tlsParams{}, err
+	}
+
+	if len(peerKeyExchanges) > 0 {
+		params.keyExchanges = slices.DeleteFunc(slices.Clone(params.keyExchanges), func(c tls.CurveID) bool {
+			return !slices.Contains(peerKeyExchanges, c)
+		})
+		if len(params.keyExchanges) == 0 {
+			return tlsParams{}, fmt.Errorf("%w: we support %v, peer supports %v", ErrNoCommonKeyExchange, hc.keyExchanges(), peerKeyExchanges)
+		}
+	}
+
+	return params, nil
+}
+
+// verifyConnection holds the peer's leaf certificate to the same algorithm
+// rules as its CA.
+func (p tlsParams) verifyConnection(cs tls.ConnectionState) error {
+	if len(p.certificateAlgorithms) == 0 {
+		return nil
+	}
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("peer sent no certificates")
+	}
+	return checkCertificateAlgorithm(cs.PeerCertificates[0], p.certificateAlgorithms)
+}
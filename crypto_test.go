@@ -0,0 +1,169 @@
+package roast_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+
+	roast "github.com/thomasdesr/roast"
+)
+
+func TestCertificateAlgorithms(t *testing.T) {
+	for _, alg := range []roast.CertificateAlgorithm{
+		roast.CertificateAlgorithmECDSAP256,
+		roast.CertificateAlgorithmECDSAP384,
+		roast.CertificateAlgorithmEd25519,
+	} {
+		t.Run(string(alg), func(t *testing.T) {
+			l, d := localValidListenerAndDialer(t)
+			if err := roast.WithCertificateAlgorithms[roast.Listener](alg)(l); err != nil {
+				t.Fatal(err)
+			}
+			if err := roast.WithCertificateAlgorithms[roast.Dialer](alg)(d); err != nil {
+				t.Fatal(err)
+			}
+
+			var serverState, clientState tls.ConnectionState
+			server, client := upgradePair(t, recordState(l.UpgradeServerConn, &serverState), recordState(d.UpgradeClientConn, &clientState))
+			if server.err != nil || client.err != nil {
+				t.Fatalf("handshake failed: server=%v client=%v", server.err, client.err)
+			}
+
+			checkKeyAlgorithm(t, serverState.PeerCertificates[0].PublicKey, alg)
+			checkKeyAlgorithm(t, clientState.PeerCertificates[0].PublicKey, alg)
+		})
+	}
+}
+
+func TestCertificateAlgorithmMismatchFailsBothSides(t *testing.T) {
+	l, d := localValidListenerAndDialer(t)
+	if err := roast.WithCertificateAlgorithms[roast.Listener](roast.CertificateAlgorithmEd25519)(l); err != nil {
+		t.Fatal(err)
+	}
+	if err := roast.WithCertificateAlgorithms[roast.Dialer](roast.CertificateAlgorithmECDSAP384)(d); err != nil {
+		t.Fatal(err)
+	}
+
+	server, client := upgradePair(t, l.UpgradeServerConn, d.UpgradeClientConn)
+	if !errors.Is(server.err, roast.ErrCertificateAlgorithmNotAccepted) {
+		t.Errorf("expected server to fail with %v, got %v", roast.ErrCertificateAlgorithmNotAccepted, server.err)
+	}
+	if !errors.Is(client.err, roast.ErrCertificateAlgorithmNotAccepted) {
+		t.Errorf("expected client to fail with %v, got %v", roast.ErrCertificateAlgorithmNotAccepted, client.err)
+	}
+}
+
+func TestCertificateAlgorithmsOnlyNeedToBeAccepted(t *testing.T) {
+	// The Listener generates Ed25519 certificates, but accepts the Dialer's
+	// default P-256 ones.
+	l, d := localValidListenerAndDialer(t)
+	if err := roast.WithCertificateAlgorithms[roast.Listener](roast.CertificateAlgorithmEd25519, roast.CertificateAlgorithmECDSAP256)(l); err != nil {
+		t.Fatal(err)
+	}
+
+	var clientState tls.ConnectionState
+	server, client := upgradePair(t, l.UpgradeServerConn, recordState(d.UpgradeClientConn, &clientState))
+	if server.err != nil || client.err != nil {
+		t.Fatalf("handshake failed: server=%v client=%v", server.err, client.err)
+	}
+
+	checkKeyAlgorithm(t, clientState.PeerCertificates[0].PublicKey, roast.CertificateAlgorithmEd25519)
+}
+
+func TestKeyExchanges(t *testing.T) {
+	for name, tc := range map[string]struct {
+		server, client []tls.CurveID
+		wantErr        error
+	}{
+		"hybrid post-quantum": {
+			server: []tls.CurveID{tls.X25519MLKEM768},
+			client: []tls.CurveID{tls.X25519MLKEM768},
+		},
+		"overlap": {
+			server: []tls.CurveID{tls.CurveP384, tls.X25519},
+			client: []tls.CurveID{tls.X25519MLKEM768, tls.CurveP384},
+		},
+		"disjoint": {
+			server:  []tls.CurveID{tls.CurveP256},
+			client:  []tls.CurveID{tls.X25519},
+			wantErr: roast.ErrNoCommonKeyExchange,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			l, d := localValidListenerAndDialer(t)
+			if err := roast.WithKeyExchanges[roast.Listener](tc.server...)(l); err != nil {
+				t.Fatal(err)
+			}
+			if err := roast.WithKeyExchanges[roast.Dialer](tc.client...)(d); err != nil {
+				t.Fatal(err)
+			}
+
+			server, client := upgradePair(t, l.UpgradeServerConn, d.UpgradeClientConn)
+			if tc.wantErr == nil {
+				if server.err != nil || client.err != nil {
+					t.Fatalf("handshake failed: server=%v client=%v", server.err, client.err)
+				}
+				return
+			}
+
+			if !errors.Is(server.err, tc.wantErr) {
+				t.Errorf("expected server to fail with %v, got %v", tc.wantErr, server.err)
+			}
+			if !errors.Is(client.err, tc.wantErr) {
+				t.Errorf("expected client to fail with %v, got %v", tc.wantErr, client.err)
+			}
+		})
+	}
+}
+
+func TestAlgorithmOptionsRejectUnknownValues(t *testing.T) {
+	if err := roast.WithCertificateAlgorithms[roast.Dialer]()(&roast.Dialer{}); err == nil {
+		t.Error("expected an empty certificate algorithm list to be rejected")
+	}
+	if err := roast.WithCertificateAlgorithms[roast.Dialer]("rsa-1024")(&roast.Dialer{}); err == nil {
+		t.Error("expected an unknown certificate algorithm to be rejected")
+	}
+	if err := roast.WithKeyExchanges[roast.Listener]()(&roast.Listener{}); err == nil {
+		t.Error("expected an empty key exchange list to be rejected")
+	}
+	if err := roast.WithKeyExchanges[roast.Listener](tls.CurveID(0xffff))(&roast.Listener{}); err == nil {
+		t.Error("expected an unknown key exchange to be rejected")
+	}
+}
+
+// recordState wraps `upgrade` to save the resulting TLS connection's state.
+func recordState(upgrade upgradeFunc, state *tls.ConnectionState) upgradeFunc {
+	return func(ctx context.Context, c net.Conn) (*tls.Conn, *roast.PeerMetadata, error) {
+		tlsConn, peer, err := upgrade(ctx, c)
+		if err == nil {
+			*state = tlsConn.ConnectionState()
+		}
+		return tlsConn, peer, err
+	}
+}
+
+func checkKeyAlgorithm(t *testing.T, pub any, want roast.CertificateAlgorithm) {
+	t.Helper()
+
+	var got roast.CertificateAlgorithm
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256():
+			got = roast.CertificateAlgorithmECDSAP256
+		case elliptic.P384():
+			got = roast.CertificateAlgorithmECDSAP384
+		}
+	case ed25519.PublicKey:
+		got = roast.CertificateAlgorithmEd25519
+	}
+
+	if got != want {
+		t.Errorf("expected a %v peer certificate, got a %T", want, pub)
+	}
+}
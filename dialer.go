@@ -9,7 +9,6 @@ import (
 	"github.com/aws/aws-sdk-go-v2/aws/arn"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/thomasdesr/roast/gcisigner"
-	"github.com/thomasdesr/roast/gcisigner/source_verifiers"
 	"github.com/thomasdesr/roast/internal/errorutil"
 )
 
@@ -19,11 +18,16 @@ type Dialer struct {
 	Signer   gcisigner.Signer
 	Verifier gcisigner.Verifier
 
+	hs handshakeConfig
+
 	// Total time to allow clients to complete a handshake before abandoning the
 	// connection.
 	handshakeTimeout time.Duration
 }
 
+// NewDialer returns a Dialer that accepts servers matching one of
+// `allowedServerRoles`: roles, which may be wildcarded, IAM users, federated
+// users or account roots, see source_verifiers.MatchesAnyPrincipal.
 func NewDialer(allowedServerRoles []arn.ARN, opts ...Option[Dialer]) (*Dialer, error) {
 	d := &Dialer{
 		Dialer: (&net.Dialer{}).DialContext,
@@ -50,12 +54,12 @@ func NewDialer(allowedServerRoles []arn.ARN, opts ...Option[Dialer]) (*Dialer, e
 	}
 
 	if d.Verifier == nil {
-		serverRoles, err := parseRolesToSources(allowedServerRoles)
+		sourceVerifier, err := d.hs.defaultSourceVerifier(allowedServerRoles)
 		if err != nil {
 			return nil, errorutil.Wrap(err, "failed to parse server roles")
 		}
 
-		d.Verifier = gcisigner.NewVerifier(source_verifiers.MatchesAny(serverRoles), nil)
+		d.Verifier = gcisigner.NewVerifier(sourceVerifier, nil, gcisigner.WithLogger(d.hs.log()))
 	}
 
 	return d, nil
@@ -70,6 +74,10 @@ func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.
 	c := &Conn{
 		Conn:          conn,
 		handshakeFunc: d.UpgradeClientConn,
+		side:          sideClient,
+		wrap: func(tlsConn *tls.Conn, peer *PeerMetadata) net.Conn {
+			return d.hs.reattest(tlsConn, peer, d.Signer, d.Verifier)
+		},
 	}
 
 	// Proactively try to trigger a handshake. This is a Dial so ensure this
@@ -81,21 +89,52 @@ func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.
 	return c, nil
 }
 
-func (d *Dialer) UpgradeClientConn(ctx context.Context, c net.Conn) (*tls.Conn, *PeerMetadata, error) {
+func (d *Dialer) UpgradeClientConn(ctx context.Context, c net.Conn) (_ *tls.Conn, _ *PeerMetadata, err error) {
 	// Enforce the handshake timeout
 	c.SetDeadline(time.Now().Add(d.handshakeTimeout))
 	defer c.SetDeadline(time.Time{})
 
-	tlsConf, peerMetadata, err := clientHandshake(ctx, c, d.Signer, d.Verifier)
+	tr := d.hs.tracer(ctx)
+	doneHandshake := tr.stage(handshakeHooks)
+	defer func() { doneHandshake(err) }()
+
+	var (
+		started      = time.Now()
+		connID       = newConnectionID()
+		failedAt     HandshakeStage
+		peerMetadata *PeerMetadata
+	)
+	handshakesStarted.Inc(sideClient)
+	defer func() {
+		recordHandshake(sideClient, failedAt, err)
+		d.hs.logHandshake(ctx, sideClient, c, started, failedAt, peerMetadata, err)
+		d.hs.audit(ctx, sideClient, connID, c, failedAt, peerMetadata, err)
+	}()
+
+	tlsConf, peerMetadata, err := clientHandshake(ctx, c, d.Signer, d.Verifier, &d.hs)
 	if err != nil {
+		failedAt = roastHandshakeStage(err)
 		return nil, nil, errorutil.Wrap(err, "failed to complete a roast handshake")
 	}
 
-	tlsConn := tls.Client(c, tlsConf)
+	// Servers verify our hello while we verify theirs, and if they reject it
+	// they say why in place of their TLS ServerHello.
+	tlsConn := tls.Client(&alertConn{Conn: c}, tlsConf)
 
-	if err := tlsConn.HandshakeContext(ctx); err != nil {
+	doneTLS := tr.stage(tlsHooks)
+	err = tlsConn.HandshakeContext(ctx)
+	doneTLS(err)
+	if err != nil {
+		failedAt = HandshakeStageTLS
 		return nil, nil, errorutil.Wrap(err, "failed to complete a tls handshake")
 	}
 
+	d.hs.stampHandshake(peerMetadata)
+	peerMetadata.ConnectionID = connID
+
+	if d.hs.resumption != nil {
+		d.hs.resumption.remember(c.RemoteAddr().String(), tlsConn, peerMetadata)
+	}
+
 	return tlsConn, peerMetadata, nil
 }
@@ -0,0 +1,142 @@
+package roast
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"strings"
+
+	"github.com/thomasdesr/roast/gcisigner"
+	"github.com/thomasdesr/roast/internal/errorutil"
+)
+
+// This file contains a frozen copy of the original, unversioned Roast
+// handshake so tests can prove that current Dialers and Listeners still
+// interoperate with peers that predate version negotiation. It should only
+// change when the helpers it borrows from change shape, never in what it puts
+// on the wire.
+
+// ReadHello and WriteHello expose the handshake message encoding so tests can
+// capture and replay hellos.
+var (
+	ReadHello  = readHello
+	WriteHello = writeHello
+)
+
+type legacyClientHello struct {
+	ClientCA        []byte
+	ServerHostnames []string
+}
+
+type legacyServerHello struct {
+	ServerCA []byte
+}
+
+// LegacyUpgradeClientConn runs the client side of the original Roast
+// handshake followed by TLS.
+func LegacyUpgradeClientConn(ctx context.Context, conn net.Conn, signer gcisigner.Signer, verifier gcisigner.Verifier) (*tls.Conn, error) {
+	remoteHost, _, _ := strings.Cut(conn.RemoteAddr().String(), ":")
+
+	localCA, err := makeLocalCA(CertificateAlgorithmECDSAP256)
+	if err != nil {
+		return nil, errorutil.Wrap(err, "failed to make a local CA")
+	}
+
+	ch, err := json.Marshal(legacyClientHello{
+		ClientCA:        localCA.certPEM,
+		ServerHostnames: []string{remoteHost},
+	})
+	if err != nil {
+		return nil, errorutil.Wrap(err, "failed to marshal client hello")
+	}
+
+	signedCH, err := signer.Sign(ctx, ch)
+	if err != nil {
+		return nil, errorutil.Wrap(err, "failed to sign client hello")
+	}
+
+	if err := json.NewEncoder(conn).Encode(signedCH); err != nil {
+		return nil, errorutil.Wrap(err, "failed to write client handshake")
+	}
+
+	var signedResponse gcisigner.UnverifiedMessage
+	if err := json.NewDecoder(conn).Decode(&signedResponse); err != nil {
+		return nil, errorutil.Wrap(err, "failed to read server handshake")
+	}
+
+	verifiedResponse, err := verifier.Verify(ctx, &signedResponse)
+	if err != nil {
+		return nil, errorutil.Wrap(err, "failed to verify server hello")
+	}
+
+	var sh legacyServerHello
+	if err := json.Unmarshal(verifiedResponse.Payload, &sh); err != nil {
+		return nil, errorutil.Wrap(err, "failed to unmarshal server hello")
+	}
+
+	tlsConf, err := makeClientConfig(*localCA, remoteHost, serverHello{ServerCA: sh.ServerCA}, tlsParams{})
+	if err != nil {
+		return nil, errorutil.Wrap(err, "failed to make client config")
+	}
+
+	tlsConn := tls.Client(conn, tlsConf)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, errorutil.Wrap(err, "failed to complete a tls handshake")
+	}
+
+	return tlsConn, nil
+}
+
+// LegacyUpgradeServerConn runs the server side of the original Roast
+// handshake followed by TLS.
+func LegacyUpgradeServerConn(ctx context.Context, conn net.Conn, signer gcisigner.Signer, verifier gcisigner.Verifier) (*tls.Conn, error) {
+	var unverifiedHandshake gcisigner.UnverifiedMessage
+	if err := json.NewDecoder(conn).Decode(&unverifiedHandshake); err != nil {
+		return nil, errorutil.Wrap(err, "failed to read client handshake")
+	}
+
+	verifiedHandshake, err := verifier.Verify(ctx, &unverifiedHandshake)
+	if err != nil {
+		return nil, errorutil.Wrap(err, "failed to verify client hello")
+	}
+
+	var ch legacyClientHello
+	if err := json.Unmarshal(verifiedHandshake.Payload, &ch); err != nil {
+		return nil, errorutil.Wrap(err, "failed to unmarshal client hello")
+	}
+
+	localCA, err := makeLocalCA(CertificateAlgorithmECDSAP256)
+	if err != nil {
+		return nil, errorutil.Wrap(err, "failed to make a local CA")
+	}
+
+	sh, err := json.Marshal(legacyServerHello{ServerCA: localCA.certPEM})
+	if err != nil {
+		return nil, errorutil.Wrap(err, "failed to marshal server hello")
+	}
+
+	signedSH, err := signer.Sign(ctx, sh)
+	if err != nil {
+		return nil, errorutil.Wrap(err, "failed to sign server hello")
+	}
+
+	if err := json.NewEncoder(conn).Encode(signedSH); err != nil {
+		return nil, errorutil.Wrap(err, "failed to write server handshake")
+	}
+
+	tlsConf, err := makeServerConfig(*localCA, clientHello{
+		ClientCA:        ch.ClientCA,
+		ServerHostnames: ch.ServerHostnames,
+	}, tlsParams{})
+	if err != nil {
+		return nil, errorutil.Wrap(err, "failed to make server config")
+	}
+
+	tlsConn := tls.Server(conn, tlsConf)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, errorutil.Wrap(err, "failed to complete a tls handshake")
+	}
+
+	return tlsConn, nil
+}
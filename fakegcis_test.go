@@ -6,6 +6,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws/arn"
 	roast "github.com/thomasdesr/roast"
@@ -84,6 +85,9 @@ func localValidListenerAndDialer(t testing.TB) (*roast.Listener, *roast.Dialer)
 type fakeGCIS struct {
 	key            []byte
 	callerIdentity awsapi.GetCallerIdentityResult
+
+	// latency is added to every Verify to stand in for the round trip to STS
+	latency time.Duration
 }
 
 func (f *fakeGCIS) Sign(ctx context.Context, payload []byte) (*gcisigner.SignedMessage, error) {
@@ -100,6 +104,14 @@ func (f *fakeGCIS) Sign(ctx context.Context, payload []byte) (*gcisigner.SignedM
 }
 
 func (f *fakeGCIS) Verify(ctx context.Context, msg *gcisigner.UnverifiedMessage) (*gcisigner.VerifiedMessage, error) {
+	if f.latency > 0 {
+		select {
+		case <-time.After(f.latency):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
 	kmac, _ := blake2b.New256(f.key)
 	kmac.Write(msg.Body)
 
@@ -0,0 +1,209 @@
+package roast
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/thomasdesr/roast/gcisigner"
+	"github.com/thomasdesr/roast/internal/errorutil"
+)
+
+// Handshake messages are sent as frames so that a peer knows exactly how many
+// bytes belong to the Roast handshake before it reads them, and so it never
+// reads any of the bytes that belong to the TLS handshake that follows:
+//
+//	+-------------+--------+----------------+---------------------+
+//	| magic (4B)  | type   | length (4B BE) | payload (length B)  |
+//	+-------------+--------+----------------+---------------------+
+//
+// Peers that only speak ProtocolVersion1 send newline terminated JSON
+// instead. Their hellos always begin with '{', which can never be the first
+// byte of a frame, so a server can tell the two apart from the first byte.
+
+// signedHello is a signed hello as it's sent. Clients that offer
+// ProtocolVersion1 along with something newer send it unframed, so servers
+// that predate framing can read it, and set Framing to ask servers that
+// don't for a framed answer. Older servers ignore the field.
+type signedHello struct {
+	*gcisigner.SignedMessage
+
+	Framing bool `json:",omitempty"`
+}
+
+// frameMagic prefixes every frame.
+var frameMagic = [4]byte{'r', 'o', 's', 't'}
+
+const (
+	frameHeaderSize = len(frameMagic) + 1 + 4
+
+	// maxFrameSize is the largest payload we'll accept from a peer. Hellos are
+	// a few KiB at most, mostly made up of a PEM CA certificate and AWS session
+	// token, so anything larger is either broken or hostile.
+	maxFrameSize = 32 << 10
+)
+
+type frameType uint8
+
+const (
+	frameTypeHello          frameType = 1
+	frameTypeAlert          frameType = 2
+	frameTypeResume         frameType = 3
+	frameTypeResumeRejected frameType = 4
+)
+
+var (
+	// ErrMalformedFrame is returned when a peer sends bytes that aren't a
+	// valid handshake message.
+	ErrMalformedFrame = errors.New("malformed handshake frame")
+
+	// ErrFrameTooLarge is returned when a peer announces a handshake message
+	// larger than we are willing to read.
+	ErrFrameTooLarge = errors.New("handshake frame too large")
+)
+
+// writeFrame writes `payload` as a single frame of type `typ`.
+func writeFrame(w io.Writer, typ frameType, payload []byte) error {
+	if len(payload) > maxFrameSize {
+		return errorutil.Wrapf(ErrFrameTooLarge, "refusing to send %d bytes", len(payload))
+	}
+
+	frame := make([]byte, 0, frameHeaderSize+len(payload))
+	frame = append(frame, frameMagic[:]...)
+	frame = append(frame, byte(typ))
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(payload)))
+	frame = append(frame, payload...)
+
+	// A single write so the whole frame goes out together
+	_, err := w.Write(frame)
+	return err
+}
+
+// readFrame reads exactly one frame from `r`, never reading past its end.
+func readFrame(r io.Reader) (frameType, []byte, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+
+	if !bytes.Equal(header[:len(frameMagic)], frameMagic[:]) {
+		return 0, nil, errorutil.Wrapf(ErrMalformedFrame, "bad magic %q", header[:len(frameMagic)])
+	}
+
+	typ := frameType(header[len(frameMagic)])
+
+	length := binary.BigEndian.Uint32(header[len(frameMagic)+1:])
+	if length > maxFrameSize {
+		return 0, nil, errorutil.Wrapf(ErrFrameTooLarge, "peer announced %d bytes, limit is %d", length, maxFrameSize)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, errorutil.Wrap(err, "failed to read frame payload")
+	}
+
+	return typ, payload, nil
+}
+
+// writeHello writes a signed hello either as a frame or, for peers that only
+// speak ProtocolVersion1, as newline terminated JSON.
+func writeHello(w io.Writer, signedHello []byte, framed bool) error {
+	if framed {
+		return writeFrame(w, frameTypeHello, signedHello)
+	}
+
+	if len(signedHello) > maxFrameSize {
+		return errorutil.Wrapf(ErrFrameTooLarge, "refusing to send %d bytes", len(signedHello))
+	}
+
+	// Newline terminated to match what a json.Encoder would've written
+	_, err := w.Write(append(signedHello[:len(signedHello):len(signedHello)], '\n'))
+	return err
+}
+
+// readHello reads a signed hello in whichever encoding the peer chose,
+// reporting whether it was framed. If the peer sent an alert instead, it is
+// returned as an *AlertError.
+func readHello(r io.Reader) (signedHello []byte, framed bool, err error) {
+	typ, payload, framed, err := readMessage(r)
+	if err != nil {
+		return nil, framed, err
+	}
+
+	signedHello, err = helloFrom(typ, payload)
+	return signedHello, framed, err
+}
+
+// readMessage reads the first message of a handshake in whichever encoding
+// the peer chose, reporting whether it was framed. Unframed messages are
+// always hellos.
+func readMessage(r io.Reader) (typ frameType, payload []byte, framed bool, err error) {
+	var first [1]byte
+	if _, err := io.ReadFull(r, first[:]); err != nil {
+		return 0, nil, false, err
+	}
+	r = io.MultiReader(bytes.NewReader(first[:]), r)
+
+	if first[0] == '{' {
+		signedHello, err := readLegacyHello(r)
+		return frameTypeHello, signedHello, false, err
+	}
+
+	typ, payload, err = readFrame(r)
+	return typ, payload, true, err
+}
+
+// helloFrom returns the hello carried by a message, or the alert the peer sent
+// instead.
+func helloFrom(typ frameType, payload []byte) ([]byte, error) {
+	switch typ {
+	case frameTypeHello:
+		return payload, nil
+	case frameTypeAlert:
+		return nil, parseAlert(payload)
+	default:
+		return nil, errorutil.Wrapf(ErrMalformedFrame, "expected a hello, got frame type %d", typ)
+	}
+}
+
+// readLegacyHello reads a single newline terminated JSON value from `r`. It
+// reads no more than maxFrameSize bytes, and consumes the trailing newline so
+// it isn't mistaken for the start of the TLS handshake.
+func readLegacyHello(r io.Reader) ([]byte, error) {
+	limited := io.LimitReader(r, maxFrameSize+1)
+
+	dec := json.NewDecoder(limited)
+
+	var signedHello json.RawMessage
+	if err := dec.Decode(&signedHello); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) && limited.(*io.LimitedReader).N == 0 {
+			return nil, errorutil.Wrapf(ErrFrameTooLarge, "legacy hello exceeds %d bytes", maxFrameSize)
+		}
+		return nil, errorutil.Wrap(err, "failed to decode legacy hello")
+	}
+
+	// The decoder reads ahead, so the newline has either already been
+	// buffered or is still waiting for us on the wire. Since the peer waits for
+	// our reply before sending anything else, nothing else should be there.
+	rest, err := io.ReadAll(dec.Buffered())
+	if err != nil {
+		return nil, errorutil.Wrap(err, "failed to read buffered data")
+	}
+
+	if len(rest) == 0 {
+		var newline [1]byte
+		if _, err := io.ReadFull(limited, newline[:]); err != nil {
+			return nil, errorutil.Wrap(err, "failed to read legacy hello terminator")
+		}
+		rest = newline[:]
+	}
+
+	if !bytes.Equal(rest, []byte("\n")) {
+		return nil, fmt.Errorf("%w: unexpected data after legacy hello: %q", ErrMalformedFrame, rest)
+	}
+
+	return signedHello, nil
+}
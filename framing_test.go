@@ -0,0 +1,142 @@
+package roast
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeFrame(&buf, frameTypeHello, []byte(`{"hello":"world"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	typ, payload, err := readFrame(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if typ != frameTypeHello || string(payload) != `{"hello":"world"}` {
+		t.Fatalf("unexpected frame: %d %q", typ, payload)
+	}
+}
+
+func TestReadFrameRejectsOversizedFrames(t *testing.T) {
+	header := append(frameMagic[:], byte(frameTypeHello))
+	header = binary.BigEndian.AppendUint32(header, 1<<30)
+
+	// If readFrame tried to read the announced payload it would block forever
+	// on this reader instead of failing.
+	_, _, err := readFrame(io.MultiReader(bytes.NewReader(header), blockingReader{}))
+	if !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("expected %v, got %v", ErrFrameTooLarge, err)
+	}
+}
+
+func TestReadFrameRejectsBadMagic(t *testing.T) {
+	_, _, err := readFrame(strings.NewReader("GET / HTTP/1.1\r\n"))
+	if !errors.Is(err, ErrMalformedFrame) {
+		t.Fatalf("expected %v, got %v", ErrMalformedFrame, err)
+	}
+}
+
+func TestReadHelloLeavesTrailingBytes(t *testing.T) {
+	const hello = `{"Body":"aGVsbG8="}`
+	const tlsBytes = "\x16\x03\x01 the tls handshake"
+
+	var framed bytes.Buffer
+	if err := writeHello(&framed, []byte(hello), true); err != nil {
+		t.Fatal(err)
+	}
+
+	var legacy bytes.Buffer
+	if err := writeHello(&legacy, []byte(hello), false); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, tc := range map[string]struct {
+		wire   []byte
+		framed bool
+		reader func(io.Reader) io.Reader
+	}{
+		"framed":                 {wire: framed.Bytes(), framed: true, reader: identity},
+		"framed one byte a time": {wire: framed.Bytes(), framed: true, reader: iotest.OneByteReader},
+		"legacy":                 {wire: legacy.Bytes(), framed: false, reader: identity},
+		"legacy one byte a time": {wire: legacy.Bytes(), framed: false, reader: iotest.OneByteReader},
+	} {
+		t.Run(name, func(t *testing.T) {
+			// Models a socket: every read only sees what has been sent so far,
+			// i.e. the hello, since the TLS bytes come after the reply.
+			r := tc.reader(bytes.NewReader(tc.wire))
+
+			got, framed, err := readHello(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(got) != hello {
+				t.Errorf("expected hello %q, got %q", hello, got)
+			}
+			if framed != tc.framed {
+				t.Errorf("expected framed=%t, got %t", tc.framed, framed)
+			}
+
+			// Nothing of the hello should be left for the TLS handshake
+			rest, err := io.ReadAll(io.MultiReader(r, strings.NewReader(tlsBytes)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(rest) != tlsBytes {
+				t.Errorf("expected TLS to see exactly %q, got %q", tlsBytes, rest)
+			}
+		})
+	}
+}
+
+func TestReadHelloRejectsOversizedLegacyHellos(t *testing.T) {
+	huge := `{"Body":"` + strings.Repeat("A", 2*maxFrameSize) + `"}` + "\n"
+
+	_, _, err := readHello(strings.NewReader(huge))
+	if !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("expected %v, got %v", ErrFrameTooLarge, err)
+	}
+}
+
+func TestServerHandshakeRejectsOversizedHellos(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	header := append(frameMagic[:], byte(frameTypeHello))
+	header = binary.BigEndian.AppendUint32(header, 64<<20)
+	clientErr := make(chan error, 1)
+	go func() {
+		client.Write(header)
+		_, _, err := readHello(client)
+		clientErr <- err
+	}()
+
+	// The server must give up before needing a signer or verifier
+	_, _, err := serverHandshake(context.Background(), server, nil, nil, &handshakeConfig{})
+	if !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("expected %v, got %v", ErrFrameTooLarge, err)
+	}
+
+	var alertErr *AlertError
+	if err := <-clientErr; !errors.As(err, &alertErr) || alertErr.Category != AlertMalformedHello {
+		t.Fatalf("expected the client to be sent a %v alert, got %v", AlertMalformedHello, err)
+	}
+}
+
+func identity(r io.Reader) io.Reader { return r }
+
+type blockingReader struct{}
+
+func (blockingReader) Read([]byte) (int, error) { select {} }
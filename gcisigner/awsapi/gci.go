@@ -1,3 +1,43 @@
 package awsapi
 
-var RegionalGetCallerIdentityURLTemplate = "https://sts.{region}.amazonaws.com?Action=GetCallerIdentity&Version=2011-06-15"
+import "fmt"
+
+// getCallerIdentityQuery is the query string of a GetCallerIdentity request.
+const getCallerIdentityQuery = "?Action=GetCallerIdentity&Version=2011-06-15"
+
+// RegionalGetCallerIdentityURLTemplate is the URL of STS's GetCallerIdentity
+// in the aws partition, with "{region}" standing in for the region.
+//
+// Deprecated: it's wrong for regions outside the aws partition and can't
+// give FIPS endpoints, use GetCallerIdentityURL.
+var RegionalGetCallerIdentityURLTemplate = "https://sts.{region}.amazonaws.com" + getCallerIdentityQuery
+
+// stsFIPSRegions are the regions STS has FIPS endpoints in, and their hosts.
+// GovCloud's regular endpoints are FIPS ones already.
+var stsFIPSRegions = map[Region]string{
+	Region_US_EAST_1:     "sts-fips.us-east-1.amazonaws.com",
+	Region_US_EAST_2:     "sts-fips.us-east-2.amazonaws.com",
+	Region_US_WEST_1:     "sts-fips.us-west-1.amazonaws.com",
+	Region_US_WEST_2:     "sts-fips.us-west-2.amazonaws.com",
+	Region_US_GOV_EAST_1: "sts.us-gov-east-1.amazonaws.com",
+	Region_US_GOV_WEST_1: "sts.us-gov-west-1.amazonaws.com",
+}
+
+// GetCallerIdentityURL returns the URL of STS's GetCallerIdentity in `region`,
+// at its FIPS endpoint if `fips` is set. A request must be sent to the same
+// URL it was signed for, so signers and verifiers both build it here.
+func GetCallerIdentityURL(region Region, fips bool) (string, error) {
+	if !region.IsValid() {
+		return "", fmt.Errorf("invalid region: %q", region)
+	}
+
+	host := fmt.Sprintf("sts.%s.%s", region, region.Partition().DNSSuffix())
+	if fips {
+		var ok bool
+		if host, ok = stsFIPSRegions[region]; !ok {
+			return "", fmt.Errorf("STS has no FIPS endpoint in %q", region)
+		}
+	}
+
+	return "https://" + host + getCallerIdentityQuery, nil
+}
@@ -19,4 +19,8 @@ type GetCallerIdentityResult struct {
 	Account string `xml:"Account"`
 }
 
-type ResponseMetadata any
+// ResponseMetadata identifies the request STS answered, which AWS support can
+// use to find it.
+type ResponseMetadata struct {
+	RequestId string `xml:"RequestId"`
+}
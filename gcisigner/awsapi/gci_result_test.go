@@ -37,4 +37,8 @@ func TestGetCallerIdentityXML(t *testing.T) {
 	if resp.GetCallerIdentityResult.Arn != "arn:aws:sts::1234567890:assumed-role/RoleName/roleSession" {
 		t.Errorf("received incorrect ARN %s", resp.GetCallerIdentityResult.Arn)
 	}
+
+	if resp.ResponseMetadata.RequestId != "bc2b1bf3-cc93-43bd-a16c-604c592e523e" {
+		t.Errorf("expected request id bc2b1bf3-cc93-43bd-a16c-604c592e523e, got %s", resp.ResponseMetadata.RequestId)
+	}
 }
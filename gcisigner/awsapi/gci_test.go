@@ -0,0 +1,65 @@
+package awsapi_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/thomasdesr/roast/gcisigner/awsapi"
+)
+
+func TestGetCallerIdentityURL(t *testing.T) {
+	tests := []struct {
+		region   awsapi.Region
+		fips     bool
+		wantHost string
+	}{
+		{awsapi.Region_US_WEST_2, false, "sts.us-west-2.amazonaws.com"},
+		{awsapi.Region_US_WEST_2, true, "sts-fips.us-west-2.amazonaws.com"},
+		{awsapi.Region_EU_CENTRAL_2, false, "sts.eu-central-2.amazonaws.com"},
+		{awsapi.Region_CN_NORTH_1, false, "sts.cn-north-1.amazonaws.com.cn"},
+		{awsapi.Region_US_GOV_WEST_1, false, "sts.us-gov-west-1.amazonaws.com"},
+		{awsapi.Region_US_GOV_WEST_1, true, "sts.us-gov-west-1.amazonaws.com"},
+
+		// No such region, and no FIPS endpoints outside the US
+		{"eu-northeast-1", false, ""},
+		{awsapi.Region_EU_WEST_1, true, ""},
+		{awsapi.Region_CN_NORTH_1, true, ""},
+	}
+
+	for _, tt := range tests {
+		url, err := awsapi.GetCallerIdentityURL(tt.region, tt.fips)
+		if tt.wantHost == "" {
+			if err == nil {
+				t.Errorf("expected no endpoint for %q (fips=%v), got %q", tt.region, tt.fips, url)
+			}
+			continue
+		}
+
+		want := "https://" + tt.wantHost + "?Action=GetCallerIdentity&Version=2011-06-15"
+		if err != nil || url != want {
+			t.Errorf("expected %q (fips=%v) to be at %q, got %q (err=%v)", tt.region, tt.fips, want, url, err)
+		}
+	}
+}
+
+func TestRegionalGetCallerIdentityURLTemplate(t *testing.T) {
+	// The deprecated template still gives the same URLs in the aws partition
+	got := strings.Replace(awsapi.RegionalGetCallerIdentityURLTemplate, "{region}", awsapi.Region_EU_WEST_1.String(), 1)
+	want, err := awsapi.GetCallerIdentityURL(awsapi.Region_EU_WEST_1, false)
+	if err != nil || got != want {
+		t.Errorf("expected the template to give %q, got %q (err=%v)", want, got, err)
+	}
+}
+
+func TestRegionPartition(t *testing.T) {
+	for region, want := range map[awsapi.Region]awsapi.Partition{
+		awsapi.Region_US_EAST_1:      awsapi.PartitionAWS,
+		awsapi.Region_CN_NORTHWEST_1: awsapi.PartitionAWSCN,
+		awsapi.Region_US_GOV_EAST_1:  awsapi.PartitionAWSUSGov,
+		"eu-northeast-1":             "",
+	} {
+		if got := region.Partition(); got != want {
+			t.Errorf("expected %q to be in partition %q, got %q", region, want, got)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package awsapi
+
+// Partition is an AWS partition, a group of regions with its own endpoints,
+// accounts and ARNs, e.g. arn:aws-cn:iam::123456789012:role/name.
+type Partition string
+
+const (
+	PartitionAWS      Partition = "aws"
+	PartitionAWSCN    Partition = "aws-cn"
+	PartitionAWSUSGov Partition = "aws-us-gov"
+)
+
+func (p Partition) String() string {
+	return string(p)
+}
+
+// DNSSuffix returns the domain the partition's endpoints are under.
+func (p Partition) DNSSuffix() string {
+	switch p {
+	case PartitionAWS, PartitionAWSUSGov:
+		return "amazonaws.com"
+	case PartitionAWSCN:
+		return "amazonaws.com.cn"
+	}
+	return ""
+}
@@ -8,30 +8,98 @@ import (
 type Region string
 
 const (
+	// aws
 	Region_US_EAST_1      Region = "us-east-1"
 	Region_US_EAST_2      Region = "us-east-2"
 	Region_US_WEST_1      Region = "us-west-1"
 	Region_US_WEST_2      Region = "us-west-2"
-	Region_EU_WEST_1      Region = "eu-west-1"
-	Region_EU_CENTRAL_1   Region = "eu-central-1"
-	Region_EU_NORTH_1     Region = "eu-north-1"
-	Region_AP_SOUTHEAST_1 Region = "ap-southeast-1"
-	Region_AP_SOUTHEAST_2 Region = "ap-southeast-2"
+	Region_AF_SOUTH_1     Region = "af-south-1"
+	Region_AP_EAST_1      Region = "ap-east-1"
+	Region_AP_EAST_2      Region = "ap-east-2"
 	Region_AP_NORTHEAST_1 Region = "ap-northeast-1"
 	Region_AP_NORTHEAST_2 Region = "ap-northeast-2"
+	Region_AP_NORTHEAST_3 Region = "ap-northeast-3"
 	Region_AP_SOUTH_1     Region = "ap-south-1"
-	Region_SA_EAST_1      Region = "sa-east-1"
+	Region_AP_SOUTH_2     Region = "ap-south-2"
+	Region_AP_SOUTHEAST_1 Region = "ap-southeast-1"
+	Region_AP_SOUTHEAST_2 Region = "ap-southeast-2"
+	Region_AP_SOUTHEAST_3 Region = "ap-southeast-3"
+	Region_AP_SOUTHEAST_4 Region = "ap-southeast-4"
+	Region_AP_SOUTHEAST_5 Region = "ap-southeast-5"
+	Region_AP_SOUTHEAST_7 Region = "ap-southeast-7"
 	Region_CA_CENTRAL_1   Region = "ca-central-1"
-	Region_ME_SOUTH_1     Region = "me-south-1"
-	Region_AF_SOUTH_1     Region = "af-south-1"
-	Region_EU_WEST_2      Region = "eu-west-2"
+	Region_CA_WEST_1      Region = "ca-west-1"
+	Region_EU_CENTRAL_1   Region = "eu-central-1"
+	Region_EU_CENTRAL_2   Region = "eu-central-2"
+	Region_EU_NORTH_1     Region = "eu-north-1"
 	Region_EU_SOUTH_1     Region = "eu-south-1"
-	Region_AP_EAST_1      Region = "ap-east-1"
+	Region_EU_SOUTH_2     Region = "eu-south-2"
+	Region_EU_WEST_1      Region = "eu-west-1"
+	Region_EU_WEST_2      Region = "eu-west-2"
 	Region_EU_WEST_3      Region = "eu-west-3"
-	Region_EU_NORTHEAST_1 Region = "eu-northeast-1"
-	Region_AP_NORTHEAST_3 Region = "ap-northeast-3"
+	Region_IL_CENTRAL_1   Region = "il-central-1"
+	Region_ME_CENTRAL_1   Region = "me-central-1"
+	Region_ME_SOUTH_1     Region = "me-south-1"
+	Region_MX_CENTRAL_1   Region = "mx-central-1"
+	Region_SA_EAST_1      Region = "sa-east-1"
+
+	// aws-cn
+	Region_CN_NORTH_1     Region = "cn-north-1"
+	Region_CN_NORTHWEST_1 Region = "cn-northwest-1"
+
+	// aws-us-gov
+	Region_US_GOV_EAST_1 Region = "us-gov-east-1"
+	Region_US_GOV_WEST_1 Region = "us-gov-west-1"
 )
 
+// Region_EU_NORTHEAST_1 is not a region AWS has.
+//
+// Deprecated: it was listed by mistake and is no longer valid.
+const Region_EU_NORTHEAST_1 Region = "eu-northeast-1"
+
+// regionPartitions is every region we know of, and the partition it's in.
+var regionPartitions = map[Region]Partition{
+	Region_US_EAST_1:      PartitionAWS,
+	Region_US_EAST_2:      PartitionAWS,
+	Region_US_WEST_1:      PartitionAWS,
+	Region_US_WEST_2:      PartitionAWS,
+	Region_AF_SOUTH_1:     PartitionAWS,
+	Region_AP_EAST_1:      PartitionAWS,
+	Region_AP_EAST_2:      PartitionAWS,
+	Region_AP_NORTHEAST_1: PartitionAWS,
+	Region_AP_NORTHEAST_2: PartitionAWS,
+	Region_AP_NORTHEAST_3: PartitionAWS,
+	Region_AP_SOUTH_1:     PartitionAWS,
+	Region_AP_SOUTH_2:     PartitionAWS,
+	Region_AP_SOUTHEAST_1: PartitionAWS,
+	Region_AP_SOUTHEAST_2: PartitionAWS,
+	Region_AP_SOUTHEAST_3: PartitionAWS,
+	Region_AP_SOUTHEAST_4: PartitionAWS,
+	Region_AP_SOUTHEAST_5: PartitionAWS,
+	Region_AP_SOUTHEAST_7: PartitionAWS,
+	Region_CA_CENTRAL_1:   PartitionAWS,
+	Region_CA_WEST_1:      PartitionAWS,
+	Region_EU_CENTRAL_1:   PartitionAWS,
+	Region_EU_CENTRAL_2:   PartitionAWS,
+	Region_EU_NORTH_1:     PartitionAWS,
+	Region_EU_SOUTH_1:     PartitionAWS,
+	Region_EU_SOUTH_2:     PartitionAWS,
+	Region_EU_WEST_1:      PartitionAWS,
+	Region_EU_WEST_2:      PartitionAWS,
+	Region_EU_WEST_3:      PartitionAWS,
+	Region_IL_CENTRAL_1:   PartitionAWS,
+	Region_ME_CENTRAL_1:   PartitionAWS,
+	Region_ME_SOUTH_1:     PartitionAWS,
+	Region_MX_CENTRAL_1:   PartitionAWS,
+	Region_SA_EAST_1:      PartitionAWS,
+
+	Region_CN_NORTH_1:     PartitionAWSCN,
+	Region_CN_NORTHWEST_1: PartitionAWSCN,
+
+	Region_US_GOV_EAST_1: PartitionAWSUSGov,
+	Region_US_GOV_WEST_1: PartitionAWSUSGov,
+}
+
 func (r Region) MarshalJSON() ([]byte, error) {
 	if !r.IsValid() {
 		return nil, fmt.Errorf("invalid region: %q", string(r))
@@ -57,30 +125,12 @@ func (r Region) String() string {
 }
 
 func (r Region) IsValid() bool {
-	switch r {
-	case Region_US_EAST_1,
-		Region_US_EAST_2,
-		Region_US_WEST_1,
-		Region_US_WEST_2,
-		Region_EU_WEST_1,
-		Region_EU_CENTRAL_1,
-		Region_EU_NORTH_1,
-		Region_AP_SOUTHEAST_1,
-		Region_AP_SOUTHEAST_2,
-		Region_AP_NORTHEAST_1,
-		Region_AP_NORTHEAST_2,
-		Region_AP_SOUTH_1,
-		Region_SA_EAST_1,
-		Region_CA_CENTRAL_1,
-		Region_ME_SOUTH_1,
-		Region_AF_SOUTH_1,
-		Region_EU_WEST_2,
-		Region_EU_SOUTH_1,
-		Region_AP_EAST_1,
-		Region_EU_WEST_3,
-		Region_EU_NORTHEAST_1,
-		Region_AP_NORTHEAST_3:
-		return true
-	}
-	return false
+	_, ok := regionPartitions[r]
+	return ok
+}
+
+// Partition returns the partition the region is in, or "" if it isn't a
+// region we know of.
+func (r Region) Partition() Partition {
+	return regionPartitions[r]
 }
@@ -1,27 +1,74 @@
 package gcisigner
 
 import (
+	"log/slog"
+
 	"github.com/thomasdesr/roast/gcisigner/awsapi"
+	"github.com/thomasdesr/roast/internal/logutil"
 )
 
 type SignedMessage struct {
 	Body []byte
 	Mask []byte
 
-	Region            awsapi.Region
+	Region awsapi.Region
+	// FIPS is set if the message was signed for the region's FIPS STS
+	// endpoint, which it must then be verified with too.
+	FIPS bool `json:",omitempty"`
+
 	AmzAuthorization  string
 	XAmzSecurityToken string
 	XAmzDate          string
 }
 
+// LogValue keeps the message's credentials and mask out of logs.
+func (m SignedMessage) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("Region", m.Region.String()),
+		slog.Bool("FIPS", m.FIPS),
+		slog.String("XAmzDate", m.XAmzDate),
+		slog.Int("BodySize", len(m.Body)),
+		slog.String("AmzAuthorization", logutil.Redacted),
+		slog.String("XAmzSecurityToken", logutil.Redacted),
+		slog.String("Mask", logutil.Redacted),
+	)
+}
+
 // Same as a SignedMessage, but since we're on the read side, we want to make it
 // clear to readers we don't trust its contents yet
 type UnverifiedMessage SignedMessage
 
+// LogValue keeps the message's credentials and mask out of logs.
+func (m UnverifiedMessage) LogValue() slog.Value {
+	return SignedMessage(m).LogValue()
+}
+
 type VerifiedMessage struct {
 	Payload        []byte
 	CallerIdentity awsapi.GetCallerIdentityResult
 
+	// RequestID is the ID STS gave the GetCallerIdentity request that
+	// verified the message.
+	RequestID string
+
+	// MatchedRule describes which of the source verifier's rules accepted
+	// the caller, if it says (see source_verifiers.Matcher).
+	MatchedRule string
+
 	// The original message that was verified
 	Raw *SignedMessage
 }
+
+// LogValue describes who the message was verified as coming from, keeping
+// the original message's credentials and mask out of logs.
+func (m VerifiedMessage) LogValue() slog.Value {
+	attrs := []slog.Attr{
+		slog.String("CallerArn", m.CallerIdentity.Arn),
+		slog.String("Account", m.CallerIdentity.Account),
+		slog.String("RequestID", m.RequestID),
+	}
+	if m.Raw != nil {
+		attrs = append(attrs, slog.Any("Raw", m.Raw))
+	}
+	return slog.GroupValue(attrs...)
+}
@@ -0,0 +1,37 @@
+package gcisigner
+
+import (
+	"io"
+
+	"github.com/thomasdesr/roast/gcisigner/awsapi"
+	"github.com/thomasdesr/roast/internal/metrics"
+)
+
+var metricsRegistry = &metrics.Registry{}
+
+var (
+	stsVerifyDuration = metrics.NewHistogram(metricsRegistry,
+		"gcisigner_sts_verify_duration_seconds",
+		"How long STS took to answer the GetCallerIdentity requests made to verify messages.",
+		metrics.DefBuckets, "region")
+
+	stsResponses = metrics.NewCounter(metricsRegistry,
+		"gcisigner_sts_responses_total",
+		`Responses from STS to the GetCallerIdentity requests made to verify messages, by HTTP status, or "error" when there was none.`,
+		"region", "status")
+)
+
+// WriteMetrics writes the package's metrics to `w` in the Prometheus text
+// exposition format.
+func WriteMetrics(w io.Writer) error {
+	return metricsRegistry.WriteText(w)
+}
+
+// regionLabel is the region label for a message, which comes from a peer we
+// haven't verified yet, so anything we don't recognise is lumped together.
+func regionLabel(region awsapi.Region) string {
+	if !region.IsValid() {
+		return "invalid"
+	}
+	return region.String()
+}
@@ -0,0 +1,195 @@
+package gcisigner
+
+import (
+	"container/heap"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultReplayGuardMaxSkew is the clock skew window used by a ReplayGuard
+	// when none is provided. It is deliberately tighter than the ~15 minutes
+	// STS itself will accept.
+	DefaultReplayGuardMaxSkew = 5 * time.Minute
+
+	// DefaultReplayGuardMaxEntries is the number of signatures a ReplayGuard
+	// will remember when no limit is provided.
+	DefaultReplayGuardMaxEntries = 1 << 16
+
+	// amzDateFormat is the ISO 8601 basic format used by the X-Amz-Date header.
+	amzDateFormat = "20060102T150405Z"
+)
+
+var (
+	// ErrReplayedMessage indicates a message's signature has already been seen.
+	ErrReplayedMessage = errors.New("message has already been seen")
+
+	// ErrStaleMessage indicates a message was signed too far in the past (or
+	// future) to be accepted.
+	ErrStaleMessage = errors.New("message is outside the allowed clock skew")
+)
+
+// ReplayError is returned when a ReplayGuard rejects a message. It always
+// wraps either ErrReplayedMessage or ErrStaleMessage.
+type ReplayError struct {
+	Reason error
+
+	// XAmzDate is the signing time claimed by the rejected message.
+	XAmzDate string
+}
+
+func (e *ReplayError) Error() string {
+	return fmt.Sprintf("replay guard rejected message signed at %q: %v", e.XAmzDate, e.Reason)
+}
+
+func (e *ReplayError) Unwrap() error {
+	return e.Reason
+}
+
+// ReplayGuard rejects messages that are either too old to be fresh or whose
+// signatures it has already seen, without having to ask STS about them.
+//
+// A ReplayGuard only remembers what the process it lives in has seen. It stops
+// a message recorded from one connection being replayed against the same
+// Verifier, not against a Verifier running somewhere else.
+type ReplayGuard struct {
+	maxSkew    time.Duration
+	maxEntries int
+
+	nowFunc func() time.Time
+
+	mu       sync.Mutex
+	seen     map[[sha256.Size]byte]time.Time // signature hash -> expiry
+	expiries expiryHeap
+}
+
+// NewReplayGuard creates a ReplayGuard that accepts messages signed within
+// `maxSkew` of the local clock and remembers up to `maxEntries` signatures.
+// Zero values select DefaultReplayGuardMaxSkew and
+// DefaultReplayGuardMaxEntries.
+func NewReplayGuard(maxSkew time.Duration, maxEntries int) *ReplayGuard {
+	if maxSkew <= 0 {
+		maxSkew = DefaultReplayGuardMaxSkew
+	}
+	if maxEntries <= 0 {
+		maxEntries = DefaultReplayGuardMaxEntries
+	}
+
+	return &ReplayGuard{
+		maxSkew:    maxSkew,
+		maxEntries: maxEntries,
+		nowFunc:    time.Now,
+		seen:       make(map[[sha256.Size]byte]time.Time),
+	}
+}
+
+// Check returns a *ReplayError if `msg` is stale or has been seen before.
+// Otherwise it remembers the message's signature until it would have become
+// stale anyway, so any later Check of the same message fails.
+func (g *ReplayGuard) Check(msg *UnverifiedMessage) error {
+	signedAt, err := time.Parse(amzDateFormat, msg.XAmzDate)
+	if err != nil {
+		return &ReplayError{Reason: ErrStaleMessage, XAmzDate: msg.XAmzDate}
+	}
+
+	now := g.nowFunc()
+	if signedAt.Before(now.Add(-g.maxSkew)) || signedAt.After(now.Add(g.maxSkew)) {
+		return &ReplayError{Reason: ErrStaleMessage, XAmzDate: msg.XAmzDate}
+	}
+
+	key := signatureKey(msg)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.expireLocked(now)
+
+	if _, ok := g.seen[key]; ok {
+		return &ReplayError{Reason: ErrReplayedMessage, XAmzDate: msg.XAmzDate}
+	}
+
+	// Once full, make room by forgetting whatever would have gone stale first
+	for len(g.seen) >= g.maxEntries && len(g.expiries) > 0 {
+		g.evictLocked()
+	}
+
+	expiry := signedAt.Add(g.maxSkew)
+	g.seen[key] = expiry
+	heap.Push(&g.expiries, expiryEntry{key: key, expiry: expiry})
+
+	// Forgotten entries leave tombstones in the heap, keep them from piling up
+	if len(g.expiries) > 2*g.maxEntries {
+		g.compactLocked()
+	}
+
+	return nil
+}
+
+// Forget removes `msg` from the set of seen signatures. Verifiers use it when
+// a message they just Checked turns out not to carry a valid signature, so
+// that junk can't crowd out real entries.
+func (g *ReplayGuard) Forget(msg *UnverifiedMessage) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	delete(g.seen, signatureKey(msg))
+}
+
+func (g *ReplayGuard) expireLocked(now time.Time) {
+	for len(g.expiries) > 0 && g.expiries[0].expiry.Before(now) {
+		g.evictLocked()
+	}
+}
+
+// evictLocked drops the entry closest to expiring.
+func (g *ReplayGuard) evictLocked() {
+	for len(g.expiries) > 0 {
+		e := heap.Pop(&g.expiries).(expiryEntry)
+
+		// Skip tombstones for entries that were forgotten or re-added
+		if expiry, ok := g.seen[e.key]; ok && expiry.Equal(e.expiry) {
+			delete(g.seen, e.key)
+			return
+		}
+	}
+}
+
+func (g *ReplayGuard) compactLocked() {
+	g.expiries = g.expiries[:0]
+	for key, expiry := range g.seen {
+		g.expiries = append(g.expiries, expiryEntry{key: key, expiry: expiry})
+	}
+	heap.Init(&g.expiries)
+}
+
+// signatureKey identifies a message by its Authorization header, which
+// contains the SigV4 signature along with its credential scope.
+func signatureKey(msg *UnverifiedMessage) [sha256.Size]byte {
+	return sha256.Sum256([]byte(msg.AmzAuthorization))
+}
+
+type expiryEntry struct {
+	key    [sha256.Size]byte
+	expiry time.Time
+}
+
+// expiryHeap is a min-heap of expiryEntries ordered by expiry.
+type expiryHeap []expiryEntry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].expiry.Before(h[j].expiry) }
+func (h expiryHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *expiryHeap) Push(x any) {
+	*h = append(*h, x.(expiryEntry))
+}
+
+func (h *expiryHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
@@ -0,0 +1,143 @@
+package gcisigner_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/thomasdesr/roast/gcisigner"
+	"github.com/thomasdesr/roast/gcisigner/awsapi"
+	"github.com/thomasdesr/roast/gcisigner/source_verifiers"
+)
+
+func TestReplayGuardRejectsReplays(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewTLSServer(countingHandler(&calls, &gciServer{tb: t, responses: []awsapi.GetCallerIdentityResponse{
+		{
+			GetCallerIdentityResult: awsapi.GetCallerIdentityResult{
+				Arn:     "arn:aws:sts::1234567890:assumed-role/RoleName/roleSession",
+				UserId:  "AROAEXAMPLE",
+				Account: "1234567890",
+			},
+		},
+	}}))
+	defer srv.Close()
+
+	msg := signTestMessage(t)
+
+	v := gcisigner.NewVerifier(allowAll, httptestServerTransport(srv),
+		gcisigner.WithReplayGuard(gcisigner.NewReplayGuard(0, 0)),
+	)
+
+	if _, err := v.Verify(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := v.Verify(context.Background(), msg)
+
+	var replayErr *gcisigner.ReplayError
+	if !errors.As(err, &replayErr) {
+		t.Fatalf("expected a *ReplayError, got %v", err)
+	}
+	if !errors.Is(err, gcisigner.ErrReplayedMessage) {
+		t.Errorf("expected %v, got %v", gcisigner.ErrReplayedMessage, err)
+	}
+
+	if n := calls.Load(); n != 1 {
+		t.Errorf("expected the replay to be rejected without calling STS, STS was called %d times", n)
+	}
+}
+
+func TestReplayGuardRejectsStaleMessages(t *testing.T) {
+	g := gcisigner.NewReplayGuard(time.Minute, 0)
+
+	for name, date := range map[string]string{
+		"too old":      time.Now().Add(-2 * time.Minute).UTC().Format("20060102T150405Z"),
+		"too new":      time.Now().Add(2 * time.Minute).UTC().Format("20060102T150405Z"),
+		"not a date":   "date",
+		"missing date": "",
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := g.Check(&gcisigner.UnverifiedMessage{AmzAuthorization: name, XAmzDate: date})
+			if !errors.Is(err, gcisigner.ErrStaleMessage) {
+				t.Errorf("expected %v, got %v", gcisigner.ErrStaleMessage, err)
+			}
+		})
+	}
+}
+
+func TestReplayGuardForgetsFailedVerifications(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "signature does not match", http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	g := gcisigner.NewReplayGuard(0, 0)
+	v := gcisigner.NewVerifier(allowAll, httptestServerTransport(srv), gcisigner.WithReplayGuard(g))
+
+	msg := signTestMessage(t)
+	if _, err := v.Verify(context.Background(), msg); err == nil {
+		t.Fatal("expected verification to fail")
+	}
+
+	// A message STS rejected shouldn't take up space in the guard
+	if err := g.Check(msg); err != nil {
+		t.Errorf("expected message to have been forgotten, got %v", err)
+	}
+}
+
+func TestReplayGuardIsBounded(t *testing.T) {
+	g := gcisigner.NewReplayGuard(0, 2)
+
+	msgs := make([]*gcisigner.UnverifiedMessage, 3)
+	for i := range msgs {
+		msgs[i] = &gcisigner.UnverifiedMessage{
+			AmzAuthorization: string(rune('a' + i)),
+			XAmzDate:         time.Now().Add(time.Duration(i) * time.Second).UTC().Format("20060102T150405Z"),
+		}
+
+		if err := g.Check(msgs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The oldest entry was evicted to make room, the newer ones are remembered
+	if err := g.Check(msgs[0]); err != nil {
+		t.Errorf("expected the oldest entry to have been evicted, got %v", err)
+	}
+	if err := g.Check(msgs[2]); !errors.Is(err, gcisigner.ErrReplayedMessage) {
+		t.Errorf("expected the newest entry to be remembered, got %v", err)
+	}
+}
+
+var allowAll = source_verifiers.VerifyFunc(func(*awsapi.GetCallerIdentityResult) (bool, error) {
+	return true, nil
+})
+
+func signTestMessage(t testing.TB) *gcisigner.UnverifiedMessage {
+	t.Helper()
+
+	signer, err := gcisigner.NewSigner("us-west-2", credentials.NewStaticCredentialsProvider("AKIA", "SK", "TK"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := signer.Sign(context.Background(), []byte("Hello World!"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return (*gcisigner.UnverifiedMessage)(msg)
+}
+
+func countingHandler(calls *atomic.Int32, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		h.ServeHTTP(w, r)
+	})
+}
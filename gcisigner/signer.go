@@ -8,7 +8,6 @@ import (
 	"encoding/hex"
 	"fmt"
 	"net/http"
-	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -27,6 +26,7 @@ type Signer interface {
 // that can be send to a `Verifier` for verification.
 type SigV4Signer struct {
 	region awsapi.Region
+	fips   bool
 
 	creds       aws.CredentialsProvider
 	sigV4Signer *v4.Signer
@@ -36,35 +36,67 @@ type SigV4Signer struct {
 
 var _ Signer = &SigV4Signer{}
 
-func NewSigner(regionName string, creds aws.CredentialsProvider) (*SigV4Signer, error) {
+// SignerOption configures optional behavior of a SigV4Signer.
+type SignerOption func(s *SigV4Signer)
+
+// WithFIPSEndpoint makes the SigV4Signer sign requests for STS's FIPS
+// endpoint, which Verifiers then verify them with. Only some regions have
+// one.
+func WithFIPSEndpoint() SignerOption {
+	return func(s *SigV4Signer) {
+		s.fips = true
+	}
+}
+
+func NewSigner(regionName string, creds aws.CredentialsProvider, opts ...SignerOption) (*SigV4Signer, error) {
 	region := awsapi.Region(regionName)
 	if !region.IsValid() { // Ensure we get handed a valid region
 		return nil, fmt.Errorf("invalid region: %q", regionName)
 	}
 
-	return &SigV4Signer{
+	s := &SigV4Signer{
 		region:      region,
 		creds:       creds,
 		sigV4Signer: v4.NewSigner(),
 		nowFunc:     time.Now,
-	}, nil
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	// Make sure there's an endpoint to sign for
+	if _, err := awsapi.GetCallerIdentityURL(s.region, s.fips); err != nil {
+		return nil, err
+	}
+
+	return s, nil
 }
 
 // Sign takes a payload and returns a `SignedMessage` that can be sent to a
 // another client and probably validated by a `Verifier`.
 func (s *SigV4Signer) Sign(ctx context.Context, payload []byte) (*SignedMessage, error) {
+	trace := signTraceFrom(ctx)
+
 	// Retrieve the credentials we'll use to Sign this request
+	if trace.GetCredentialsStart != nil {
+		trace.GetCredentialsStart()
+	}
 	creds, err := s.creds.Retrieve(ctx)
+	if trace.GotCredentials != nil {
+		trace.GotCredentials(err)
+	}
 	if err != nil {
 		return nil, errorutil.Wrap(err, "getting credentials")
 	}
 
 	// Construct the GetCallerIdentity request we need to sign
-	req, err := http.NewRequest(
-		"POST",
-		strings.Replace(awsapi.RegionalGetCallerIdentityURLTemplate, "{region}", s.region.String(), 1),
-		bytes.NewBuffer(payload),
-	)
+	url, err := awsapi.GetCallerIdentityURL(s.region, s.fips)
+	if err != nil {
+		return nil, errorutil.Wrap(err, "building STS URL")
+	}
+
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(payload))
 	if err != nil {
 		return nil, errorutil.Wrap(err, "creating request")
 	}
@@ -92,6 +124,7 @@ func (s *SigV4Signer) Sign(ctx context.Context, payload []byte) (*SignedMessage,
 	// Construct our "SignedMessage" we can safely hand to clients
 	return &SignedMessage{
 		Region:            s.region,
+		FIPS:              s.fips,
 		Body:              masker.Mask(mask, payload),
 		Mask:              mask,
 		AmzAuthorization:  signedReq.Header.Get("Authorization"),
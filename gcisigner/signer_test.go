@@ -1,11 +1,16 @@
 package gcisigner_test
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/xml"
+	"errors"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/aws/aws-sdk-go-v2/credentials"
@@ -85,3 +90,113 @@ func httptestServerTransport(srv *httptest.Server) *http.Transport {
 
 	return tr
 }
+
+func TestSignTrace(t *testing.T) {
+	signer, err := gcisigner.NewSigner("us-west-2", credentials.NewStaticCredentialsProvider("AKIA", "SK", "TK"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var events []string
+	ctx := gcisigner.WithSignTrace(context.Background(), &gcisigner.SignTrace{
+		GetCredentialsStart: func() { events = append(events, "start") },
+		GotCredentials: func(err error) {
+			if err != nil {
+				t.Errorf("unexpected error getting credentials: %v", err)
+			}
+			events = append(events, "done")
+		},
+	})
+
+	if _, err := signer.Sign(ctx, []byte("Hello World!")); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 2 || events[0] != "start" || events[1] != "done" {
+		t.Errorf("expected the credential hooks to be called in order, got %v", events)
+	}
+}
+
+func TestSignedMessagesAreRedactedInLogs(t *testing.T) {
+	const token = "SECRET-SESSION-TOKEN"
+
+	signer, err := gcisigner.NewSigner("us-west-2", credentials.NewStaticCredentialsProvider("AKIA", "SK", token))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := signer.Sign(context.Background(), []byte("Hello World!"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+	logger.Info("signed", "msg", msg, "unverified", (*gcisigner.UnverifiedMessage)(msg))
+
+	for name, secret := range map[string]string{
+		"security token": msg.XAmzSecurityToken,
+		"authorization":  msg.AmzAuthorization,
+		"mask":           base64.StdEncoding.EncodeToString(msg.Mask),
+	} {
+		if strings.Contains(buf.String(), secret) {
+			t.Errorf("expected the %s to be redacted, got: %s", name, buf.String())
+		}
+	}
+}
+
+func TestSignVerifyPartitions(t *testing.T) {
+	tests := []struct {
+		region    string
+		fips      bool
+		callerARN string
+		wantHost  string
+		wantErr   error
+	}{
+		{"us-east-1", true, "arn:aws:sts::123456789012:assumed-role/RoleName/roleSession", "sts-fips.us-east-1.amazonaws.com", nil},
+		{"cn-north-1", false, "arn:aws-cn:sts::123456789012:assumed-role/RoleName/roleSession", "sts.cn-north-1.amazonaws.com.cn", nil},
+		{"us-gov-west-1", false, "arn:aws-us-gov:sts::123456789012:assumed-role/RoleName/roleSession", "sts.us-gov-west-1.amazonaws.com", nil},
+		{"cn-north-1", false, "arn:aws:sts::123456789012:assumed-role/RoleName/roleSession", "sts.cn-north-1.amazonaws.com.cn", gcisigner.ErrInvalidSource},
+	}
+
+	for _, tt := range tests {
+		var gotHost string
+		srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gotHost = r.Host
+			xml.NewEncoder(w).Encode(&awsapi.GetCallerIdentityResponse{
+				GetCallerIdentityResult: awsapi.GetCallerIdentityResult{Arn: tt.callerARN, Account: "123456789012"},
+			})
+		}))
+		defer srv.Close()
+
+		var opts []gcisigner.SignerOption
+		if tt.fips {
+			opts = append(opts, gcisigner.WithFIPSEndpoint())
+		}
+		signer, err := gcisigner.NewSigner(tt.region, credentials.NewStaticCredentialsProvider("AKIA", "SK", "TK"), opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		signedMessage, err := signer.Sign(context.Background(), []byte("Hello World!"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		verifier := gcisigner.NewVerifier(source_verifiers.VerifyFunc(func(*awsapi.GetCallerIdentityResult) (bool, error) {
+			return true, nil
+		}), httptestServerTransport(srv))
+
+		_, err = verifier.Verify(context.Background(), (*gcisigner.UnverifiedMessage)(signedMessage))
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("expected verifying %s from %s to fail with %v, got %v", tt.callerARN, tt.region, tt.wantErr, err)
+		}
+		if gotHost != tt.wantHost {
+			t.Errorf("expected %s (fips=%v) to be verified at %q, got %q", tt.region, tt.fips, tt.wantHost, gotHost)
+		}
+	}
+
+	if _, err := gcisigner.NewSigner("eu-west-1", credentials.NewStaticCredentialsProvider("AKIA", "SK", "TK"), gcisigner.WithFIPSEndpoint()); err == nil {
+		t.Error("expected a FIPS signer to be refused in a region without a FIPS endpoint")
+	}
+}
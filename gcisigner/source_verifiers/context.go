@@ -0,0 +1,28 @@
+package source_verifiers
+
+import (
+	"context"
+	"net"
+	"net/netip"
+)
+
+type sourceAddrContextKey struct{}
+
+// WithSourceAddr returns a context that tells Matchers the network address
+// of the caller being verified.
+func WithSourceAddr(ctx context.Context, addr net.Addr) context.Context {
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		// Not an IP address, e.g. a unix socket, so there's nothing to say
+		return ctx
+	}
+
+	return context.WithValue(ctx, sourceAddrContextKey{}, ap.Addr().Unmap())
+}
+
+// SourceAddrFrom returns the IP address of the caller being verified, if it
+// is known.
+func SourceAddrFrom(ctx context.Context) (netip.Addr, bool) {
+	addr, ok := ctx.Value(sourceAddrContextKey{}).(netip.Addr)
+	return addr, ok
+}
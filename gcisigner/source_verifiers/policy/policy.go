@@ -0,0 +1,406 @@
+// Package policy compiles authorization policy files, which say which
+// callers a Roast peer accepts, into source verifiers.
+//
+// A policy is a JSON document of statements, each of which allows or denies
+// the callers that meet all of its conditions:
+//
+//	{
+//	  "Version": 1,
+//	  "Statements": [
+//	    {
+//	      "Sid": "no-contractors",
+//	      "Effect": "Deny",
+//	      "Priority": 10,
+//	      "Condition": {"Role": ["arn:aws:iam::123456789012:role/contractor-*"]}
+//	    },
+//	    {
+//	      "Sid": "payments-from-vpc",
+//	      "Effect": "Allow",
+//	      "Priority": 20,
+//	      "Condition": {
+//	        "Account": ["123456789012"],
+//	        "SessionName": ["payments-*"],
+//	        "SourceCIDR": ["10.0.0.0/8"]
+//	      }
+//	    }
+//	  ]
+//	}
+//
+// The conditions are:
+//
+//   - Account: the caller's account ID is one of these.
+//   - Role: the role the caller assumed matches one of these patterns, see
+//     sources.RolePattern. STS doesn't say what path a caller's role has, so
+//     wildcard patterns with paths need a policy to be given a
+//     source_verifiers.RolePathResolver, see Policy.WithRolePaths.
+//   - SessionName: the caller's role session name matches one of these,
+//     where `*` matches any run of characters.
+//   - SourceCIDR: the caller is connecting from an address in one of these.
+//
+// Statements are evaluated in order of Priority, lowest first, like the rules
+// of a network ACL, and the first whose conditions are all met decides.
+// Priorities must be unique, so which statement wins never depends on the
+// order they're written in. Callers that meet no statement are denied.
+//
+// Policies are parsed strictly: unknown fields, statements without any
+// conditions and malformed values are all errors, so a typo can't silently
+// widen a policy.
+package policy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/thomasdesr/roast/gcisigner/awsapi"
+	"github.com/thomasdesr/roast/gcisigner/source_verifiers"
+	"github.com/thomasdesr/roast/gcisigner/source_verifiers/sources"
+	"github.com/thomasdesr/roast/internal/errorutil"
+)
+
+// Version is the policy format version this package understands.
+const Version = 1
+
+var (
+	// ErrInvalidPolicy indicates a policy file couldn't be compiled
+	ErrInvalidPolicy = errors.New("invalid policy")
+
+	// ErrSourceAddrUnknown indicates a policy conditions on the caller's
+	// address, but it wasn't known
+	ErrSourceAddrUnknown = errors.New("policy needs the caller's address, which isn't known")
+
+	// ErrRolePathUnknown indicates a policy conditions on the path of the
+	// caller's role, but it wasn't known
+	ErrRolePathUnknown = errors.New("policy needs the path of the caller's role, which isn't known")
+)
+
+var (
+	validSidPattern         = regexp.MustCompile(`^[\w.-]+$`)
+	validAccountPattern     = regexp.MustCompile(`^[0-9]+$`)
+	validSessionNamePattern = regexp.MustCompile(`^[\w+=,.@*-]+$`)
+)
+
+// Effect is what a statement does to the callers it matches.
+type Effect string
+
+const (
+	Allow Effect = "Allow"
+	Deny  Effect = "Deny"
+)
+
+// Decision is the outcome of evaluating a policy for a caller.
+type Decision struct {
+	Effect Effect
+
+	// Statement is the Sid of the statement that decided, or empty if none
+	// did and the caller was denied by default.
+	Statement string
+}
+
+func (d Decision) String() string {
+	if d.Statement == "" {
+		return fmt.Sprintf("%s (no statement matched)", d.Effect)
+	}
+	return fmt.Sprintf("%s by statement %q", d.Effect, d.Statement)
+}
+
+// Policy is a compiled policy. It is a source_verifiers.Matcher, which
+// reports the Sid of the statement that decided as its rule.
+type Policy struct {
+	statements []statement
+
+	// rolePaths, if set, finds the paths of callers' roles
+	rolePaths source_verifiers.RolePathResolver
+}
+
+var _ source_verifiers.Matcher = &Policy{}
+
+type statement struct {
+	sid      string
+	effect   Effect
+	priority int
+
+	accounts     []string
+	roles        []sources.RolePattern
+	sessionNames []string
+	sourceCIDRs  []netip.Prefix
+}
+
+// document is the JSON form of a policy.
+type document struct {
+	Version    int
+	Statements []statementDocument
+}
+
+type statementDocument struct {
+	Sid       string
+	Effect    Effect
+	Priority  *int
+	Condition conditionDocument
+}
+
+type conditionDocument struct {
+	Account     []string
+	Role        []string
+	SessionName []string
+	SourceCIDR  []string
+}
+
+// Load reads and compiles the policy file at `path`.
+func Load(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errorutil.Wrap(err, "failed to read policy")
+	}
+
+	p, err := Parse(data)
+	if err != nil {
+		return nil, errorutil.Wrapf(err, "failed to compile policy %q", path)
+	}
+
+	return p, nil
+}
+
+// Parse compiles a policy from its JSON form.
+func Parse(data []byte) (*Policy, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	var doc document
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidPolicy, err)
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("%w: trailing data after the policy", ErrInvalidPolicy)
+	}
+
+	if doc.Version != Version {
+		return nil, fmt.Errorf("%w: unsupported version %d, must be %d", ErrInvalidPolicy, doc.Version, Version)
+	}
+	if len(doc.Statements) == 0 {
+		return nil, fmt.Errorf("%w: no statements", ErrInvalidPolicy)
+	}
+
+	p := &Policy{}
+	sids := make(map[string]bool)
+	priorities := make(map[int]string)
+
+	for i, sd := range doc.Statements {
+		s, err := compileStatement(sd)
+		if err != nil {
+			return nil, errorutil.Wrapf(err, "statement %d", i)
+		}
+
+		if sids[s.sid] {
+			return nil, fmt.Errorf("%w: more than one statement has Sid %q", ErrInvalidPolicy, s.sid)
+		}
+		sids[s.sid] = true
+
+		if other, ok := priorities[s.priority]; ok {
+			return nil, fmt.Errorf("%w: statements %q and %q have the same priority %d", ErrInvalidPolicy, other, s.sid, s.priority)
+		}
+		priorities[s.priority] = s.sid
+
+		p.statements = append(p.statements, s)
+	}
+
+	slices.SortFunc(p.statements, func(a, b statement) int { return a.priority - b.priority })
+
+	return p, nil
+}
+
+func compileStatement(sd statementDocument) (statement, error) {
+	if !validSidPattern.MatchString(sd.Sid) {
+		return statement{}, fmt.Errorf("%w: Sid must match pattern %q, got %q", ErrInvalidPolicy, validSidPattern.String(), sd.Sid)
+	}
+
+	if sd.Effect != Allow && sd.Effect != Deny {
+		return statement{}, fmt.Errorf("%w: Effect must be %q or %q, got %q", ErrInvalidPolicy, Allow, Deny, sd.Effect)
+	}
+
+	if sd.Priority == nil {
+		return statement{}, fmt.Errorf("%w: statement %q has no Priority", ErrInvalidPolicy, sd.Sid)
+	}
+
+	s := statement{
+		sid:      sd.Sid,
+		effect:   sd.Effect,
+		priority: *sd.Priority,
+	}
+
+	c := sd.Condition
+	if c.Account == nil && c.Role == nil && c.SessionName == nil && c.SourceCIDR == nil {
+		return statement{}, fmt.Errorf("%w: statement %q has no conditions", ErrInvalidPolicy, sd.Sid)
+	}
+
+	for _, account := range c.Account {
+		if !validAccountPattern.MatchString(account) {
+			return statement{}, fmt.Errorf("%w: Account must be an account ID, got %q", ErrInvalidPolicy, account)
+		}
+		s.accounts = append(s.accounts, account)
+	}
+
+	for _, role := range c.Role {
+		a, err := arn.Parse(role)
+		if err != nil {
+			return statement{}, fmt.Errorf("%w: Role %q: %w", ErrInvalidPolicy, role, err)
+		}
+
+		pattern, err := sources.FromARN[sources.RolePattern](a)
+		if err != nil {
+			return statement{}, fmt.Errorf("%w: %w", ErrInvalidPolicy, err)
+		}
+		s.roles = append(s.roles, pattern)
+	}
+
+	for _, name := range c.SessionName {
+		if !validSessionNamePattern.MatchString(name) || strings.Contains(name, "**") {
+			return statement{}, fmt.Errorf("%w: SessionName must match pattern %q without consecutive wildcards, got %q",
+				ErrInvalidPolicy, validSessionNamePattern.String(), name)
+		}
+		s.sessionNames = append(s.sessionNames, name)
+	}
+
+	for _, cidr := range c.SourceCIDR {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return statement{}, fmt.Errorf("%w: SourceCIDR %q: %w", ErrInvalidPolicy, cidr, err)
+		}
+		if prefix != prefix.Masked() {
+			return statement{}, fmt.Errorf("%w: SourceCIDR %q has host bits set, did you mean %q?", ErrInvalidPolicy, cidr, prefix.Masked())
+		}
+		s.sourceCIDRs = append(s.sourceCIDRs, prefix)
+	}
+
+	// An empty list would be a condition that nothing meets, which is more
+	// likely a mistake than a way of disabling a statement
+	if (c.Account != nil && len(c.Account) == 0) || (c.Role != nil && len(c.Role) == 0) ||
+		(c.SessionName != nil && len(c.SessionName) == 0) || (c.SourceCIDR != nil && len(c.SourceCIDR) == 0) {
+		return statement{}, fmt.Errorf("%w: statement %q has an empty condition", ErrInvalidPolicy, sd.Sid)
+	}
+
+	return s, nil
+}
+
+// WithRolePaths returns a copy of the policy that uses `resolve` to find the
+// paths of callers' roles, which Role conditions with paths need to be
+// evaluated.
+func (p *Policy) WithRolePaths(resolve source_verifiers.RolePathResolver) *Policy {
+	withPaths := *p
+	withPaths.rolePaths = resolve
+	return &withPaths
+}
+
+// Evaluate decides whether `caller`, connecting from `source`, is allowed
+// by the policy. `source` may be the zero Addr if it isn't known, in which
+// case policies that condition on it fail to evaluate, as do those that
+// condition on the path of a caller's role the policy can't resolve.
+func (p *Policy) Evaluate(ctx context.Context, caller sources.AssumedRole, source netip.Addr) (Decision, error) {
+	role, err := caller.SessionIssuer()
+	if err != nil {
+		return Decision{}, errorutil.Wrap(err, "failed to get the caller's role")
+	}
+
+	role, err = source_verifiers.ResolveRolePath(ctx, p.rolePaths, role)
+	if err != nil {
+		return Decision{}, err
+	}
+
+	for _, s := range p.statements {
+		ok, err := s.matches(caller, role, source)
+		if err != nil {
+			return Decision{}, err
+		}
+		if ok {
+			return Decision{Effect: s.effect, Statement: s.sid}, nil
+		}
+	}
+
+	return Decision{Effect: Deny}, nil
+}
+
+func (s *statement) matches(caller sources.AssumedRole, role sources.Role, source netip.Addr) (bool, error) {
+	if s.accounts != nil && !slices.Contains(s.accounts, caller.ARN().AccountID) {
+		return false, nil
+	}
+
+	if s.roles != nil {
+		matched, err := s.matchesRole(role)
+		if !matched || err != nil {
+			return false, err
+		}
+	}
+
+	if s.sessionNames != nil && !slices.ContainsFunc(s.sessionNames, func(pattern string) bool {
+		ok, _ := path.Match(pattern, caller.SessionName())
+		return ok
+	}) {
+		return false, nil
+	}
+
+	if s.sourceCIDRs != nil {
+		// Skipping the statement would wrongly allow a caller it denies, so
+		// refuse to decide at all
+		if !source.IsValid() {
+			return false, errorutil.Wrapf(ErrSourceAddrUnknown, "statement %q", s.sid)
+		}
+		if !slices.ContainsFunc(s.sourceCIDRs, func(p netip.Prefix) bool { return p.Contains(source) }) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+func (s *statement) matchesRole(role sources.Role) (bool, error) {
+	for _, pattern := range s.roles {
+		if pattern.Matches(role) {
+			return true, nil
+		}
+
+		// Skipping a pattern that might match were it not for the path we
+		// don't know could wrongly allow a caller the statement denies, so
+		// refuse to decide at all
+		if role.Path() == "" {
+			underPattern, err := role.WithPath(pattern.Path())
+			if err == nil && pattern.Matches(underPattern) {
+				return false, errorutil.Wrapf(ErrRolePathUnknown, "statement %q", s.sid)
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// Verify is Match, without the caller's address.
+func (p *Policy) Verify(gcir *awsapi.GetCallerIdentityResult) (bool, error) {
+	_, ok, err := p.Match(context.Background(), gcir)
+	return ok, err
+}
+
+// Match evaluates the policy for the caller, using the address given by
+// source_verifiers.WithSourceAddr if there is one.
+func (p *Policy) Match(ctx context.Context, gcir *awsapi.GetCallerIdentityResult) (string, bool, error) {
+	caller, err := source_verifiers.CallerAssumedRole(gcir)
+	if err != nil {
+		return "", false, err
+	}
+
+	source, _ := source_verifiers.SourceAddrFrom(ctx)
+
+	d, err := p.Evaluate(ctx, caller, source)
+	if err != nil {
+		return "", false, err
+	}
+
+	return d.Statement, d.Effect == Allow, nil
+}
@@ -0,0 +1,132 @@
+package policy_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/thomasdesr/roast/gcisigner/awsapi"
+	"github.com/thomasdesr/roast/gcisigner/source_verifiers"
+	"github.com/thomasdesr/roast/gcisigner/source_verifiers/policy"
+	"github.com/thomasdesr/roast/gcisigner/source_verifiers/sources"
+)
+
+const testPolicy = `{
+	"Version": 1,
+	"Statements": [
+		{
+			"Sid": "payments-from-vpc",
+			"Effect": "Allow",
+			"Priority": 20,
+			"Condition": {
+				"Account": ["123456789012"],
+				"SessionName": ["payments-*"],
+				"SourceCIDR": ["10.0.0.0/8"]
+			}
+		},
+		{
+			"Sid": "no-contractors",
+			"Effect": "Deny",
+			"Priority": 10,
+			"Condition": {"Role": ["arn:aws:iam::123456789012:role/contractor-*"]}
+		},
+		{
+			"Sid": "services",
+			"Effect": "Allow",
+			"Priority": 30,
+			"Condition": {"Role": ["arn:aws:iam::123456789012:role/*"]}
+		}
+	]
+}`
+
+func TestPolicy(t *testing.T) {
+	p, err := policy.Parse([]byte(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		caller, source string
+		want           policy.Decision
+	}{
+		// Deny statements only win by coming first
+		{"arn:aws:sts::123456789012:assumed-role/contractor-ci/payments-1", "10.1.2.3:1234", policy.Decision{Effect: policy.Deny, Statement: "no-contractors"}},
+		{"arn:aws:sts::123456789012:assumed-role/ci/payments-1", "10.1.2.3:1234", policy.Decision{Effect: policy.Allow, Statement: "payments-from-vpc"}},
+		{"arn:aws:sts::123456789012:assumed-role/ci/payments-1", "192.0.2.1:1234", policy.Decision{Effect: policy.Allow, Statement: "services"}},
+		{"arn:aws:sts::210987654321:assumed-role/ci/payments-1", "10.1.2.3:1234", policy.Decision{Effect: policy.Deny}},
+	}
+
+	for _, tt := range tests {
+		ctx := source_verifiers.WithSourceAddr(context.Background(), net.TCPAddrFromAddrPort(netip.MustParseAddrPort(tt.source)))
+
+		rule, ok, err := p.Match(ctx, &awsapi.GetCallerIdentityResult{Arn: tt.caller})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ok != (tt.want.Effect == policy.Allow) || rule != tt.want.Statement {
+			t.Errorf("expected %s from %s to be %v, got rule %q allowed %v", tt.caller, tt.source, tt.want, rule, ok)
+		}
+	}
+
+	// A statement that needs the caller's address can't be skipped without it
+	_, _, err = p.Match(context.Background(), &awsapi.GetCallerIdentityResult{Arn: "arn:aws:sts::123456789012:assumed-role/ci/payments-1"})
+	if !errors.Is(err, policy.ErrSourceAddrUnknown) {
+		t.Errorf("expected an error without the caller's address, got: %v", err)
+	}
+}
+
+func TestPolicyValidation(t *testing.T) {
+	for name, doc := range map[string]string{
+		"unknown field":      `{"Version": 1, "Statements": [{"Sid": "a", "Effect": "Allow", "Priority": 1, "Condition": {"Acount": ["123456789012"]}}]}`,
+		"no conditions":      `{"Version": 1, "Statements": [{"Sid": "a", "Effect": "Allow", "Priority": 1}]}`,
+		"empty condition":    `{"Version": 1, "Statements": [{"Sid": "a", "Effect": "Allow", "Priority": 1, "Condition": {"Account": []}}]}`,
+		"no priority":        `{"Version": 1, "Statements": [{"Sid": "a", "Effect": "Allow", "Condition": {"Account": ["123456789012"]}}]}`,
+		"duplicate priority": `{"Version": 1, "Statements": [{"Sid": "a", "Effect": "Allow", "Priority": 1, "Condition": {"Account": ["1"]}}, {"Sid": "b", "Effect": "Deny", "Priority": 1, "Condition": {"Account": ["2"]}}]}`,
+		"duplicate sid":      `{"Version": 1, "Statements": [{"Sid": "a", "Effect": "Allow", "Priority": 1, "Condition": {"Account": ["1"]}}, {"Sid": "a", "Effect": "Deny", "Priority": 2, "Condition": {"Account": ["2"]}}]}`,
+		"bad effect":         `{"Version": 1, "Statements": [{"Sid": "a", "Effect": "allow", "Priority": 1, "Condition": {"Account": ["123456789012"]}}]}`,
+		"wildcard account":   `{"Version": 1, "Statements": [{"Sid": "a", "Effect": "Allow", "Priority": 1, "Condition": {"Account": ["*"]}}]}`,
+		"bad role":           `{"Version": 1, "Statements": [{"Sid": "a", "Effect": "Allow", "Priority": 1, "Condition": {"Role": ["arn:aws:iam::*:role/a"]}}]}`,
+		"host bits":          `{"Version": 1, "Statements": [{"Sid": "a", "Effect": "Allow", "Priority": 1, "Condition": {"SourceCIDR": ["10.0.0.1/8"]}}]}`,
+		"wrong version":      `{"Version": 2, "Statements": [{"Sid": "a", "Effect": "Allow", "Priority": 1, "Condition": {"Account": ["123456789012"]}}]}`,
+		"no statements":      `{"Version": 1, "Statements": []}`,
+	} {
+		if _, err := policy.Parse([]byte(doc)); !errors.Is(err, policy.ErrInvalidPolicy) {
+			t.Errorf("expected a policy with %s to be invalid, got: %v", name, err)
+		}
+	}
+}
+
+func TestPolicyRolePaths(t *testing.T) {
+	p, err := policy.Parse([]byte(`{
+		"Version": 1,
+		"Statements": [
+			{"Sid": "no-contractors", "Effect": "Deny", "Priority": 1, "Condition": {"Role": ["arn:aws:iam::123456789012:role/contractors/*"]}},
+			{"Sid": "everyone", "Effect": "Allow", "Priority": 2, "Condition": {"Account": ["123456789012"]}}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gcir := &awsapi.GetCallerIdentityResult{Arn: "arn:aws:sts::123456789012:assumed-role/alice/session"}
+
+	// Without knowing where alice's role is, the deny can't be ruled out
+	if _, _, err := p.Match(context.Background(), gcir); !errors.Is(err, policy.ErrRolePathUnknown) {
+		t.Errorf("expected an error without the role's path, got: %v", err)
+	}
+
+	for path, want := range map[string]string{"/contractors/": "no-contractors", "/staff/": "everyone"} {
+		withPaths := p.WithRolePaths(func(context.Context, sources.Role) (string, error) { return path, nil })
+
+		rule, _, err := withPaths.Match(context.Background(), gcir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rule != want {
+			t.Errorf("expected a role under %s to be decided by %q, got %q", path, want, rule)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package source_verifiers
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/thomasdesr/roast/gcisigner/awsapi"
+	"github.com/thomasdesr/roast/gcisigner/source_verifiers/sources"
+	"github.com/thomasdesr/roast/internal/errorutil"
+)
+
+// CallerPrincipal returns the principal the caller authenticated as.
+func CallerPrincipal(gcir *awsapi.GetCallerIdentityResult) (sources.Principal, error) {
+	callerARN, err := arn.Parse(gcir.Arn)
+	if err != nil {
+		return nil, errorutil.Wrap(err, "failed to parse caller ARN")
+	}
+
+	principal, err := sources.PrincipalFromARN(callerARN)
+	if err != nil {
+		return nil, errorutil.Wrap(err, "failed to parse caller principal")
+	}
+
+	return principal, nil
+}
+
+// callerAs returns the caller as a T, if it's that type of principal.
+func callerAs[T sources.Principal](gcir *awsapi.GetCallerIdentityResult) (T, bool, error) {
+	principal, err := CallerPrincipal(gcir)
+	if err != nil {
+		var zero T
+		return zero, false, err
+	}
+
+	caller, ok := principal.(T)
+	return caller, ok, nil
+}
+
+// MatchesAnyUser is a SourceVerifier that checks if the caller is one of
+// `users`, e.g. developers running tools with their own IAM credentials.
+func MatchesAnyUser(users []sources.User) Verifier {
+	return MatchFunc(func(_ context.Context, gcir *awsapi.GetCallerIdentityResult) (string, bool, error) {
+		caller, ok, err := callerAs[sources.User](gcir)
+		if err != nil || !ok {
+			return "", false, err
+		}
+
+		i := slices.IndexFunc(users, caller.Is)
+		if i < 0 {
+			return "", false, nil
+		}
+		return users[i].ARN().String(), true, nil
+	})
+}
+
+// MatchesAnyFederatedUser is a SourceVerifier that checks if the caller is
+// one of `users`, which got their credentials from GetFederationToken.
+//
+// A federated user's name is whatever the caller of GetFederationToken asks
+// for, and its ARN doesn't say which IAM user that was, so any IAM user in the
+// account allowed sts:GetFederationToken can become any federated user. Only
+// allow them in accounts where that permission is as privileged as what
+// they're being let into.
+func MatchesAnyFederatedUser(users []sources.FederatedUser) Verifier {
+	return MatchFunc(func(_ context.Context, gcir *awsapi.GetCallerIdentityResult) (string, bool, error) {
+		caller, ok, err := callerAs[sources.FederatedUser](gcir)
+		if err != nil || !ok {
+			return "", false, err
+		}
+
+		if !slices.Contains(users, caller) {
+			return "", false, nil
+		}
+		return caller.ARN().String(), true, nil
+	})
+}
+
+// MatchesAnyRoot is a SourceVerifier that checks if the caller is the root
+// user of one of `roots`' accounts, e.g. for break-glass access.
+func MatchesAnyRoot(roots []sources.Root) Verifier {
+	return MatchFunc(func(_ context.Context, gcir *awsapi.GetCallerIdentityResult) (string, bool, error) {
+		caller, ok, err := callerAs[sources.Root](gcir)
+		if err != nil || !ok {
+			return "", false, err
+		}
+
+		if !slices.Contains(roots, caller) {
+			return "", false, nil
+		}
+		return caller.ARN().String(), true, nil
+	})
+}
+
+// MatchesAnyPrincipal is a SourceVerifier that accepts callers matching any
+// of `allowed`, each of which is either a role pattern (see
+// sources.RolePattern), an IAM user, a federated user (see
+// MatchesAnyFederatedUser for why those need care) or an account's root.
+// Wildcard role patterns can't be scoped to a path, as nothing here can
+// resolve the paths of callers' roles; use MatchesAnyPatternWithPaths for
+// those.
+func MatchesAnyPrincipal(allowed []arn.ARN) (Verifier, error) {
+	var (
+		patterns       []sources.RolePattern
+		users          []sources.User
+		federatedUsers []sources.FederatedUser
+		roots          []sources.Root
+	)
+
+	for _, a := range allowed {
+		if a.Service == "iam" && strings.HasPrefix(a.Resource, "role/") {
+			pattern, err := sources.FromARN[sources.RolePattern](a)
+			if err != nil {
+				return nil, err
+			}
+			if pattern.IsWildcard() && pattern.Path() != "/" {
+				return nil, fmt.Errorf("wildcard role %q is scoped to a path, which needs a RolePathResolver to match", a)
+			}
+
+			patterns = append(patterns, pattern)
+			continue
+		}
+
+		principal, err := sources.PrincipalFromARN(a)
+		if err != nil {
+			return nil, err
+		}
+
+		switch p := principal.(type) {
+		case sources.User:
+			users = append(users, p)
+		case sources.FederatedUser:
+			federatedUsers = append(federatedUsers, p)
+		case sources.Root:
+			roots = append(roots, p)
+		case sources.AssumedRole:
+			// A session only lasts hours, so allowing one is a mistake
+			return nil, fmt.Errorf("%q is a role session, allow its role instead", a)
+		}
+	}
+
+	return AnyOf(
+		MatchesAnyPattern(patterns),
+		MatchesAnyUser(users),
+		MatchesAnyFederatedUser(federatedUsers),
+		MatchesAnyRoot(roots),
+	), nil
+}
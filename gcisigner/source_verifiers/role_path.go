@@ -0,0 +1,44 @@
+package source_verifiers
+
+import (
+	"context"
+
+	"github.com/thomasdesr/roast/gcisigner/source_verifiers/sources"
+	"github.com/thomasdesr/roast/internal/errorutil"
+)
+
+// RolePathResolver looks up the path of a caller's role, which STS leaves out
+// of the caller's ARN (see sources.Role), e.g. with IAM's GetRole. It returns
+// an empty path if it doesn't know it.
+type RolePathResolver func(ctx context.Context, role sources.Role) (path string, err error)
+
+// KnownRolePaths is a RolePathResolver that knows the paths of `roles`, e.g.
+// ones listed with their full ARNs in config.
+func KnownRolePaths(roles ...sources.Role) RolePathResolver {
+	return func(_ context.Context, role sources.Role) (string, error) {
+		for _, known := range roles {
+			if known.Path() != "" && known.Is(role) {
+				return known.Path(), nil
+			}
+		}
+		return "", nil
+	}
+}
+
+// ResolveRolePath returns `role` with its path filled in by `resolve`, if it
+// knows it. A nil resolver knows no paths.
+func ResolveRolePath(ctx context.Context, resolve RolePathResolver, role sources.Role) (sources.Role, error) {
+	if resolve == nil || role.Path() != "" {
+		return role, nil
+	}
+
+	path, err := resolve(ctx, role)
+	if err != nil {
+		return sources.Role{}, errorutil.Wrapf(err, "failed to resolve the path of %q", role.ARN())
+	}
+	if path == "" {
+		return role, nil
+	}
+
+	return role.WithPath(path)
+}
@@ -0,0 +1,115 @@
+package source_verifiers
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/thomasdesr/roast/gcisigner/awsapi"
+	"github.com/thomasdesr/roast/gcisigner/source_verifiers/sources"
+	"github.com/thomasdesr/roast/internal/errorutil"
+)
+
+// SessionNameConstraint is a condition on the session name a caller assumed
+// its role with, which often says what it is: an EC2 instance ID, an ECS task
+// or a CI job.
+type SessionNameConstraint struct {
+	desc  string
+	match func(string) bool
+}
+
+// SessionNameEquals is met by sessions named exactly `name`.
+func SessionNameEquals(name string) SessionNameConstraint {
+	return SessionNameConstraint{
+		desc:  fmt.Sprintf("session name %q", name),
+		match: func(s string) bool { return s == name },
+	}
+}
+
+// SessionNameHasPrefix is met by sessions whose names start with `prefix`,
+// e.g. "i-" for EC2 instances.
+func SessionNameHasPrefix(prefix string) SessionNameConstraint {
+	return SessionNameConstraint{
+		desc:  fmt.Sprintf("session name prefix %q", prefix),
+		match: func(s string) bool { return strings.HasPrefix(s, prefix) },
+	}
+}
+
+// SessionNameMatchesRegexp is met by sessions whose whole name matches the
+// regular expression `expr`, without it needing to be anchored.
+func SessionNameMatchesRegexp(expr string) (SessionNameConstraint, error) {
+	re, err := regexp.Compile(`^(?:` + expr + `)$`)
+	if err != nil {
+		return SessionNameConstraint{}, errorutil.Wrapf(err, "invalid session name regexp %q", expr)
+	}
+
+	return SessionNameConstraint{
+		desc:  fmt.Sprintf("session name regexp %q", expr),
+		match: re.MatchString,
+	}, nil
+}
+
+// Matches reports whether `name` meets the constraint.
+func (c SessionNameConstraint) Matches(name string) bool {
+	return c.match != nil && c.match(name)
+}
+
+func (c SessionNameConstraint) String() string {
+	return c.desc
+}
+
+// RequireSessionName is a Verifier that accepts the callers `v` does, as long
+// as they're assumed roles whose session names also meet any of
+// `constraints`. The rule it reports
+// is `v`'s, followed by the constraint that was met.
+func RequireSessionName(v Verifier, constraints ...SessionNameConstraint) Verifier {
+	return MatchFunc(func(ctx context.Context, gcir *awsapi.GetCallerIdentityResult) (string, bool, error) {
+		caller, ok, err := callerAs[sources.AssumedRole](gcir)
+		if err != nil || !ok {
+			return "", false, err
+		}
+
+		var met *SessionNameConstraint
+		for i := range constraints {
+			if constraints[i].Matches(caller.SessionName()) {
+				met = &constraints[i]
+				break
+			}
+		}
+		if met == nil {
+			return "", false, nil
+		}
+
+		rule, ok, err := Match(ctx, v, gcir)
+		if err != nil || !ok {
+			return rule, ok, err
+		}
+
+		return joinRules(rule, met.String()), true, nil
+	})
+}
+
+// AnyOf is a Verifier that accepts the callers any of `vs` do. The rule it
+// reports is the first of theirs that accepted the caller.
+func AnyOf(vs ...Verifier) Verifier {
+	return MatchFunc(func(ctx context.Context, gcir *awsapi.GetCallerIdentityResult) (string, bool, error) {
+		for _, v := range vs {
+			rule, ok, err := Match(ctx, v, gcir)
+			if err != nil {
+				return "", false, err
+			}
+			if ok {
+				return rule, true, nil
+			}
+		}
+		return "", false, nil
+	})
+}
+
+func joinRules(rule, constraint string) string {
+	if rule == "" {
+		return constraint
+	}
+	return rule + " with " + constraint
+}
@@ -1,6 +1,7 @@
 package source_verifiers
 
 import (
+	"context"
 	"slices"
 
 	"github.com/aws/aws-sdk-go-v2/aws/arn"
@@ -24,28 +25,138 @@ func (v VerifyFunc) Verify(gcir *awsapi.GetCallerIdentityResult) (bool, error) {
 	return v(gcir)
 }
 
-// MatchesIAMRoles is a SourceVerifier that checks if the caller's ARN is in
-// the list of allowed peer roles. The passed in set of Roles should be aws IAM
-// role ARNs
+// Matcher is a Verifier that can also say which of its rules decided whether
+// to accept a caller, for audit logs, and can use what else is known about
+// the caller from the context it is verified in (see WithSourceAddr).
+type Matcher interface {
+	Verifier
+
+	// Match is Verify, also returning a description of the rule that
+	// accepted, or rejected, the caller.
+	Match(context.Context, *awsapi.GetCallerIdentityResult) (rule string, ok bool, err error)
+}
+
+// Match runs `v` against `gcir`, returning the rule that decided if `v` is a
+// Matcher.
+func Match(ctx context.Context, v Verifier, gcir *awsapi.GetCallerIdentityResult) (rule string, ok bool, err error) {
+	if m, isMatcher := v.(Matcher); isMatcher {
+		return m.Match(ctx, gcir)
+	}
+
+	ok, err = v.Verify(gcir)
+	return "", ok, err
+}
+
+// MatchFunc is a Matcher made from a function.
+type MatchFunc func(context.Context, *awsapi.GetCallerIdentityResult) (rule string, ok bool, err error)
+
+var _ Matcher = MatchFunc(nil)
+
+func (m MatchFunc) Verify(gcir *awsapi.GetCallerIdentityResult) (bool, error) {
+	_, ok, err := m(context.Background(), gcir)
+	return ok, err
+}
+
+func (m MatchFunc) Match(ctx context.Context, gcir *awsapi.GetCallerIdentityResult) (string, bool, error) {
+	return m(ctx, gcir)
+}
+
+// MatchesAny is a SourceVerifier that checks if the caller is a session of
+// one of the allowed peer roles. The passed in set of Roles should be aws IAM
+// role ARNs.
+//
+// Callers that aren't assumed roles, such as IAM users or federated users, are
+// rejected rather than failing verification with an error as they used to. Use
+// MatchesAnyPrincipal to allow them.
 func MatchesAny(allowedRoles []sources.Role) Verifier {
-	return VerifyFunc(func(gcir *awsapi.GetCallerIdentityResult) (bool, error) {
-		// Parse the caller's ARN string into an arn.ARN
-		callerARN, err := arn.Parse(gcir.Arn)
-		if err != nil {
-			return false, errorutil.Wrap(err, "failed to parse caller ARN")
+	return MatchFunc(func(_ context.Context, gcir *awsapi.GetCallerIdentityResult) (string, bool, error) {
+		parentRole, ok, err := callerRole(gcir)
+		if err != nil || !ok {
+			return "", false, err
 		}
 
-		assumedRole, err := sources.FromARN[sources.AssumedRole](callerARN)
-		if err != nil {
-			return false, errorutil.Wrap(err, "caller isn't an AssumedRole")
+		i := slices.IndexFunc(allowedRoles, parentRole.Is)
+		if i < 0 {
+			return "", false, nil
 		}
+		return allowedRoles[i].ARN().String(), true, nil
+	})
+}
+
+// MatchesAnyPattern is a SourceVerifier that checks if the caller's role
+// matches any of `patterns`, see sources.RolePattern. The rule it reports is
+// the first pattern that matched.
+func MatchesAnyPattern(patterns []sources.RolePattern) Verifier {
+	return MatchesAnyPatternWithPaths(patterns, nil)
+}
 
-		// Get the parent role from the assumed role
-		parentRole, err := assumedRole.SessionIssuer()
-		if err != nil {
-			return false, errorutil.Wrap(err, "failed to get parent role from assumed role")
+// MatchesAnyPatternWithPaths is MatchesAnyPattern, using `resolve` to find
+// the path of the caller's role so that wildcard patterns with paths can
+// match it.
+func MatchesAnyPatternWithPaths(patterns []sources.RolePattern, resolve RolePathResolver) Verifier {
+	return MatchFunc(func(ctx context.Context, gcir *awsapi.GetCallerIdentityResult) (string, bool, error) {
+		parentRole, ok, err := callerRole(gcir)
+		if err != nil || !ok {
+			return "", false, err
 		}
 
-		return slices.Contains(allowedRoles, parentRole), nil
+		if parentRole, err = ResolveRolePath(ctx, resolve, parentRole); err != nil {
+			return "", false, err
+		}
+
+		for _, pattern := range patterns {
+			if pattern.Matches(parentRole) {
+				return pattern.String(), true, nil
+			}
+		}
+		return "", false, nil
 	})
 }
+
+// callerRole returns the IAM role the caller assumed, if it's an assumed
+// role.
+func callerRole(gcir *awsapi.GetCallerIdentityResult) (sources.Role, bool, error) {
+	assumedRole, ok, err := callerAs[sources.AssumedRole](gcir)
+	if err != nil || !ok {
+		return sources.Role{}, false, err
+	}
+
+	parentRole, err := assumedRole.SessionIssuer()
+	if err != nil {
+		return sources.Role{}, false, errorutil.Wrap(err, "failed to get parent role from assumed role")
+	}
+
+	return parentRole, true, nil
+}
+
+// CallerRole returns the IAM role the caller assumed.
+func CallerRole(gcir *awsapi.GetCallerIdentityResult) (sources.Role, error) {
+	assumedRole, err := CallerAssumedRole(gcir)
+	if err != nil {
+		return sources.Role{}, err
+	}
+
+	// Get the parent role from the assumed role
+	parentRole, err := assumedRole.SessionIssuer()
+	if err != nil {
+		return sources.Role{}, errorutil.Wrap(err, "failed to get parent role from assumed role")
+	}
+
+	return parentRole, nil
+}
+
+// CallerAssumedRole returns the caller as the STS assumed role it must be.
+func CallerAssumedRole(gcir *awsapi.GetCallerIdentityResult) (sources.AssumedRole, error) {
+	// Parse the caller's ARN string into an arn.ARN
+	callerARN, err := arn.Parse(gcir.Arn)
+	if err != nil {
+		return sources.AssumedRole{}, errorutil.Wrap(err, "failed to parse caller ARN")
+	}
+
+	assumedRole, err := sources.FromARN[sources.AssumedRole](callerARN)
+	if err != nil {
+		return sources.AssumedRole{}, errorutil.Wrap(err, "caller isn't an AssumedRole")
+	}
+
+	return assumedRole, nil
+}
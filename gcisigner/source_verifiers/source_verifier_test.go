@@ -0,0 +1,353 @@
+package source_verifiers_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/thomasdesr/roast/gcisigner/awsapi"
+	"github.com/thomasdesr/roast/gcisigner/source_verifiers"
+	"github.com/thomasdesr/roast/gcisigner/source_verifiers/sources"
+)
+
+func TestMatchesAny(t *testing.T) {
+	role, err := sources.FromARN[sources.Role](mustParse(t, "arn:aws:iam::123456789012:role/payments-api"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := source_verifiers.MatchesAny([]sources.Role{role})
+
+	for caller, want := range map[string]bool{
+		"arn:aws:sts::123456789012:assumed-role/payments-api/s":    true,
+		"arn:aws:sts::123456789012:assumed-role/payments-api-v2/s": false,
+		"arn:aws:iam::123456789012:user/payments-api":              false,
+		"arn:aws:sts::123456789012:federated-user/payments-api":    false,
+		"arn:aws:iam::123456789012:root":                           false,
+	} {
+		ok, err := v.Verify(&awsapi.GetCallerIdentityResult{Arn: caller})
+		if err != nil || ok != want {
+			t.Errorf("expected %s to match %v, got %v (err=%v)", caller, want, ok, err)
+		}
+	}
+}
+
+func TestMatchesAnyPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		caller  string
+		want    bool
+	}{
+		{"arn:aws:iam::123456789012:role/payments-api", "arn:aws:sts::123456789012:assumed-role/payments-api/s", true},
+		{"arn:aws:iam::123456789012:role/payments-api", "arn:aws:sts::123456789012:assumed-role/payments-api-v2/s", false},
+		{"arn:aws:iam::123456789012:role/payments-*", "arn:aws:sts::123456789012:assumed-role/payments-api/s", true},
+		{"arn:aws:iam::123456789012:role/payments-*", "arn:aws:sts::123456789012:assumed-role/billing-api/s", false},
+		{"arn:aws:iam::123456789012:role/*-api", "arn:aws:sts::123456789012:assumed-role/billing-api/s", true},
+		{"arn:aws:iam::123456789012:role/*", "arn:aws:sts::123456789012:assumed-role/anything/s", true},
+		{"arn:aws:iam::123456789012:role/*", "arn:aws:sts::210987654321:assumed-role/anything/s", false},
+		{"arn:aws:iam::123456789012:role/*", "arn:aws-cn:sts::123456789012:assumed-role/anything/s", false},
+		{"arn:aws-us-gov:iam::123456789012:role/*", "arn:aws-us-gov:sts::123456789012:assumed-role/anything/s", true},
+	}
+
+	for _, tt := range tests {
+		pattern, err := sources.FromARN[sources.RolePattern](mustParse(t, tt.pattern))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rule, ok, err := source_verifiers.Match(
+			context.Background(),
+			source_verifiers.MatchesAnyPattern([]sources.RolePattern{pattern}),
+			&awsapi.GetCallerIdentityResult{Arn: tt.caller},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ok != tt.want {
+			t.Errorf("expected %s matching %s to be %v", tt.pattern, tt.caller, tt.want)
+		}
+		if ok && rule != tt.pattern {
+			t.Errorf("expected the matched rule to be %s, got %q", tt.pattern, rule)
+		}
+	}
+}
+
+func TestRolePatternValidation(t *testing.T) {
+	for _, bad := range []string{
+		"arn:*:iam::123456789012:role/payments",
+		"arn:aws:iam::*:role/payments",
+		"arn:aws:iam::12345678901*:role/payments",
+		"arn:aws:iam:us-west-2:123456789012:role/payments",
+		"arn:aws:sts::123456789012:role/payments",
+		"arn:aws:iam::123456789012:user/payments",
+		"arn:aws:iam::123456789012:role/**",
+		"arn:aws:iam::123456789012:role/payments-**",
+		"arn:aws:iam::123456789012:role/payments-?",
+		"arn:aws:iam::123456789012:role/",
+	} {
+		_, err := sources.FromARN[sources.RolePattern](mustParse(t, bad))
+		if !errors.Is(err, sources.ErrInvalidRolePattern) {
+			t.Errorf("expected %s to be rejected, got: %v", bad, err)
+		}
+	}
+}
+
+func mustParse(t *testing.T, s string) arn.ARN {
+	t.Helper()
+
+	a, err := arn.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestRequireSessionName(t *testing.T) {
+	pattern, err := sources.FromARN[sources.RolePattern](mustParse(t, "arn:aws:iam::123456789012:role/workers"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciJob, err := source_verifiers.SessionNameMatchesRegexp(`ci-[0-9]+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := source_verifiers.RequireSessionName(
+		source_verifiers.MatchesAnyPattern([]sources.RolePattern{pattern}),
+		source_verifiers.SessionNameHasPrefix("i-"),
+		source_verifiers.SessionNameEquals("deployer"),
+		ciJob,
+	)
+
+	tests := []struct {
+		caller   string
+		wantRule string
+	}{
+		{"arn:aws:sts::123456789012:assumed-role/workers/i-0123456789abcdef0", `arn:aws:iam::123456789012:role/workers with session name prefix "i-"`},
+		{"arn:aws:sts::123456789012:assumed-role/workers/deployer", `arn:aws:iam::123456789012:role/workers with session name "deployer"`},
+		{"arn:aws:sts::123456789012:assumed-role/workers/ci-42", `arn:aws:iam::123456789012:role/workers with session name regexp "ci-[0-9]+"`},
+		{"arn:aws:sts::123456789012:assumed-role/workers/deployer2", ""},
+		{"arn:aws:sts::123456789012:assumed-role/workers/xci-42", ""},
+		{"arn:aws:sts::123456789012:assumed-role/others/i-0123456789abcdef0", ""},
+	}
+
+	for _, tt := range tests {
+		rule, ok, err := source_verifiers.Match(context.Background(), v, &awsapi.GetCallerIdentityResult{Arn: tt.caller})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ok != (tt.wantRule != "") || rule != tt.wantRule {
+			t.Errorf("expected %s to be matched by %q, got %q (ok=%v)", tt.caller, tt.wantRule, rule, ok)
+		}
+	}
+
+	if _, err := source_verifiers.SessionNameMatchesRegexp(`ci-(`); err == nil {
+		t.Error("expected an invalid regexp to be rejected")
+	}
+}
+
+func TestRolePaths(t *testing.T) {
+	role, err := sources.FromARN[sources.Role](mustParse(t, "arn:aws:iam::123456789012:role/service/app/MyRole"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if role.Path() != "/service/app/" || role.RoleName() != "MyRole" {
+		t.Errorf("expected path /service/app/ and name MyRole, got %q and %q", role.Path(), role.RoleName())
+	}
+
+	for _, bad := range []string{
+		"arn:aws:iam::123456789012:role/service//MyRole",
+		"arn:aws:iam::123456789012:role/service/MyRole/",
+	} {
+		if _, err := sources.FromARN[sources.Role](mustParse(t, bad)); !errors.Is(err, sources.ErrInvalidRoleARN) {
+			t.Errorf("expected %s to be rejected, got: %v", bad, err)
+		}
+	}
+
+	const caller = "arn:aws:sts::123456789012:assumed-role/MyRole/session"
+	gcir := &awsapi.GetCallerIdentityResult{Arn: caller}
+
+	callerRole, err := source_verifiers.CallerRole(gcir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if callerRole.Path() != "" || !role.Is(callerRole) {
+		t.Errorf("expected the caller's role to have an unknown path and be %s", role.ARN())
+	}
+
+	tests := []struct {
+		pattern       string
+		resolve       source_verifiers.RolePathResolver
+		wantUnknown   bool
+		wantWithPaths bool
+	}{
+		// Patterns that name the role match it wherever it is
+		{pattern: "arn:aws:iam::123456789012:role/service/app/MyRole", wantUnknown: true, wantWithPaths: true},
+		{pattern: "arn:aws:iam::123456789012:role/MyRole", wantUnknown: true, wantWithPaths: true},
+		// Wildcards scoped to a path need to know where the role is
+		{pattern: "arn:aws:iam::123456789012:role/service/*", wantUnknown: false, wantWithPaths: true},
+		{pattern: "arn:aws:iam::123456789012:role/service/app/My*", wantUnknown: false, wantWithPaths: true},
+		{pattern: "arn:aws:iam::123456789012:role/other/*", wantUnknown: false, wantWithPaths: false},
+		{pattern: "arn:aws:iam::123456789012:role/service/application/*", wantUnknown: false, wantWithPaths: false},
+		{pattern: "arn:aws:iam::123456789012:role/*", wantUnknown: true, wantWithPaths: true},
+	}
+
+	for _, tt := range tests {
+		pattern, err := sources.FromARN[sources.RolePattern](mustParse(t, tt.pattern))
+		if err != nil {
+			t.Fatal(err)
+		}
+		patterns := []sources.RolePattern{pattern}
+
+		for _, v := range []struct {
+			verifier source_verifiers.Verifier
+			want     bool
+		}{
+			{source_verifiers.MatchesAnyPattern(patterns), tt.wantUnknown},
+			{source_verifiers.MatchesAnyPatternWithPaths(patterns, source_verifiers.KnownRolePaths(role)), tt.wantWithPaths},
+		} {
+			ok, err := v.verifier.Verify(gcir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != v.want {
+				t.Errorf("expected %s matching %s to be %v", tt.pattern, caller, v.want)
+			}
+		}
+	}
+
+	if _, err := sources.FromARN[sources.RolePattern](mustParse(t, "arn:aws:iam::123456789012:role/serv*/MyRole")); !errors.Is(err, sources.ErrInvalidRolePattern) {
+		t.Errorf("expected a wildcarded path to be rejected, got: %v", err)
+	}
+}
+
+func TestMatchesAnyPrincipal(t *testing.T) {
+	v, err := source_verifiers.MatchesAnyPrincipal([]arn.ARN{
+		mustParse(t, "arn:aws:iam::123456789012:role/workers-*"),
+		mustParse(t, "arn:aws:iam::123456789012:user/admins/alice"),
+		mustParse(t, "arn:aws:sts::123456789012:federated-user/bob"),
+		mustParse(t, "arn:aws:iam::210987654321:root"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		caller   string
+		wantType sources.PrincipalType
+		wantRule string
+	}{
+		{"arn:aws:sts::123456789012:assumed-role/workers-a/i-0123", sources.PrincipalAssumedRole, "arn:aws:iam::123456789012:role/workers-*"},
+		{"arn:aws:iam::123456789012:user/admins/alice", sources.PrincipalUser, "arn:aws:iam::123456789012:user/admins/alice"},
+		{"arn:aws:iam::123456789012:user/alice", sources.PrincipalUser, "arn:aws:iam::123456789012:user/admins/alice"},
+		{"arn:aws:iam::123456789012:user/admins/mallory", sources.PrincipalUser, ""},
+		{"arn:aws:sts::123456789012:federated-user/bob", sources.PrincipalFederatedUser, "arn:aws:sts::123456789012:federated-user/bob"},
+		{"arn:aws:sts::123456789012:federated-user/carol", sources.PrincipalFederatedUser, ""},
+		{"arn:aws:iam::210987654321:root", sources.PrincipalRoot, "arn:aws:iam::210987654321:root"},
+		{"arn:aws:iam::123456789012:root", sources.PrincipalRoot, ""},
+	}
+
+	for _, tt := range tests {
+		gcir := &awsapi.GetCallerIdentityResult{Arn: tt.caller}
+
+		principal, err := source_verifiers.CallerPrincipal(gcir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if principal.Type() != tt.wantType {
+			t.Errorf("expected %s to be a %q, got %q", tt.caller, tt.wantType, principal.Type())
+		}
+
+		rule, ok, err := source_verifiers.Match(context.Background(), v, gcir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != (tt.wantRule != "") || rule != tt.wantRule {
+			t.Errorf("expected %s to be matched by %q, got %q (ok=%v)", tt.caller, tt.wantRule, rule, ok)
+		}
+	}
+
+	for _, bad := range []string{
+		"arn:aws:sts::123456789012:assumed-role/workers/i-0123",
+		"arn:aws:iam::123456789012:group/admins",
+		"arn:aws:iam::123456789012:role/service/*",
+		"arn:aws:iam::abc:root",
+	} {
+		if _, err := source_verifiers.MatchesAnyPrincipal([]arn.ARN{mustParse(t, bad)}); err == nil {
+			t.Errorf("expected %s to be rejected", bad)
+		}
+	}
+}
+
+func TestMatchesAnyPermissionSet(t *testing.T) {
+	admin, err := sources.NewPermissionSet("aws", "123456789012", "Admin_Access")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the first role is really one IAM Identity Center provisioned, the
+	// look-alike is the same name someone created at the root path
+	real, err := sources.FromARN[sources.Role](mustParse(t, "arn:aws:iam::123456789012:role/aws-reserved/sso.amazonaws.com/us-west-2/AWSReservedSSO_Admin_Access_0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookAlike, err := sources.FromARN[sources.Role](mustParse(t, "arn:aws:iam::123456789012:role/AWSReservedSSO_Admin_Access_1111111111111111"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := source_verifiers.MatchesAnyPermissionSet([]sources.PermissionSet{admin}, source_verifiers.KnownRolePaths(real, lookAlike))
+
+	tests := []struct {
+		caller   string
+		wantUser string
+		wantRule string
+	}{
+		{"arn:aws:sts::123456789012:assumed-role/AWSReservedSSO_Admin_Access_0123456789abcdef/jane@example.com", "jane@example.com", admin.String()},
+		{"arn:aws:sts::123456789012:assumed-role/AWSReservedSSO_Admin_Access_1111111111111111/jane@example.com", "jane@example.com", ""},
+		{"arn:aws:sts::123456789012:assumed-role/AWSReservedSSO_Admin_Access_2222222222222222/jane@example.com", "jane@example.com", ""},
+		{"arn:aws:sts::123456789012:assumed-role/AWSReservedSSO_ReadOnly_0123456789abcdef/jane@example.com", "jane@example.com", ""},
+		{"arn:aws:sts::210987654321:assumed-role/AWSReservedSSO_Admin_Access_fedcba9876543210/jane@example.com", "jane@example.com", ""},
+		{"arn:aws:sts::123456789012:assumed-role/AWSReservedSSO_Admin_Access/jane@example.com", "", ""},
+		{"arn:aws:sts::123456789012:assumed-role/Admin_Access/jane@example.com", "", ""},
+		{"arn:aws:iam::123456789012:user/jane", "", ""},
+	}
+
+	for _, tt := range tests {
+		gcir := &awsapi.GetCallerIdentityResult{Arn: tt.caller}
+
+		session, ok, err := source_verifiers.CallerSSOSession(gcir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != (tt.wantUser != "") || session.UserName() != tt.wantUser {
+			t.Errorf("expected %s to be SSO user %q, got %q (ok=%v)", tt.caller, tt.wantUser, session.UserName(), ok)
+		}
+
+		rule, ok, err := source_verifiers.Match(context.Background(), v, gcir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != (tt.wantRule != "") || rule != tt.wantRule {
+			t.Errorf("expected %s to be matched by %q, got %q (ok=%v)", tt.caller, tt.wantRule, rule, ok)
+		}
+	}
+
+	// Without a resolver no role's path is known, so nobody is let in
+	gcir := &awsapi.GetCallerIdentityResult{Arn: tests[0].caller}
+	if _, ok, err := source_verifiers.Match(context.Background(), source_verifiers.MatchesAnyPermissionSet([]sources.PermissionSet{admin}, nil), gcir); ok || err != nil {
+		t.Errorf("expected %s to be denied without a resolver, got ok=%v err=%v", tests[0].caller, ok, err)
+	}
+
+	for _, bad := range [][3]string{
+		{"aws-mars", "123456789012", "Admin"},
+		{"aws", "12345678901*", "Admin"},
+		{"aws", "123456789012", "Admin Access"},
+		{"aws", "123456789012", "ThisPermissionSetNameIsFarTooLong"},
+	} {
+		if _, err := sources.NewPermissionSet(bad[0], bad[1], bad[2]); !errors.Is(err, sources.ErrInvalidPermissionSet) {
+			t.Errorf("expected %q to be rejected with %v, got %v", bad, sources.ErrInvalidPermissionSet, err)
+		}
+	}
+}
@@ -18,14 +18,32 @@ var (
 
 	// ErrInvalidAssumedRoleARN indicates the provided ARN is not a valid STS assumed role ARN
 	ErrInvalidAssumedRoleARN = errors.New("invalid STS assumed role ARN")
+
+	// ErrInvalidRolePattern indicates the provided ARN is not a valid IAM role pattern
+	ErrInvalidRolePattern = errors.New("invalid IAM role pattern")
+
+	// ErrInvalidUserARN indicates the provided ARN is not a valid IAM user ARN
+	ErrInvalidUserARN = errors.New("invalid IAM user ARN")
+
+	// ErrInvalidFederatedUserARN indicates the provided ARN is not a valid STS federated user ARN
+	ErrInvalidFederatedUserARN = errors.New("invalid STS federated user ARN")
+
+	// ErrInvalidRootARN indicates the provided ARN is not a valid account root ARN
+	ErrInvalidRootARN = errors.New("invalid account root ARN")
+
+	// ErrInvalidPrincipalARN indicates the provided ARN is not any kind of principal we know
+	ErrInvalidPrincipalARN = errors.New("invalid principal ARN")
+
+	// ErrInvalidPermissionSet indicates the provided IAM Identity Center permission set is not valid
+	ErrInvalidPermissionSet = errors.New("invalid IAM Identity Center permission set")
 )
 
 // validNamePattern adheres to AWS IAM naming rules
 var validNamePattern = regexp.MustCompile(`^[\w+=,.@-]+$`)
 
-// FromARN converts an arn.ARN into either a Role or AssumedRole
-// Returns an error if the ARN is invalid
-func FromARN[T Role | AssumedRole](arn arn.ARN) (T, error) {
+// FromARN converts an arn.ARN into a Role, AssumedRole, RolePattern, User,
+// FederatedUser or Root. Returns an error if the ARN is invalid
+func FromARN[T Role | AssumedRole | RolePattern | User | FederatedUser | Root](arn arn.ARN) (T, error) {
 	var result T
 
 	// Create the appropriate type based on the generic type parameter
@@ -42,6 +60,30 @@ func FromARN[T Role | AssumedRole](arn arn.ARN) (T, error) {
 			return result, errorutil.Wrapf(err, "failed to parse %q as assumed role ARN", arn)
 		}
 		return any(assumedRole).(T), nil
+	case RolePattern:
+		pattern, err := rolePatternFromARN(arn)
+		if err != nil {
+			return result, errorutil.Wrapf(err, "failed to parse %q as role pattern", arn)
+		}
+		return any(pattern).(T), nil
+	case User:
+		user, err := userFromARN(arn)
+		if err != nil {
+			return result, errorutil.Wrapf(err, "failed to parse %q as user ARN", arn)
+		}
+		return any(user).(T), nil
+	case FederatedUser:
+		federatedUser, err := federatedUserFromARN(arn)
+		if err != nil {
+			return result, errorutil.Wrapf(err, "failed to parse %q as federated user ARN", arn)
+		}
+		return any(federatedUser).(T), nil
+	case Root:
+		root, err := rootFromARN(arn)
+		if err != nil {
+			return result, errorutil.Wrapf(err, "failed to parse %q as root ARN", arn)
+		}
+		return any(root).(T), nil
 	default:
 		panic(fmt.Sprintf("unsupported type %T", result))
 	}
@@ -72,7 +72,8 @@ func (a AssumedRole) SessionName() string {
 	return parts[2]
 }
 
-// SessionIssuer returns the IAM role that minted the assumed role
+// SessionIssuer returns the IAM role that minted the assumed role. Its path
+// isn't known, see Role.
 func (a AssumedRole) SessionIssuer() (Role, error) {
 	roleName := a.RoleName()
 	if roleName == "" {
@@ -92,6 +93,7 @@ func (a AssumedRole) SessionIssuer() (Role, error) {
 	if err != nil {
 		return Role{}, errorutil.Wrapf(err, "failed to create parent role")
 	}
+	parent.pathUnknown = true
 
 	return parent, nil
 }
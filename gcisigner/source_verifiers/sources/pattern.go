@@ -0,0 +1,132 @@
+package sources
+
+import (
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/thomasdesr/roast/internal/errorutil"
+)
+
+// Partitions are the AWS partitions a RolePattern can name.
+var Partitions = []string{"aws", "aws-cn", "aws-us-gov", "aws-iso", "aws-iso-b"}
+
+// validAccountPattern is what an AWS account ID looks like, and rules out any
+// attempt at wildcarding one.
+var validAccountPattern = regexp.MustCompile(`^[0-9]+$`)
+
+// validNameGlobPattern is validNamePattern with `*` wildcards.
+var validNameGlobPattern = regexp.MustCompile(`^[\w+=,.@*-]+$`)
+
+// RolePattern matches IAM roles by ARN, where the role name may use `*` to
+// match any run of characters, e.g. arn:aws:iam::123456789012:role/payments-*.
+// A name of just `*` matches every role in the account.
+//
+// A pattern's path scopes it to roles at that path or below, so
+// arn:aws:iam::123456789012:role/service/* matches any role under /service/,
+// including /service/app/. Paths can't be wildcarded. As STS doesn't say what
+// path a caller's role has (see Role), a wildcard pattern with a path only
+// matches roles whose path is known. A pattern without wildcards names one
+// role, and role names are unique within an account, so it matches that role
+// whether its path is known or not.
+//
+// Patterns never match across partitions or accounts, so those must always be
+// spelled out in full. A role ARN with no wildcards is a pattern that matches
+// only that role.
+type RolePattern struct {
+	arn arn.ARN
+
+	path, name string
+}
+
+// rolePatternFromARN parses an ARN into a RolePattern
+func rolePatternFromARN(a arn.ARN) (RolePattern, error) {
+	if a.Service != "iam" {
+		return RolePattern{}, errorutil.Wrapf(ErrInvalidRolePattern, "service must be 'iam', got %q", a.Service)
+	}
+
+	if !slices.Contains(Partitions, a.Partition) {
+		return RolePattern{}, errorutil.Wrapf(ErrInvalidRolePattern, "partition must be one of %q, got %q", Partitions, a.Partition)
+	}
+
+	if a.Region != "" {
+		return RolePattern{}, errorutil.Wrapf(ErrInvalidRolePattern, "IAM roles have no region, got %q", a.Region)
+	}
+
+	if !validAccountPattern.MatchString(a.AccountID) {
+		return RolePattern{}, errorutil.Wrapf(ErrInvalidRolePattern, "account must be an account ID, got %q", a.AccountID)
+	}
+
+	resource, ok := strings.CutPrefix(a.Resource, "role/")
+	if !ok {
+		return RolePattern{}, errorutil.Wrapf(ErrInvalidRolePattern, "resource must start with 'role/', got %q", a.Resource)
+	}
+
+	path, name := splitPath(resource)
+	if err := validatePath(path); err != nil {
+		return RolePattern{}, errorutil.Wrap(ErrInvalidRolePattern, err.Error())
+	}
+	if strings.Contains(path, "*") {
+		return RolePattern{}, errorutil.Wrapf(ErrInvalidRolePattern, "only the role name can be wildcarded, got path %q", path)
+	}
+
+	if !validNameGlobPattern.MatchString(name) {
+		return RolePattern{}, errorutil.Wrapf(ErrInvalidRolePattern, "role name must match pattern %q, got %q",
+			validNameGlobPattern.String(), name)
+	}
+
+	// A run of wildcards matches no more than one does, so is most likely a
+	// mistake for something narrower (or a path glob, which this isn't).
+	if strings.Contains(name, "**") {
+		return RolePattern{}, errorutil.Wrapf(ErrInvalidRolePattern, "role name must not contain consecutive wildcards, got %q", name)
+	}
+
+	return RolePattern{arn: a, path: path, name: name}, nil
+}
+
+// ARN returns the ARN the pattern was parsed from.
+func (p RolePattern) ARN() arn.ARN {
+	return p.arn
+}
+
+// String returns the pattern as it was written.
+func (p RolePattern) String() string {
+	return p.arn.String()
+}
+
+// IsWildcard reports whether the pattern can match more than one role.
+func (p RolePattern) IsWildcard() bool {
+	return strings.Contains(p.name, "*")
+}
+
+// Path returns the path the pattern is scoped to, which is "/" for patterns
+// that match roles under any path.
+func (p RolePattern) Path() string {
+	return p.path
+}
+
+// Matches reports whether `r` is one of the roles the pattern matches.
+func (p RolePattern) Matches(r Role) bool {
+	if r.arn.Partition != p.arn.Partition || r.arn.AccountID != p.arn.AccountID || r.arn.Region != p.arn.Region {
+		return false
+	}
+
+	// Role names can't contain any of path.Match's other special characters,
+	// nor can our patterns, so this is just matching `*`s.
+	if ok, _ := path.Match(p.name, r.RoleName()); !ok {
+		return false
+	}
+
+	switch {
+	case p.path == "/":
+		return true
+	case r.Path() != "":
+		return strings.HasPrefix(r.Path(), p.path)
+	default:
+		// We can't tell where the role is, but if the pattern names it there's
+		// only one role it can be
+		return !p.IsWildcard()
+	}
+}
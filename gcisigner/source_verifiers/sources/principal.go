@@ -0,0 +1,168 @@
+package sources
+
+import (
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/thomasdesr/roast/internal/errorutil"
+)
+
+// PrincipalType is the kind of AWS principal a caller authenticated as.
+type PrincipalType string
+
+const (
+	// PrincipalAssumedRole is a session of an IAM role, see AssumedRole
+	PrincipalAssumedRole PrincipalType = "assumed-role"
+	// PrincipalUser is an IAM user, see User
+	PrincipalUser PrincipalType = "user"
+	// PrincipalFederatedUser is a GetFederationToken session, see
+	// FederatedUser
+	PrincipalFederatedUser PrincipalType = "federated-user"
+	// PrincipalRoot is an account's root user, see Root
+	PrincipalRoot PrincipalType = "root"
+)
+
+// Principal is any of the principals GetCallerIdentity can say a caller is.
+type Principal interface {
+	ARN() arn.ARN
+	Type() PrincipalType
+}
+
+// PrincipalFromARN parses a caller's ARN into whichever Principal it is.
+func PrincipalFromARN(a arn.ARN) (Principal, error) {
+	switch {
+	case a.Service == "sts" && strings.HasPrefix(a.Resource, "assumed-role/"):
+		return FromARN[AssumedRole](a)
+	case a.Service == "sts" && strings.HasPrefix(a.Resource, "federated-user/"):
+		return FromARN[FederatedUser](a)
+	case a.Service == "iam" && strings.HasPrefix(a.Resource, "user/"):
+		return FromARN[User](a)
+	case a.Service == "iam" && a.Resource == "root":
+		return FromARN[Root](a)
+	default:
+		return nil, errorutil.Wrapf(ErrInvalidPrincipalARN, "%q isn't an assumed role, user, federated user or root", a)
+	}
+}
+
+func (a AssumedRole) Type() PrincipalType { return PrincipalAssumedRole }
+
+// User represents an IAM user ARN, which unlike an assumed role's includes
+// the user's path
+type User struct {
+	arn arn.ARN
+}
+
+// userFromARN parses an ARN into a User
+func userFromARN(a arn.ARN) (User, error) {
+	if a.Service != "iam" {
+		return User{}, errorutil.Wrapf(ErrInvalidUserARN, "service must be 'iam', got %q", a.Service)
+	}
+
+	resource, ok := strings.CutPrefix(a.Resource, "user/")
+	if !ok {
+		return User{}, errorutil.Wrapf(ErrInvalidUserARN, "resource must start with 'user/', got %q", a.Resource)
+	}
+
+	path, name := splitPath(resource)
+	if err := validatePath(path); err != nil {
+		return User{}, errorutil.Wrap(ErrInvalidUserARN, err.Error())
+	}
+
+	if !validNamePattern.MatchString(name) {
+		return User{}, errorutil.Wrapf(ErrInvalidUserARN, "user name must match pattern %q, got %q",
+			validNamePattern.String(), name)
+	}
+
+	return User{arn: a}, nil
+}
+
+// ARN returns the ARN of the user
+func (u User) ARN() arn.ARN {
+	return u.arn
+}
+
+func (u User) Type() PrincipalType { return PrincipalUser }
+
+// UserName returns the name of the user without the path
+func (u User) UserName() string {
+	_, name := splitPath(strings.TrimPrefix(u.arn.Resource, "user/"))
+	return name
+}
+
+// Path returns the user's path, which is "/" for users created without one
+func (u User) Path() string {
+	path, _ := splitPath(strings.TrimPrefix(u.arn.Resource, "user/"))
+	return path
+}
+
+// Is reports whether `u` and `other` are the same user. User names are
+// unique within an account, whatever their path.
+func (u User) Is(other User) bool {
+	return u.arn.Partition == other.arn.Partition && u.arn.AccountID == other.arn.AccountID && u.UserName() == other.UserName()
+}
+
+// FederatedUser represents an STS federated user ARN, as returned for
+// sessions from GetFederationToken
+type FederatedUser struct {
+	arn arn.ARN
+}
+
+// federatedUserFromARN parses an ARN into a FederatedUser
+func federatedUserFromARN(a arn.ARN) (FederatedUser, error) {
+	if a.Service != "sts" {
+		return FederatedUser{}, errorutil.Wrapf(ErrInvalidFederatedUserARN, "service must be 'sts', got %q", a.Service)
+	}
+
+	name, ok := strings.CutPrefix(a.Resource, "federated-user/")
+	if !ok {
+		return FederatedUser{}, errorutil.Wrapf(ErrInvalidFederatedUserARN, "resource must start with 'federated-user/', got %q", a.Resource)
+	}
+
+	if !validNamePattern.MatchString(name) {
+		return FederatedUser{}, errorutil.Wrapf(ErrInvalidFederatedUserARN, "federated user name must match pattern %q, got %q",
+			validNamePattern.String(), name)
+	}
+
+	return FederatedUser{arn: a}, nil
+}
+
+// ARN returns the ARN of the federated user
+func (f FederatedUser) ARN() arn.ARN {
+	return f.arn
+}
+
+func (f FederatedUser) Type() PrincipalType { return PrincipalFederatedUser }
+
+// Name returns the name the federation token was requested with
+func (f FederatedUser) Name() string {
+	return strings.TrimPrefix(f.arn.Resource, "federated-user/")
+}
+
+// Root represents the ARN of an account's root user
+type Root struct {
+	arn arn.ARN
+}
+
+// rootFromARN parses an ARN into a Root
+func rootFromARN(a arn.ARN) (Root, error) {
+	if a.Service != "iam" {
+		return Root{}, errorutil.Wrapf(ErrInvalidRootARN, "service must be 'iam', got %q", a.Service)
+	}
+
+	if a.Resource != "root" {
+		return Root{}, errorutil.Wrapf(ErrInvalidRootARN, "resource must be 'root', got %q", a.Resource)
+	}
+
+	if !validAccountPattern.MatchString(a.AccountID) {
+		return Root{}, errorutil.Wrapf(ErrInvalidRootARN, "account must be an account ID, got %q", a.AccountID)
+	}
+
+	return Root{arn: a}, nil
+}
+
+// ARN returns the ARN of the root user
+func (r Root) ARN() arn.ARN {
+	return r.arn
+}
+
+func (r Root) Type() PrincipalType { return PrincipalRoot }
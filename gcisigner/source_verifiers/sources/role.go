@@ -1,15 +1,32 @@
 package sources
 
 import (
+	"fmt"
+	"regexp"
 	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws/arn"
 	"github.com/thomasdesr/roast/internal/errorutil"
 )
 
+// maxPathLength is the longest path IAM allows
+const maxPathLength = 512
+
+// validPathSegmentPattern adheres to AWS IAM path rules, which allow any
+// printable ASCII between the slashes
+var validPathSegmentPattern = regexp.MustCompile(`^[\x21-\x2E\x30-\x7E]+$`)
+
 // Role represents an IAM role ARN
+//
+// Roles can sit under a path, e.g. arn:aws:iam::123456789012:role/service/app/MyRole
+// has the path /service/app/, but STS leaves the path out of the ARNs of
+// sessions that assume them. So a Role rebuilt from an AssumedRole has an
+// unknown path until one is given to it with WithPath.
 type Role struct {
 	arn arn.ARN
+
+	// pathUnknown is set for roles whose ARN was rebuilt without their path
+	pathUnknown bool
 }
 
 // roleFromARN parses an ARN string into a Role
@@ -25,17 +42,22 @@ func roleFromARN(a arn.ARN) (Role, error) {
 		return Role{}, errorutil.Wrapf(ErrInvalidRoleARN, "resource must start with 'role/', got %q", a.Resource)
 	}
 
+	path, name := splitPath(parts[1])
+	if err := validatePath(path); err != nil {
+		return Role{}, errorutil.Wrap(ErrInvalidRoleARN, err.Error())
+	}
+
 	// Check role name is valid
-	if !validNamePattern.MatchString(parts[1]) {
+	if !validNamePattern.MatchString(name) {
 		return Role{}, errorutil.Wrapf(ErrInvalidRoleARN, "role name must match pattern %q, got %q",
-			validNamePattern.String(), parts[1])
+			validNamePattern.String(), name)
 	}
 
 	return Role{arn: a}, nil
 }
 
 // ARN returns the ARN of the role, it exists because we don't want to allow people to construct a Role
-// without using the blessed paths.
+// without using the blessed paths. It only includes the role's path if that is known.
 func (r Role) ARN() arn.ARN {
 	return r.arn
 }
@@ -48,3 +70,70 @@ func (r Role) RoleName() string {
 	}
 	return parts[len(parts)-1]
 }
+
+// Path returns the role's path, e.g. "/service/app/", which is "/" for roles
+// created without one. It is empty if the path isn't known, see Role.
+func (r Role) Path() string {
+	if r.pathUnknown {
+		return ""
+	}
+
+	path, _ := splitPath(strings.TrimPrefix(r.arn.Resource, "role/"))
+	return path
+}
+
+// WithPath returns the role under `path`, which must start and end with a
+// slash, e.g. to fill in the path of a role rebuilt from an AssumedRole.
+func (r Role) WithPath(path string) (Role, error) {
+	if err := validatePath(path); err != nil {
+		return Role{}, errorutil.Wrap(ErrInvalidRoleARN, err.Error())
+	}
+
+	a := r.arn
+	a.Resource = "role" + path + r.RoleName()
+	return Role{arn: a}, nil
+}
+
+// Is reports whether `r` and `other` are the same role. Role names are unique
+// within an account, whatever their path, so the paths are only compared if
+// both are known.
+func (r Role) Is(other Role) bool {
+	if r.arn.Partition != other.arn.Partition || r.arn.AccountID != other.arn.AccountID || r.RoleName() != other.RoleName() {
+		return false
+	}
+
+	if r.pathUnknown || other.pathUnknown {
+		return true
+	}
+	return r.Path() == other.Path()
+}
+
+// splitPath splits what follows "role/" in a role's resource into its path
+// and name.
+func splitPath(resource string) (path, name string) {
+	i := strings.LastIndex(resource, "/")
+	if i < 0 {
+		return "/", resource
+	}
+	return "/" + resource[:i+1], resource[i+1:]
+}
+
+// validatePath checks `path` is a valid IAM path.
+func validatePath(path string) error {
+	if !strings.HasPrefix(path, "/") || !strings.HasSuffix(path, "/") {
+		return fmt.Errorf("path must start and end with '/', got %q", path)
+	}
+	if len(path) > maxPathLength {
+		return fmt.Errorf("path must be at most %d characters, got %d", maxPathLength, len(path))
+	}
+
+	if path == "/" {
+		return nil
+	}
+	for _, segment := range strings.Split(path[1:len(path)-1], "/") {
+		if !validPathSegmentPattern.MatchString(segment) {
+			return fmt.Errorf("path segments must match pattern %q, got %q in %q", validPathSegmentPattern.String(), segment, path)
+		}
+	}
+	return nil
+}
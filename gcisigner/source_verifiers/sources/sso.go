@@ -0,0 +1,116 @@
+package sources
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/thomasdesr/roast/internal/errorutil"
+)
+
+// validPermissionSetName is what IAM Identity Center allows a permission set
+// to be named.
+var validPermissionSetName = regexp.MustCompile(`^[\w+=,.@-]{1,32}$`)
+
+// SSORolePath is the path IAM Identity Center creates the roles it provisions
+// for permission sets under, possibly followed by a region. Only IAM Identity
+// Center can create roles under it.
+const SSORolePath = "/aws-reserved/sso.amazonaws.com/"
+
+// ssoRoleName is the name IAM Identity Center gives the role it provisions for
+// a permission set: the permission set's name followed by a hash of it. As
+// names may contain underscores, the hash is found from the end.
+var ssoRoleName = regexp.MustCompile(`^AWSReservedSSO_([\w+=,.@-]{1,32})_[0-9a-f]{16}$`)
+
+// PermissionSet is an IAM Identity Center permission set, as provisioned into
+// one account. Each provisioning gets a role named
+// AWSReservedSSO_<name>_<hash>, where the hash differs between accounts, so
+// permission sets are matched by name and account rather than by role ARN.
+type PermissionSet struct {
+	partition, accountID, name string
+}
+
+// NewPermissionSet returns the permission set called `name` as provisioned
+// into `accountID` in `partition`.
+func NewPermissionSet(partition, accountID, name string) (PermissionSet, error) {
+	if !slices.Contains(Partitions, partition) {
+		return PermissionSet{}, errorutil.Wrapf(ErrInvalidPermissionSet, "partition must be one of %q, got %q", Partitions, partition)
+	}
+
+	if !validAccountPattern.MatchString(accountID) {
+		return PermissionSet{}, errorutil.Wrapf(ErrInvalidPermissionSet, "account must be an account ID, got %q", accountID)
+	}
+
+	if !validPermissionSetName.MatchString(name) {
+		return PermissionSet{}, errorutil.Wrapf(ErrInvalidPermissionSet, "name must match pattern %q, got %q",
+			validPermissionSetName.String(), name)
+	}
+
+	return PermissionSet{partition: partition, accountID: accountID, name: name}, nil
+}
+
+// Partition returns the partition the permission set is provisioned in
+func (p PermissionSet) Partition() string {
+	return p.partition
+}
+
+// AccountID returns the account the permission set is provisioned into
+func (p PermissionSet) AccountID() string {
+	return p.accountID
+}
+
+// Name returns the name of the permission set
+func (p PermissionSet) Name() string {
+	return p.name
+}
+
+// String describes the permission set, e.g. for logging which one matched
+func (p PermissionSet) String() string {
+	return fmt.Sprintf("permission set %q in %s account %s", p.name, p.partition, p.accountID)
+}
+
+// SSOSession is an assumed role session an IAM Identity Center user got by
+// signing in with a permission set.
+type SSOSession struct {
+	permissionSet PermissionSet
+	userName      string
+}
+
+// SSOSessionOf returns the IAM Identity Center session `a` is, if it's one.
+//
+// Sessions are recognized by their role's name alone, as STS doesn't say what
+// path it has (see Role), which would otherwise show it's one of the roles
+// under SSORolePath. Anyone able to create roles in an account can create one
+// with a look-alike name, so never trust the result on its own; use
+// IsSSORole once the role's path is known, as
+// source_verifiers.MatchesAnyPermissionSet does.
+func SSOSessionOf(a AssumedRole) (SSOSession, bool) {
+	m := ssoRoleName.FindStringSubmatch(a.RoleName())
+	if m == nil {
+		return SSOSession{}, false
+	}
+
+	return SSOSession{
+		permissionSet: PermissionSet{partition: a.arn.Partition, accountID: a.arn.AccountID, name: m[1]},
+		userName:      a.SessionName(),
+	}, true
+}
+
+// IsSSORole reports whether `r` is a role IAM Identity Center provisioned,
+// which can only be told from its path. Roles whose path isn't known never
+// are.
+func IsSSORole(r Role) bool {
+	return ssoRoleName.MatchString(r.RoleName()) && strings.HasPrefix(r.Path(), SSORolePath)
+}
+
+// PermissionSet returns the permission set the user signed in with
+func (s SSOSession) PermissionSet() PermissionSet {
+	return s.permissionSet
+}
+
+// UserName returns the IAM Identity Center user name the session belongs to,
+// which IAM Identity Center uses as the session name.
+func (s SSOSession) UserName() string {
+	return s.userName
+}
@@ -0,0 +1,57 @@
+package source_verifiers
+
+import (
+	"context"
+	"slices"
+
+	"github.com/thomasdesr/roast/gcisigner/awsapi"
+	"github.com/thomasdesr/roast/gcisigner/source_verifiers/sources"
+)
+
+// CallerSSOSession returns the IAM Identity Center session the caller is
+// using, if it's using one. See sources.SSOSessionOf for why that can't be
+// trusted on its own.
+func CallerSSOSession(gcir *awsapi.GetCallerIdentityResult) (sources.SSOSession, bool, error) {
+	caller, ok, err := callerAs[sources.AssumedRole](gcir)
+	if err != nil || !ok {
+		return sources.SSOSession{}, false, err
+	}
+
+	session, ok := sources.SSOSessionOf(caller)
+	return session, ok, nil
+}
+
+// MatchesAnyPermissionSet is a SourceVerifier that checks if the caller is an
+// IAM Identity Center user signed in with one of `permissionSets`, e.g. to let
+// engineers with an admin permission set reach internal admin endpoints. The
+// rule it reports is the permission set, and PeerMetadata.SSOUserName says
+// which user it was.
+//
+// As anyone able to create roles could create one named like a permission
+// set's, `resolve` is used to check the caller's role is under
+// sources.SSORolePath. Callers whose role's path it doesn't know are denied.
+func MatchesAnyPermissionSet(permissionSets []sources.PermissionSet, resolve RolePathResolver) Verifier {
+	return MatchFunc(func(ctx context.Context, gcir *awsapi.GetCallerIdentityResult) (string, bool, error) {
+		session, ok, err := CallerSSOSession(gcir)
+		if err != nil || !ok {
+			return "", false, err
+		}
+
+		if !slices.Contains(permissionSets, session.PermissionSet()) {
+			return "", false, nil
+		}
+
+		parentRole, _, err := callerRole(gcir)
+		if err != nil {
+			return "", false, err
+		}
+		if parentRole, err = ResolveRolePath(ctx, resolve, parentRole); err != nil {
+			return "", false, err
+		}
+		if !sources.IsSSORole(parentRole) {
+			return "", false, nil
+		}
+
+		return session.PermissionSet().String(), true, nil
+	})
+}
@@ -0,0 +1,29 @@
+package gcisigner
+
+import "context"
+
+// SignTrace is a set of hooks SigV4Signer.Sign calls as it works, so callers
+// can see where signing time goes. Any of them may be nil.
+type SignTrace struct {
+	// GetCredentialsStart is called before the signer retrieves the AWS
+	// credentials it signs with, and GotCredentials once it has them or has
+	// failed to.
+	GetCredentialsStart func()
+	GotCredentials      func(err error)
+}
+
+type signTraceContextKey struct{}
+
+// WithSignTrace returns a context that makes SigV4Signer.Sign call `trace`'s
+// hooks.
+func WithSignTrace(ctx context.Context, trace *SignTrace) context.Context {
+	return context.WithValue(ctx, signTraceContextKey{}, trace)
+}
+
+// signTraceFrom returns the trace attached to `ctx`, or an empty one.
+func signTraceFrom(ctx context.Context) *SignTrace {
+	if trace, ok := ctx.Value(signTraceContextKey{}).(*SignTrace); ok && trace != nil {
+		return trace
+	}
+	return &SignTrace{}
+}
@@ -4,15 +4,33 @@ import (
 	"bytes"
 	"context"
 	"encoding/xml"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
-	"net/url"
-	"strings"
+	"strconv"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
 	"github.com/thomasdesr/roast/gcisigner/awsapi"
 	"github.com/thomasdesr/roast/gcisigner/internal/masker"
 	"github.com/thomasdesr/roast/gcisigner/source_verifiers"
 	"github.com/thomasdesr/roast/internal/errorutil"
+	"github.com/thomasdesr/roast/internal/logutil"
+)
+
+var (
+	// ErrSignatureInvalid indicates STS refused to vouch for a message, e.g.
+	// because its signature doesn't match or its credentials have expired.
+	ErrSignatureInvalid = errors.New("message signature is invalid")
+
+	// ErrInvalidSource indicates a message was correctly signed, but by a
+	// principal the Verifier doesn't accept.
+	ErrInvalidSource = errors.New("message came from an invalid source")
+
+	// ErrVerifierUnavailable indicates the message couldn't be checked at all,
+	// e.g. because STS couldn't be reached or is having problems.
+	ErrVerifierUnavailable = errors.New("unable to verify message with STS")
 )
 
 type Verifier interface {
@@ -26,11 +44,36 @@ type SigV4Verifier struct {
 	raw unconstrainedSigV4Verifier
 
 	verifier source_verifiers.Verifier
+
+	// replayGuard, if set, screens messages before they're sent to STS
+	replayGuard *ReplayGuard
+
+	logger *slog.Logger
 }
 
 var _ Verifier = &SigV4Verifier{}
 
-func NewVerifier(validSources source_verifiers.Verifier, tr http.RoundTripper) *SigV4Verifier {
+// VerifierOption configures optional behavior of a SigV4Verifier.
+type VerifierOption func(v *SigV4Verifier)
+
+// WithReplayGuard makes the SigV4Verifier check every message against `g`
+// before spending an STS call on it. Messages that are stale or have already
+// been verified once are rejected with a *ReplayError.
+func WithReplayGuard(g *ReplayGuard) VerifierOption {
+	return func(v *SigV4Verifier) {
+		v.replayGuard = g
+	}
+}
+
+// WithLogger makes the SigV4Verifier log the outcome of every verification to
+// `logger`, failures at Warn and successes at Debug.
+func WithLogger(logger *slog.Logger) VerifierOption {
+	return func(v *SigV4Verifier) {
+		v.logger = logutil.OrDiscard(logger)
+	}
+}
+
+func NewVerifier(validSources source_verifiers.Verifier, tr http.RoundTripper, opts ...VerifierOption) *SigV4Verifier {
 	// We should never get a redirect, so we can safely ignore them
 	nonRedirectingClient := &http.Client{
 		Transport: tr,
@@ -39,69 +82,187 @@ func NewVerifier(validSources source_verifiers.Verifier, tr http.RoundTripper) *
 		},
 	}
 
-	return &SigV4Verifier{
+	v := &SigV4Verifier{
 		raw: unconstrainedSigV4Verifier{c: nonRedirectingClient},
 
 		verifier: validSources,
+
+		logger: logutil.Discard,
+	}
+
+	for _, opt := range opts {
+		opt(v)
 	}
+
+	return v
 }
 
 func (v *SigV4Verifier) Verify(ctx context.Context, msg *UnverifiedMessage) (*VerifiedMessage, error) {
-	sigVerifiedPayload, gcir, err := v.raw.VerifyPayload(ctx, msg)
+	start := time.Now()
+	verified, err := v.verify(ctx, msg)
+
+	// A zero SigV4Verifier has no logger
+	logger := logutil.OrDiscard(v.logger)
+
+	attrs := []slog.Attr{
+		slog.String("region", msg.Region.String()),
+		slog.Duration("duration", time.Since(start)),
+	}
+	if err != nil {
+		logger.LogAttrs(ctx, slog.LevelWarn, "message verification failed", append(attrs, slog.Any("error", err))...)
+		return nil, err
+	}
+
+	logger.LogAttrs(ctx, slog.LevelDebug, "message verified", append(attrs,
+		slog.String("peer_arn", verified.CallerIdentity.Arn),
+		slog.String("account", verified.CallerIdentity.Account),
+	)...)
+	return verified, nil
+}
+
+func (v *SigV4Verifier) verify(ctx context.Context, msg *UnverifiedMessage) (*VerifiedMessage, error) {
+	if v.replayGuard != nil {
+		if err := v.replayGuard.Check(msg); err != nil {
+			return nil, err
+		}
+	}
+
+	sigVerifiedPayload, resp, err := v.raw.VerifyPayload(ctx, msg)
 	if err != nil {
+		// The signature wasn't good, so there's nothing worth remembering
+		if v.replayGuard != nil {
+			v.replayGuard.Forget(msg)
+		}
 		return nil, errorutil.Wrap(err, "failed to verify unconstrained")
-	} else if gcir == nil {
-		panic("gcir should never be nil if there wasn't an error")
+	} else if resp == nil {
+		panic("resp should never be nil if there wasn't an error")
 	}
+	gcir := &resp.GetCallerIdentityResult
 
-	if ok, err := v.verifier.Verify(gcir); err != nil {
-		return nil, errorutil.Wrap(err, "failed to verify source")
-	} else if !ok {
-		return nil, fmt.Errorf("msg came from an invalid source: %v", gcir)
+	// STS only vouches for principals in its own partition, so a caller from
+	// any other can't be matched against the allowed roles
+	if err := checkPartition(msg.Region, gcir); err != nil {
+		return nil, &SourceError{
+			CallerIdentity: *gcir,
+			RequestID:      resp.ResponseMetadata.RequestId,
+			Err:            err,
+		}
+	}
+
+	rule, ok, err := source_verifiers.Match(ctx, v.verifier, gcir)
+	if err != nil || !ok {
+		return nil, &SourceError{
+			CallerIdentity: *gcir,
+			RequestID:      resp.ResponseMetadata.RequestId,
+			Rule:           rule,
+			Err:            err,
+		}
 	}
 
 	return &VerifiedMessage{
 		Payload:        sigVerifiedPayload,
 		CallerIdentity: *gcir,
+		RequestID:      resp.ResponseMetadata.RequestId,
+		MatchedRule:    rule,
 
 		Raw: (*SignedMessage)(msg),
 	}, nil
 }
 
+// checkPartition checks that the caller STS in `region` vouched for is in the
+// same partition as it.
+func checkPartition(region awsapi.Region, gcir *awsapi.GetCallerIdentityResult) error {
+	callerARN, err := arn.Parse(gcir.Arn)
+	if err != nil {
+		return errorutil.Wrap(err, "failed to parse caller ARN")
+	}
+
+	if awsapi.Partition(callerARN.Partition) != region.Partition() {
+		return fmt.Errorf("caller is in partition %q, but was verified in %q, which is in %q",
+			callerARN.Partition, region, region.Partition())
+	}
+	return nil
+}
+
+// SourceError is returned when a message was correctly signed, but by a
+// principal the Verifier doesn't accept. It matches ErrInvalidSource.
+type SourceError struct {
+	// CallerIdentity is who STS says signed the message, and RequestID the ID
+	// of the request it said so in.
+	CallerIdentity awsapi.GetCallerIdentityResult
+	RequestID      string
+
+	// Rule is the rule that rejected the caller, if the source verifier says
+	// (see source_verifiers.Matcher).
+	Rule string
+
+	// Err is why the source verifier rejected the caller, if it said.
+	Err error
+}
+
+func (e *SourceError) Error() string {
+	if e.Err != nil {
+		return errorutil.Wrap(fmt.Errorf("%w: %w", ErrInvalidSource, e.Err), "failed to verify source").Error()
+	}
+	return fmt.Sprintf("%v: %v", ErrInvalidSource, &e.CallerIdentity)
+}
+
+func (e *SourceError) Is(target error) bool {
+	return target == ErrInvalidSource
+}
+
+func (e *SourceError) Unwrap() error {
+	return e.Err
+}
+
 type unconstrainedSigV4Verifier struct {
 	c *http.Client
 }
 
-func (v *unconstrainedSigV4Verifier) VerifyPayload(ctx context.Context, msg *UnverifiedMessage) ([]byte, *awsapi.GetCallerIdentityResult, error) {
+func (v *unconstrainedSigV4Verifier) VerifyPayload(ctx context.Context, msg *UnverifiedMessage) ([]byte, *awsapi.GetCallerIdentityResponse, error) {
 	canonReq, unverifiedPayload /* cannot be trusted until we complete verification */, err := canonicalRequestFrom(ctx, msg)
 	if err != nil {
-		return nil, nil, errorutil.Wrap(err, "failed to create canonical request")
+		return nil, nil, errorutil.Wrap(fmt.Errorf("%w: %w", ErrSignatureInvalid, err), "failed to create canonical request")
 	}
 
 	// Send the request to STS to verify the signature
+	region := regionLabel(msg.Region)
+	start := time.Now()
 	resp, err := v.c.Do(canonReq)
+	stsVerifyDuration.Observe(time.Since(start).Seconds(), region)
 	if err != nil {
-		return nil, nil, errorutil.Wrap(err, "failed to send request")
+		stsResponses.Inc(region, "error")
+		return nil, nil, errorutil.Wrap(fmt.Errorf("%w: %w", ErrVerifierUnavailable, err), "failed to send request")
 	}
 	defer resp.Body.Close()
+	stsResponses.Inc(region, strconv.Itoa(resp.StatusCode))
 
-	// This should fail if the signature doesn't match
-	if resp.StatusCode != 200 {
-		return nil, nil, fmt.Errorf("failed to verify request: %s", resp.Status)
+	switch {
+	case resp.StatusCode == http.StatusOK:
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		// Throttled or broken, neither says anything about the message
+		return nil, nil, fmt.Errorf("%w: %s", ErrVerifierUnavailable, resp.Status)
+	default:
+		// This should fail if the signature doesn't match
+		return nil, nil, fmt.Errorf("%w: failed to verify request: %s", ErrSignatureInvalid, resp.Status)
 	}
 
 	// Extract the info about the caller from the response
 	var gcir awsapi.GetCallerIdentityResponse
 	if err := xml.NewDecoder(resp.Body).Decode(&gcir); err != nil {
-		return nil, nil, errorutil.Wrap(err, "failed to unmarshal response")
+		return nil, nil, errorutil.Wrap(fmt.Errorf("%w: %w", ErrVerifierUnavailable, err), "failed to unmarshal response")
 	}
 
-	return unverifiedPayload, &gcir.GetCallerIdentityResult, nil
+	return unverifiedPayload, &gcir, nil
 }
 
 func canonicalRequestFrom(ctx context.Context, msg *UnverifiedMessage) (*http.Request, []byte, error) {
-	// Construct sts:GetCallerIdentity URL for verification
-	uri, _ := url.Parse(strings.Replace(awsapi.RegionalGetCallerIdentityURLTemplate, "{region}", msg.Region.String(), 1))
+	// Construct sts:GetCallerIdentity URL for verification, which must be the
+	// one the message was signed for
+	uri, err := awsapi.GetCallerIdentityURL(msg.Region, msg.FIPS)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	// Unmask our data
 	unmaskedPayload, err := masker.Unmask(msg.Mask, msg.Body)
@@ -112,7 +273,7 @@ func canonicalRequestFrom(ctx context.Context, msg *UnverifiedMessage) (*http.Re
 	req, err := http.NewRequestWithContext(
 		ctx,
 		"POST",
-		uri.String(),
+		uri,
 		bytes.NewBuffer(unmaskedPayload),
 	)
 	if err != nil {
@@ -3,8 +3,11 @@ package gcisigner_test
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/thomasdesr/roast/gcisigner"
@@ -108,10 +111,74 @@ func TestVerifyBadSource(t *testing.T) {
 		XAmzSecurityToken: "token",
 		XAmzDate:          "date",
 	})
-	if err == nil {
-		t.Fatal("Verification should've failed", err)
+	if !errors.Is(err, gcisigner.ErrInvalidSource) {
+		t.Fatalf("Expected %v, got %v", gcisigner.ErrInvalidSource, err)
 	}
 	if resp != nil {
 		t.Fatalf("Expected nil response, got %v", resp)
 	}
 }
+
+func TestVerifyClassifiesSTSFailures(t *testing.T) {
+	for name, tc := range map[string]struct {
+		status int
+		want   error
+	}{
+		"forbidden":   {status: http.StatusForbidden, want: gcisigner.ErrSignatureInvalid},
+		"throttled":   {status: http.StatusTooManyRequests, want: gcisigner.ErrVerifierUnavailable},
+		"unavailable": {status: http.StatusServiceUnavailable, want: gcisigner.ErrVerifierUnavailable},
+	} {
+		t.Run(name, func(t *testing.T) {
+			srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.status)
+			}))
+			defer srv.Close()
+
+			v := gcisigner.NewVerifier(allowAll, httptestServerTransport(srv))
+
+			_, err := v.Verify(context.Background(), signTestMessage(t))
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("Expected %v, got %v", tc.want, err)
+			}
+		})
+	}
+
+	t.Run("unreachable", func(t *testing.T) {
+		srv := httptest.NewTLSServer(http.NotFoundHandler())
+		tr := httptestServerTransport(srv)
+		srv.Close()
+
+		v := gcisigner.NewVerifier(allowAll, tr)
+
+		_, err := v.Verify(context.Background(), signTestMessage(t))
+		if !errors.Is(err, gcisigner.ErrVerifierUnavailable) {
+			t.Fatalf("Expected %v, got %v", gcisigner.ErrVerifierUnavailable, err)
+		}
+	})
+}
+
+func TestVerifyMetrics(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	v := gcisigner.NewVerifier(allowAll, httptestServerTransport(srv))
+	if _, err := v.Verify(context.Background(), signTestMessage(t)); err == nil {
+		t.Fatal("expected verification to fail")
+	}
+
+	var buf bytes.Buffer
+	if err := gcisigner.WriteMetrics(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, series := range []string{
+		`gcisigner_sts_responses_total{region="us-west-2",status="403"} `,
+		`gcisigner_sts_verify_duration_seconds_count{region="us-west-2"} `,
+	} {
+		if !strings.Contains(buf.String(), series) {
+			t.Errorf("expected metrics to include %s, got:\n%s", series, buf.String())
+		}
+	}
+}
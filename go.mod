@@ -1,6 +1,6 @@
 module github.com/thomasdesr/roast
 
-go 1.23.0
+go 1.24.0
 
 require (
 	github.com/aws/aws-sdk-go-v2 v1.30.0
@@ -4,62 +4,296 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
 	"net"
+	"slices"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws/arn"
 	"github.com/thomasdesr/roast/gcisigner"
+	"github.com/thomasdesr/roast/gcisigner/source_verifiers"
 	"github.com/thomasdesr/roast/internal/errorutil"
 )
 
-func clientHandshake(ctx context.Context, conn net.Conn, signer gcisigner.Signer, verifier gcisigner.Verifier) (*tls.Config, *PeerMetadata, error) {
+// handshakeConfig holds the handshake settings shared by Dialers and
+// Listeners.
+type handshakeConfig struct {
+	versions     []ProtocolVersion
+	capabilities []Capability
+
+	// certAlgorithms and keyExchangeGroups restrict the cryptography used by
+	// the TLS connection that follows the handshake.
+	certAlgorithms    []CertificateAlgorithm
+	keyExchangeGroups []tls.CurveID
+
+	// resumption holds session resumption tickets when it's enabled
+	resumption *sessionCache
+
+	// maxConnectionAge is how long a connection may be used for after its
+	// handshake, or zero for no limit.
+	maxConnectionAge time.Duration
+
+	// reattestation is set when peers must re-prove their identity on a
+	// schedule
+	reattestation *reattestation
+
+	// nextProtos are the ALPN protocols offered during the TLS handshake
+	nextProtos []string
+
+	// claims are signed into our hello for the peer to see
+	claims Claims
+
+	// sourceVerifier, if set, decides which peers the default Verifier
+	// accepts in place of a list of allowed roles
+	sourceVerifier source_verifiers.Verifier
+
+	// trace, if set, is run for every handshake
+	trace *HandshakeTrace
+
+	// logger, if set, is where we log handshakes and re-attestations
+	logger *slog.Logger
+
+	// auditSink, if set, records the outcome of every handshake
+	auditSink AuditSink
+}
+
+// protocolVersions returns the versions this side is willing to speak, falling
+// back to the defaults if none were configured.
+func (hc *handshakeConfig) protocolVersions() []ProtocolVersion {
+	if len(hc.versions) == 0 {
+		return defaultProtocolVersions
+	}
+	return hc.versions
+}
+
+// certificateAlgorithms returns the algorithms we accept for the peer's
+// certificates, falling back to the defaults if none were configured.
+func (hc *handshakeConfig) certificateAlgorithms() []CertificateAlgorithm {
+	if len(hc.certAlgorithms) == 0 {
+		return defaultCertificateAlgorithms
+	}
+	return hc.certAlgorithms
+}
+
+// certificateAlgorithm is the algorithm we generate our own certificates with.
+func (hc *handshakeConfig) certificateAlgorithm() CertificateAlgorithm {
+	return hc.certificateAlgorithms()[0]
+}
+
+// keyExchanges returns the TLS key exchange groups we support in order of
+// preference, falling back to the defaults if none were configured.
+func (hc *handshakeConfig) keyExchanges() []tls.CurveID {
+	if len(hc.keyExchangeGroups) == 0 {
+		return defaultKeyExchanges
+	}
+	return hc.keyExchangeGroups
+}
+
+// localTLSParams are our TLS parameters, before they are negotiated against a
+// peer's hello, or for when there is no hello to negotiate them against.
+func (hc *handshakeConfig) localTLSParams() tlsParams {
+	return tlsParams{
+		keyExchanges:          hc.keyExchanges(),
+		certificateAlgorithms: hc.certificateAlgorithms(),
+		nextProtos:            hc.nextProtos,
+	}
+}
+
+// stampHandshake records in `peer` that its handshake has just completed, and
+// when the connection will expire.
+func (hc *handshakeConfig) stampHandshake(peer *PeerMetadata) {
+	peer.HandshakeTime = time.Now()
+	peer.ExpiresAt = time.Time{}
+	if hc.maxConnectionAge > 0 {
+		peer.ExpiresAt = peer.HandshakeTime.Add(hc.maxConnectionAge)
+	}
+
+	// A peer that can't re-attest only gets to use the connection until its
+	// first re-attestation would have been due.
+	if hc.reattestation != nil && !slices.Contains(peer.Capabilities, CapabilityReattestation) {
+		due := peer.HandshakeTime.Add(hc.reattestation.interval)
+		if peer.ExpiresAt.IsZero() || due.Before(peer.ExpiresAt) {
+			peer.ExpiresAt = due
+		}
+	}
+}
+
+// framing reports whether we speak framing, which is the case whenever we
+// offer anything newer than ProtocolVersion1.
+func (hc *handshakeConfig) framing() bool {
+	return offersFraming(hc.protocolVersions())
+}
+
+func offersFraming(versions []ProtocolVersion) bool {
+	return slices.ContainsFunc(versions, func(v ProtocolVersion) bool {
+		return v >= ProtocolVersion2
+	})
+}
+
+func clientHandshake(ctx context.Context, conn net.Conn, signer gcisigner.Signer, verifier gcisigner.Verifier, hc *handshakeConfig) (_ *tls.Config, _ *PeerMetadata, err error) {
 	remoteHost, _, _ := strings.Cut(conn.RemoteAddr().String(), ":") // Trim off any port
+	tr := hc.tracer(ctx)
+	ctx = source_verifiers.WithSourceAddr(ctx, conn.RemoteAddr())
 
-	localCA, err := makeLocalCA()
+	localCA, err := tr.makeLocalCA(hc.certificateAlgorithm())
 	if err != nil {
 		return nil, nil, errorutil.Wrap(err, "failed to make a local CA")
 	}
 
-	// Write our client hello
+	// Servers that only speak ProtocolVersion1 can't read framed hellos, so as
+	// long as we offer it we send ours unframed, asking for a framed answer if
+	// we speak framing. Servers that understand framing answer in a frame, and
+	// we know to speak it from then on.
+	sentFramed := !slices.Contains(hc.protocolVersions(), ProtocolVersion1)
+	framed := sentFramed
+
+	// Once we've said hello, tell the server why we're hanging up on it, as
+	// long as it understands alerts.
+	var saidHello bool
+	defer func() {
+		if err != nil && saidHello && framed {
+			sendAlert(conn, err, hc)
+		}
+	}()
+
+	// Try to resume an earlier session with this server before paying for STS.
+	// If the server doesn't know our ticket we carry on as if we'd never had it.
+	// We only hold tickets for servers that understand framing.
+	if hc.framing() && hc.resumption != nil {
+		if t := hc.resumption.take(conn.RemoteAddr().String()); t != nil && hc.recheckSource(ctx, &t.peer) == nil {
+			tlsConfig, peer, err := clientResume(conn, localCA, remoteHost, t, hc.localTLSParams())
+			if !errors.Is(err, errResumptionRejected) {
+				return tlsConfig, peer, err
+			}
+		}
+	}
+
+	// Write our client hello, keeping the exact bytes we sent so we can check
+	// the server's response is bound to them.
+	var signedCHBytes []byte
 	{
 		ch, err := json.Marshal(clientHello{
 			ClientCA:        localCA.certPEM,
 			ServerHostnames: []string{remoteHost},
+
+			Versions:     hc.protocolVersions(),
+			Capabilities: hc.capabilities,
+
+			CertificateAlgorithms: hc.certificateAlgorithms(),
+			KeyExchanges:          hc.keyExchanges(),
+
+			Claims: hc.claims,
+			Nonce:  newNonce(),
 		})
 		if err != nil {
 			return nil, nil, errorutil.Wrap(err, "failed to marshal client hello")
 		}
 
-		signedCH, err := signer.Sign(ctx, ch)
+		signedCH, err := tr.sign(ctx, signer, ch)
 		if err != nil {
 			return nil, nil, errorutil.Wrap(err, "failed to sign client hello")
 		}
 
-		if err := json.NewEncoder(conn).Encode(signedCH); err != nil {
+		signedCHBytes, err = json.Marshal(signedHello{
+			SignedMessage: signedCH,
+			Framing:       !sentFramed && hc.framing(),
+		})
+		if err != nil {
+			return nil, nil, errorutil.Wrap(err, "failed to marshal signed client hello")
+		}
+
+		if err := writeHello(conn, signedCHBytes, sentFramed); err != nil {
 			return nil, nil, errorutil.Wrap(err, "failed to write client handshake")
 		}
+		saidHello = true
 	}
 
 	// Read the server hello
 	var (
-		sh   serverHello
-		peer PeerMetadata
+		sh     serverHello
+		peer   PeerMetadata
+		params tlsParams
 	)
 	{
-		var signedResponse gcisigner.UnverifiedMessage
-		if err := json.NewDecoder(conn).Decode(&signedResponse); err != nil {
+		signedSHBytes, shFramed, err := readHello(conn)
+		if err != nil {
+			if sentFramed && hungUp(err) {
+				return nil, nil, errorutil.Wrap(err, "server closed the connection without replying (servers that predate ProtocolVersion2 can't read hellos from Dialers that don't offer ProtocolVersion1)")
+			}
 			return nil, nil, errorutil.Wrap(err, "failed to read server handshake")
 		}
 
-		verifiedResponse, err := verifier.Verify(ctx, &signedResponse)
+		// Servers answer framed hellos in frames, and unframed ones in frames
+		// only if we offered something newer than ProtocolVersion1. Anything
+		// else means someone other than the server is answering, e.g. with an
+		// old, unbound server hello to downgrade us.
+		if shFramed != framed && (sentFramed || !hc.framing()) {
+			return nil, nil, errorutil.Wrapf(ErrMalformedFrame, "server hello framing (%t) doesn't match client hello framing (%t)", shFramed, sentFramed)
+		}
+		framed = shFramed
+
+		var signedResponse gcisigner.UnverifiedMessage
+		if err := json.Unmarshal(signedSHBytes, &signedResponse); err != nil {
+			return nil, nil, errorutil.Wrap(err, "failed to unmarshal server handshake")
+		}
+
+		verifiedResponse, err := tr.verify(ctx, verifier, &signedResponse)
 		if err != nil {
-			return nil, nil, errorutil.Wrap(err, "failed to verify server hello")
+			return nil, nil, errorutil.Wrap(verificationError{err}, "failed to verify server hello")
 		}
 
 		if err := json.Unmarshal(verifiedResponse.Payload, &sh); err != nil {
 			return nil, nil, errorutil.Wrap(err, "failed to unmarshal server hello")
 		}
 
+		// Any server that understands framing binds its hello to ours, so
+		// don't trust anything else it says until we've checked that binding.
+		// Servers restricted to ProtocolVersion1 answer unframed but still
+		// bind, so an unframed hello that carries a binding has it checked
+		// too. Only framed hellos list Versions, so one that arrives unframed
+		// was re-sent by someone hoping we'd skip the binding.
+		if !framed && len(sh.Versions) > 0 {
+			return nil, nil, errorutil.Wrap(ErrTranscriptMismatch, "server hello lists versions but wasn't framed")
+		}
+		if framed || len(sh.Nonce) > 0 || len(sh.ClientHelloHash) > 0 {
+			if err := sh.verifyBinding(signedCHBytes); err != nil {
+				return nil, nil, errorutil.Wrap(err, "failed to verify server hello binding")
+			}
+		}
+
+		var version ProtocolVersion
+		if framed {
+			// Framed servers tell us what they support and leave the choice to
+			// us, making the same choice on their end.
+			version, err = negotiateVersion(hc.protocolVersions(), sh.Versions)
+			if err != nil {
+				return nil, nil, errorutil.Wrap(err, "failed to negotiate a protocol version")
+			}
+		} else {
+			// Servers that predate version negotiation don't tell us what they
+			// picked, but they can only be speaking the original protocol.
+			version = sh.Version
+			if version == 0 {
+				version = ProtocolVersion1
+			}
+			if !slices.Contains(hc.protocolVersions(), version) {
+				return nil, nil, errorutil.Wrapf(ErrNoCommonProtocolVersion, "server selected %v, but we only support %v", version, hc.protocolVersions())
+			}
+		}
+
+		if err := sh.Claims.validate(); err != nil {
+			return nil, nil, errorutil.Wrap(err, "server hello has invalid claims")
+		}
+
+		params, err = negotiateTLSParams(hc, localCA, sh.ServerCA, sh.CertificateAlgorithms, sh.KeyExchanges)
+		if err != nil {
+			return nil, nil, errorutil.Wrap(err, "failed to negotiate TLS parameters")
+		}
+
 		peerARN, err := arn.Parse(verifiedResponse.CallerIdentity.Arn)
 		if err != nil {
 			return nil, nil, errorutil.Wrap(err, "failed to parse peer ARN from a getcalleridentity response")
@@ -68,10 +302,21 @@ func clientHandshake(ctx context.Context, conn net.Conn, signer gcisigner.Signer
 		peer = PeerMetadata{
 			AccountID: verifiedResponse.CallerIdentity.Account,
 			Role:      peerARN,
+
+			ProtocolVersion: version,
+			Capabilities:    negotiateCapabilities(hc.capabilities, sh.Capabilities),
+
+			Claims: sh.Claims,
+
+			verifiedAt: time.Now(),
+			identity:   verifiedIdentityOf(verifiedResponse),
 		}
+		peer.describePrincipal()
 	}
 
-	tlsConfig, err := makeClientConfig(*localCA, remoteHost, sh)
+	doneCert := tr.certificate(localCA.algorithm)
+	tlsConfig, err := makeClientConfig(*localCA, remoteHost, sh, params)
+	doneCert(err)
 	if err != nil {
 		return nil, nil, errorutil.Wrap(err, "failed to make client config")
 	}
@@ -79,27 +324,138 @@ func clientHandshake(ctx context.Context, conn net.Conn, signer gcisigner.Signer
 	return tlsConfig, &peer, nil
 }
 
-func serverHandshake(ctx context.Context, conn net.Conn, signer gcisigner.Signer, verifier gcisigner.Verifier) (*tls.Config, *PeerMetadata, error) {
-	// Read the client hello
+func serverHandshake(ctx context.Context, conn net.Conn, signer gcisigner.Signer, verifier gcisigner.Verifier, hc *handshakeConfig) (_ *tls.Config, _ *PeerMetadata, err error) {
+	var framed bool
+	ctx = source_verifiers.WithSourceAddr(ctx, conn.RemoteAddr())
+
+	// Tell the client why we're rejecting it, as long as it'll understand an
+	// alert. It gets one either in place of our hello or of our TLS
+	// ServerHello, depending on how far we got.
+	defer func() {
+		if err != nil && framed {
+			sendAlert(conn, err, hc)
+		}
+	}()
+
 	var (
-		ch   clientHello
-		peer PeerMetadata
+		typ     frameType
+		payload []byte
 	)
-	{
-		var unverifiedHandshake gcisigner.UnverifiedMessage
-		if err := json.NewDecoder(conn).Decode(&unverifiedHandshake); err != nil {
+	typ, payload, framed, err = readMessage(conn)
+	if err != nil {
+		return nil, nil, errorutil.Wrap(err, "failed to read client handshake")
+	}
+
+	// Clients holding a ticket from an earlier session try to resume it first.
+	// If we can't, we say so and they carry on with a full handshake.
+	if typ == frameTypeResume {
+		tlsConfig, peer, resumeErr := serverResume(ctx, conn, payload, hc)
+		if !errors.Is(resumeErr, errResumptionRejected) {
+			return tlsConfig, peer, resumeErr
+		}
+
+		if err := writeFrame(conn, frameTypeResumeRejected, nil); err != nil {
+			return nil, nil, errorutil.Wrap(err, "failed to reject session resumption")
+		}
+
+		typ, payload, framed, err = readMessage(conn)
+		if err != nil {
 			return nil, nil, errorutil.Wrap(err, "failed to read client handshake")
 		}
+	}
+
+	// Keep the exact bytes of the client hello so we can bind our response to
+	// them.
+	signedCHBytes, err := helloFrom(typ, payload)
+	if err != nil {
+		return nil, nil, errorutil.Wrap(err, "failed to read client handshake")
+	}
 
-		verifiedHandshake, err := verifier.Verify(ctx, &unverifiedHandshake)
+	var hello signedHello
+	if err := json.Unmarshal(signedCHBytes, &hello); err != nil || hello.SignedMessage == nil {
+		return nil, nil, errorutil.Wrapf(ErrMalformedFrame, "failed to unmarshal client handshake: %v", err)
+	}
+	unverifiedHandshake := (*gcisigner.UnverifiedMessage)(hello.SignedMessage)
+
+	// Clients that still offer ProtocolVersion1 send unframed hellos so that
+	// older servers can read them. If they ask for it, we answer them as if
+	// they'd framed it, binding our hello to theirs.
+	if !framed && hello.Framing && hc.framing() {
+		framed = true
+	}
+
+	// Kick off verification of the client hello with STS, we'll do what we can
+	// while it's in flight but never go on to TLS until it has succeeded.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	tr := hc.tracer(ctx)
+	waitForVerification := verifyAsync(ctx, tr, verifier, unverifiedHandshake)
+
+	localCA, err := tr.makeLocalCA(hc.certificateAlgorithm())
+	if err != nil {
+		return nil, nil, errorutil.Wrap(err, "failed to make a local CA")
+	}
+
+	sh := serverHello{
+		ServerCA: localCA.certPEM,
+
+		CertificateAlgorithms: hc.certificateAlgorithms(),
+		KeyExchanges:          hc.keyExchanges(),
+
+		Claims:          hc.claims,
+		Nonce:           newNonce(),
+		ClientHelloHash: transcriptHash(signedCHBytes),
+	}
+
+	// Framed clients work out the version and capabilities for themselves from
+	// what we support, so we can answer them without waiting on STS. The
+	// client will in turn verify our hello while we verify theirs.
+	if framed {
+		sh.Versions, sh.Capabilities = hc.protocolVersions(), hc.capabilities
+
+		if err := writeServerHello(ctx, conn, tr, signer, sh, framed); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Wait for the client hello to be verified
+	var (
+		ch     clientHello
+		peer   PeerMetadata
+		params tlsParams
+	)
+	{
+		verifiedHandshake, err := waitForVerification()
 		if err != nil {
-			return nil, nil, errorutil.Wrap(err, "failed to verify client hello")
+			return nil, nil, errorutil.Wrap(verificationError{err}, "failed to verify client hello")
 		}
 
 		if err := json.Unmarshal(verifiedHandshake.Payload, &ch); err != nil {
 			return nil, nil, errorutil.Wrap(err, "failed to unmarshal client hello")
 		}
 
+		version, err := negotiateVersion(hc.protocolVersions(), ch.Versions)
+		if err != nil {
+			return nil, nil, errorutil.Wrap(err, "failed to negotiate a protocol version")
+		}
+
+		// Whether to frame isn't signed, so a client offering anything newer
+		// that we didn't answer in frames must have had its request for them
+		// stripped, to get it to accept an unbound answer.
+		if !framed && version >= ProtocolVersion2 {
+			return nil, nil, errorutil.Wrapf(ErrMalformedFrame, "client offered %v but didn't ask for a framed answer", version)
+		}
+
+		if err := ch.Claims.validate(); err != nil {
+			return nil, nil, errorutil.Wrap(err, "client hello has invalid claims")
+		}
+
+		params, err = negotiateTLSParams(hc, localCA, ch.ClientCA, ch.CertificateAlgorithms, ch.KeyExchanges)
+		if err != nil {
+			return nil, nil, errorutil.Wrap(err, "failed to negotiate TLS parameters")
+		}
+
 		peerARN, err := arn.Parse(verifiedHandshake.CallerIdentity.Arn)
 		if err != nil {
 			return nil, nil, errorutil.Wrap(err, "failed to parse peer ARN from a getcalleridentity response")
@@ -108,37 +464,84 @@ func serverHandshake(ctx context.Context, conn net.Conn, signer gcisigner.Signer
 		peer = PeerMetadata{
 			AccountID: verifiedHandshake.CallerIdentity.Account,
 			Role:      peerARN,
-		}
-	}
 
-	localCA, err := makeLocalCA()
-	if err != nil {
-		return nil, nil, errorutil.Wrap(err, "failed to make a local CA")
-	}
+			ProtocolVersion: version,
+			Capabilities:    negotiateCapabilities(hc.capabilities, ch.Capabilities),
 
-	// Write our server hello
-	{
-		sh, err := json.Marshal(serverHello{
-			ServerCA: localCA.certPEM,
-		})
-		if err != nil {
-			return nil, nil, errorutil.Wrap(err, "failed to marshal server hello")
-		}
+			Claims: ch.Claims,
 
-		signedSH, err := signer.Sign(ctx, sh)
-		if err != nil {
-			return nil, nil, errorutil.Wrap(err, "failed to sign server hello")
+			verifiedAt: time.Now(),
+			identity:   verifiedIdentityOf(verifiedHandshake),
 		}
+		peer.describePrincipal()
+	}
 
-		if err := json.NewEncoder(conn).Encode(signedSH); err != nil {
-			return nil, nil, errorutil.Wrap(err, "failed to write server handshake")
+	// Clients that predate framing expect to be told which version we picked,
+	// which we can only do once we've verified their hello.
+	if !framed {
+		sh.Version, sh.Capabilities = peer.ProtocolVersion, peer.Capabilities
+
+		if err := writeServerHello(ctx, conn, tr, signer, sh, framed); err != nil {
+			return nil, nil, err
 		}
 	}
 
-	tlsConfig, err := makeServerConfig(*localCA, ch)
+	doneCert := tr.certificate(localCA.algorithm)
+	tlsConfig, err := makeServerConfig(*localCA, ch, params)
+	doneCert(err)
 	if err != nil {
 		return nil, nil, errorutil.Wrap(err, "failed to make server config")
 	}
 
 	return tlsConfig, &peer, nil
 }
+
+// writeServerHello signs `sh` and sends it to the client.
+func writeServerHello(ctx context.Context, conn net.Conn, tr tracer, signer gcisigner.Signer, sh serverHello, framed bool) error {
+	shBytes, err := json.Marshal(sh)
+	if err != nil {
+		return errorutil.Wrap(err, "failed to marshal server hello")
+	}
+
+	signedSH, err := tr.sign(ctx, signer, shBytes)
+	if err != nil {
+		return errorutil.Wrap(err, "failed to sign server hello")
+	}
+
+	signedSHBytes, err := json.Marshal(signedSH)
+	if err != nil {
+		return errorutil.Wrap(err, "failed to marshal signed server hello")
+	}
+
+	// Reply in whichever encoding the client used
+	if err := writeHello(conn, signedSHBytes, framed); err != nil {
+		return errorutil.Wrap(err, "failed to write server handshake")
+	}
+
+	return nil
+}
+
+// verifyAsync starts verifying `msg` in the background and returns a function
+// that waits for the result.
+func verifyAsync(ctx context.Context, tr tracer, verifier gcisigner.Verifier, msg *gcisigner.UnverifiedMessage) func() (*gcisigner.VerifiedMessage, error) {
+	type result struct {
+		verified *gcisigner.VerifiedMessage
+		err      error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		verified, err := tr.verify(ctx, verifier, msg)
+		done <- result{verified, err}
+	}()
+
+	return func() (*gcisigner.VerifiedMessage, error) {
+		r := <-done
+		return r.verified, r.err
+	}
+}
+
+// hungUp reports whether `err` means the peer closed the connection on us.
+func hungUp(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET)
+}
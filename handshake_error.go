@@ -0,0 +1,90 @@
+package roast
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/thomasdesr/roast/gcisigner"
+)
+
+// HandshakeStage says how far a server-side handshake got before it failed.
+type HandshakeStage string
+
+const (
+	// HandshakeStageAdmission failures happen before the handshake starts,
+	// e.g. waiting too long for a slot (see WithMaxInFlightHandshakes).
+	HandshakeStageAdmission HandshakeStage = "admission"
+
+	// HandshakeStageFraming failures happen reading and parsing the client's
+	// hello, including when the client hangs up or times out.
+	HandshakeStageFraming HandshakeStage = "framing"
+
+	// HandshakeStageSignature failures happen checking the client hello's
+	// signature with STS, including STS being unavailable.
+	HandshakeStageSignature HandshakeStage = "signature verification"
+
+	// HandshakeStageSource failures happen when the client hello was validly
+	// signed, but by a principal we don't accept.
+	HandshakeStageSource HandshakeStage = "source verification"
+
+	// HandshakeStageNegotiation failures happen when the client has no
+	// protocol version or algorithms in common with us.
+	HandshakeStageNegotiation HandshakeStage = "negotiation"
+
+	// HandshakeStageTLS failures happen in the TLS handshake that follows the
+	// Roast one, including when the client rejects our hello and sends an
+	// alert in place of its TLS ClientHello.
+	HandshakeStageTLS HandshakeStage = "tls"
+)
+
+// HandshakeError is returned when a server-side handshake fails, and passed
+// to the hook set by WithHandshakeErrorHook.
+type HandshakeError struct {
+	RemoteAddr net.Addr
+	Stage      HandshakeStage
+	Err        error
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("handshake with %v failed during %v: %v", e.RemoteAddr, e.Stage, e.Err)
+}
+
+func (e *HandshakeError) Unwrap() error {
+	return e.Err
+}
+
+// stage is the stage `e` failed at, or "" if it's nil.
+func (e *HandshakeError) stage() HandshakeStage {
+	if e == nil {
+		return ""
+	}
+	return e.Stage
+}
+
+// verificationError marks an error from verifying a peer's hello.
+type verificationError struct {
+	error
+}
+
+func (e verificationError) Unwrap() error {
+	return e.error
+}
+
+// roastHandshakeStage works out which stage of the Roast handshake (as
+// opposed to the TLS one that follows it) failed with `err`.
+func roastHandshakeStage(err error) HandshakeStage {
+	var verr verificationError
+	switch {
+	case errors.As(err, &verr) && errors.Is(err, gcisigner.ErrInvalidSource):
+		return HandshakeStageSource
+	case errors.As(err, &verr):
+		return HandshakeStageSignature
+	case errors.Is(err, ErrNoCommonProtocolVersion),
+		errors.Is(err, ErrCertificateAlgorithmNotAccepted),
+		errors.Is(err, ErrNoCommonKeyExchange):
+		return HandshakeStageNegotiation
+	default:
+		return HandshakeStageFraming
+	}
+}
@@ -0,0 +1,194 @@
+package roast_test
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	roast "github.com/thomasdesr/roast"
+	"github.com/thomasdesr/roast/gcisigner"
+)
+
+func TestHandshakeErrorStages(t *testing.T) {
+	for name, tc := range map[string]struct {
+		setup func(t *testing.T, l *roast.Listener, d *roast.Dialer) upgradeFunc
+		want  roast.HandshakeStage
+	}{
+		"framing": {
+			setup: func(_ *testing.T, _ *roast.Listener, _ *roast.Dialer) upgradeFunc {
+				return func(_ context.Context, c net.Conn) (*tls.Conn, *roast.PeerMetadata, error) {
+					io.WriteString(c, "GET / HTTP/1.1\r\n\r\n")
+					return nil, nil, errors.New("not a roast client")
+				}
+			},
+			want: roast.HandshakeStageFraming,
+		},
+		"signature": {
+			setup: func(t *testing.T, l *roast.Listener, d *roast.Dialer) upgradeFunc {
+				l.Verifier = failingVerifier{fmt.Errorf("%w: 403 Forbidden", gcisigner.ErrSignatureInvalid)}
+				return d.UpgradeClientConn
+			},
+			want: roast.HandshakeStageSignature,
+		},
+		"source": {
+			setup: func(t *testing.T, l *roast.Listener, d *roast.Dialer) upgradeFunc {
+				l.Verifier = failingVerifier{gcisigner.ErrInvalidSource}
+				return d.UpgradeClientConn
+			},
+			want: roast.HandshakeStageSource,
+		},
+		"negotiation": {
+			setup: func(t *testing.T, l *roast.Listener, d *roast.Dialer) upgradeFunc {
+				if err := roast.WithKeyExchanges[roast.Listener](tls.CurveP256)(l); err != nil {
+					t.Fatal(err)
+				}
+				if err := roast.WithKeyExchanges[roast.Dialer](tls.X25519)(d); err != nil {
+					t.Fatal(err)
+				}
+				return d.UpgradeClientConn
+			},
+			want: roast.HandshakeStageNegotiation,
+		},
+		"tls": {
+			setup: func(_ *testing.T, _ *roast.Listener, d *roast.Dialer) upgradeFunc {
+				d.Verifier = failingVerifier{gcisigner.ErrInvalidSource}
+				return d.UpgradeClientConn
+			},
+			want: roast.HandshakeStageTLS,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			l, d := localValidListenerAndDialer(t)
+
+			var hooked []*roast.HandshakeError
+			if err := roast.WithHandshakeErrorHook(func(err *roast.HandshakeError) {
+				hooked = append(hooked, err)
+			})(l); err != nil {
+				t.Fatal(err)
+			}
+
+			server, _ := upgradePair(t, l.UpgradeServerConn, tc.setup(t, l, d))
+
+			var herr *roast.HandshakeError
+			if !errors.As(server.err, &herr) {
+				t.Fatalf("expected a HandshakeError, got %v", server.err)
+			}
+			if herr.Stage != tc.want {
+				t.Errorf("expected the handshake to fail during %q, got %q: %v", tc.want, herr.Stage, herr.Err)
+			}
+			if herr.RemoteAddr == nil {
+				t.Error("expected the error to say who the connection was from")
+			}
+
+			if len(hooked) != 1 || hooked[0] != herr {
+				t.Errorf("expected the hook to be called once with %v, got %v", herr, hooked)
+			}
+		})
+	}
+}
+
+func TestHandshakeErrorHookAdmission(t *testing.T) {
+	l, d := localValidListenerAndDialer(t)
+	if err := roast.WithHandshakeTimeout[roast.Listener](200 * time.Millisecond)(l); err != nil {
+		t.Fatal(err)
+	}
+	if err := roast.WithMaxInFlightHandshakes(1)(l); err != nil {
+		t.Fatal(err)
+	}
+	if err := roast.WithHandshakeQueueDepth(1)(l); err != nil {
+		t.Fatal(err)
+	}
+
+	hooked := make(chan *roast.HandshakeError, 2)
+	if err := roast.WithHandshakeErrorHook(func(err *roast.HandshakeError) { hooked <- err })(l); err != nil {
+		t.Fatal(err)
+	}
+
+	// Hold the only slot, verifying the first client, for longer than the
+	// queued connection will wait
+	release := make(chan struct{})
+	defer close(release)
+	serverVerifier := l.Verifier
+	l.Verifier = verifierFunc(func(ctx context.Context, msg *gcisigner.UnverifiedMessage) (*gcisigner.VerifiedMessage, error) {
+		<-release
+		return serverVerifier.Verify(ctx, msg)
+	})
+	acceptAll(t, l)
+
+	go d.DialContext(context.Background(), l.Addr().Network(), l.Addr().String())
+	waitFor(t, func() bool { return l.AdmissionStats().InFlight == 1 })
+	queued := rawDial(t, l)
+
+	select {
+	case err := <-hooked:
+		if err.Stage != roast.HandshakeStageAdmission || !errors.Is(err, roast.ErrHandshakeQueueTimeout) {
+			t.Errorf("expected an admission failure with %v, got %v", roast.ErrHandshakeQueueTimeout, err)
+		}
+		if err.RemoteAddr.String() != queued.LocalAddr().String() {
+			t.Errorf("expected the failure to be from %v, got %v", queued.LocalAddr(), err.RemoteAddr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the hook")
+	}
+}
+
+func TestAcceptHandshakedOnly(t *testing.T) {
+	l, d := localValidListenerAndDialer(t)
+	if err := roast.WithAcceptHandshakedOnly()(l); err != nil {
+		t.Fatal(err)
+	}
+
+	failed := make(chan *roast.HandshakeError, 1)
+	if err := roast.WithHandshakeErrorHook(func(err *roast.HandshakeError) { failed <- err })(l); err != nil {
+		t.Fatal(err)
+	}
+	accepted := acceptAll(t, l)
+
+	// A client that fails its handshake is never returned by Accept...
+	bad := rawDial(t, l)
+	io.WriteString(bad, "GET / HTTP/1.1\r\n\r\n")
+	select {
+	case <-failed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the handshake to fail")
+	}
+	// (it is closed, with or without a reset, rather than left hanging)
+	bad.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(bad); errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Error("expected the failed connection to be closed")
+	}
+
+	// ...but one that succeeds is, already handshaked
+	client, err := d.DialContext(context.Background(), l.Addr().Network(), l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	select {
+	case c := <-accepted:
+		if peer := c.(*roast.Conn).Peer; peer == nil {
+			t.Error("expected the accepted connection to have finished its handshake")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the connection to be accepted")
+	}
+
+	select {
+	case c := <-accepted:
+		t.Errorf("expected only one connection to be accepted, also got one from %v", c.RemoteAddr())
+	default:
+	}
+
+	// Once the Listener is closed, Accept says so
+	l.Close()
+	if _, err := l.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("expected %v, got %v", net.ErrClosed, err)
+	}
+}
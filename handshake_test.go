@@ -0,0 +1,163 @@
+package roast_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	roast "github.com/thomasdesr/roast"
+	"github.com/thomasdesr/roast/gcisigner"
+	"github.com/thomasdesr/roast/gcisigner/source_verifiers/sources"
+)
+
+func TestHelloVerificationIsConcurrent(t *testing.T) {
+	l, d := localValidListenerAndDialer(t)
+
+	// The server refuses to finish verifying the client until the client has
+	// started verifying the server, which can only happen if the server sent
+	// its hello without waiting on its own verification.
+	clientVerifying := make(chan struct{})
+	serverVerifier, clientVerifier := l.Verifier, d.Verifier
+
+	l.Verifier = verifierFunc(func(ctx context.Context, msg *gcisigner.UnverifiedMessage) (*gcisigner.VerifiedMessage, error) {
+		select {
+		case <-clientVerifying:
+		case <-time.After(5 * time.Second):
+			return nil, errors.New("client never started verifying our hello")
+		}
+		return serverVerifier.Verify(ctx, msg)
+	})
+	d.Verifier = verifierFunc(func(ctx context.Context, msg *gcisigner.UnverifiedMessage) (*gcisigner.VerifiedMessage, error) {
+		close(clientVerifying)
+		return clientVerifier.Verify(ctx, msg)
+	})
+
+	server, client := upgradePair(t, l.UpgradeServerConn, d.UpgradeClientConn)
+	if server.err != nil || client.err != nil {
+		t.Fatalf("handshake failed: server=%v client=%v", server.err, client.err)
+	}
+}
+
+func TestServerRejectionAfterHelloStopsTLS(t *testing.T) {
+	l, d := localValidListenerAndDialer(t)
+
+	// Only reject the client once it has already accepted our hello, so the
+	// rejection has to land in the middle of its TLS handshake.
+	clientVerified := make(chan struct{})
+	clientVerifier := d.Verifier
+
+	l.Verifier = verifierFunc(func(ctx context.Context, msg *gcisigner.UnverifiedMessage) (*gcisigner.VerifiedMessage, error) {
+		<-clientVerified
+		return nil, fmt.Errorf("%w: not on the list", gcisigner.ErrInvalidSource)
+	})
+	d.Verifier = verifierFunc(func(ctx context.Context, msg *gcisigner.UnverifiedMessage) (*gcisigner.VerifiedMessage, error) {
+		defer close(clientVerified)
+		return clientVerifier.Verify(ctx, msg)
+	})
+
+	server, client := upgradePair(t, l.UpgradeServerConn, d.UpgradeClientConn)
+	if !errors.Is(server.err, gcisigner.ErrInvalidSource) {
+		t.Errorf("expected server to fail with %v, got %v", gcisigner.ErrInvalidSource, server.err)
+	}
+
+	var alertErr *roast.AlertError
+	if !errors.As(client.err, &alertErr) || alertErr.Category != roast.AlertPeerRoleNotAllowed {
+		t.Fatalf("expected client TLS to fail with a %q alert, got %v", roast.AlertPeerRoleNotAllowed, client.err)
+	}
+}
+
+func TestPeerSessionName(t *testing.T) {
+	l, d := localValidListenerAndDialer(t)
+
+	server, client := upgradePair(t, l.UpgradeServerConn, d.UpgradeClientConn)
+	if server.err != nil || client.err != nil {
+		t.Fatalf("handshake failed: server=%v client=%v", server.err, client.err)
+	}
+
+	if server.peer.SessionName != "ClientRoleSession" || client.peer.SessionName != "ServerRoleSession" {
+		t.Errorf("expected each side to see the other's session name, got server=%q client=%q", server.peer.SessionName, client.peer.SessionName)
+	}
+	if server.peer.PrincipalType != sources.PrincipalAssumedRole || client.peer.PrincipalType != sources.PrincipalAssumedRole {
+		t.Errorf("expected both peers to be assumed roles, got server=%q client=%q", server.peer.PrincipalType, client.peer.PrincipalType)
+	}
+}
+
+func TestPeerSSOUserNeedsPermissionSetMatch(t *testing.T) {
+	const caller = "arn:aws:sts::123456789012:assumed-role/AWSReservedSSO_Admin_0123456789abcdef/jane@example.com"
+	admin, err := sources.NewPermissionSet("aws", "123456789012", "Admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name              string
+		matchedRule       string
+		wantUser          string
+		wantPermissionSet string
+	}{
+		// Anyone can create a role with a look-alike name, so unless the
+		// permission set matcher checked its path it's just a role
+		{"look-alike name", "", "", ""},
+		{"matched permission set", admin.String(), "jane@example.com", "Admin"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			l, d := localValidListenerAndDialer(t)
+
+			gcis := l.Verifier.(*fakeGCIS)
+			gcis.callerIdentity.Arn = caller
+			l.Verifier = verifierFunc(func(ctx context.Context, msg *gcisigner.UnverifiedMessage) (*gcisigner.VerifiedMessage, error) {
+				verified, err := gcis.Verify(ctx, msg)
+				if err != nil {
+					return nil, err
+				}
+				verified.MatchedRule = tt.matchedRule
+				return verified, nil
+			})
+
+			server, client := upgradePair(t, l.UpgradeServerConn, d.UpgradeClientConn)
+			if server.err != nil || client.err != nil {
+				t.Fatalf("handshake failed: server=%v client=%v", server.err, client.err)
+			}
+
+			if server.peer.SSOUserName != tt.wantUser {
+				t.Errorf("expected SSO user %q, got %q", tt.wantUser, server.peer.SSOUserName)
+			}
+			if server.peer.PermissionSet != tt.wantPermissionSet {
+				t.Errorf("expected permission set %q, got %q", tt.wantPermissionSet, server.peer.PermissionSet)
+			}
+		})
+	}
+}
+
+// BenchmarkHandshake compares a sequential ProtocolVersion1 handshake with a
+// concurrent ProtocolVersion2 one when every STS call takes stsLatency. The
+// former should take about two round trips to STS, the latter about one.
+func BenchmarkHandshake(b *testing.B) {
+	const stsLatency = 20 * time.Millisecond
+
+	for _, version := range []roast.ProtocolVersion{roast.ProtocolVersion1, roast.ProtocolVersion2} {
+		b.Run(fmt.Sprintf("v%d", version), func(b *testing.B) {
+			l, d := localValidListenerAndDialer(b)
+			l.Verifier.(*fakeGCIS).latency = stsLatency
+			d.Verifier.(*fakeGCIS).latency = stsLatency
+
+			d = pinnedDialer(b, d, version)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				server, client := upgradePair(b, l.UpgradeServerConn, d.UpgradeClientConn)
+				if server.err != nil || client.err != nil {
+					b.Fatalf("handshake failed: server=%v client=%v", server.err, client.err)
+				}
+			}
+		})
+	}
+}
+
+type verifierFunc func(ctx context.Context, msg *gcisigner.UnverifiedMessage) (*gcisigner.VerifiedMessage, error)
+
+func (f verifierFunc) Verify(ctx context.Context, msg *gcisigner.UnverifiedMessage) (*gcisigner.VerifiedMessage, error) {
+	return f(ctx, msg)
+}
@@ -0,0 +1,69 @@
+// Package logutil holds the structured logging helpers shared by roast's
+// packages and commands.
+package logutil
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// Discard is the logger used when none has been configured.
+var Discard = slog.New(slog.DiscardHandler)
+
+// OrDiscard returns `l`, or Discard if it's nil.
+func OrDiscard(l *slog.Logger) *slog.Logger {
+	if l == nil {
+		return Discard
+	}
+	return l
+}
+
+// Redacted replaces the value of any attribute that holds a secret.
+const Redacted = "[REDACTED]"
+
+// secretKeys are the (lower-cased) attribute keys whose values are always
+// redacted, whatever they were logged as.
+var secretKeys = map[string]bool{
+	"amzauthorization":     true,
+	"authorization":        true,
+	"xamzsecuritytoken":    true,
+	"x-amz-security-token": true,
+	"mask":                 true,
+	"secret":               true,
+	"secretaccesskey":      true,
+	"sessiontoken":         true,
+}
+
+// Redact is a slog.HandlerOptions.ReplaceAttr that redacts attributes whose
+// keys name secrets, as a backstop for values that don't redact themselves.
+func Redact(_ []string, a slog.Attr) slog.Attr {
+	if secretKeys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, Redacted)
+	}
+	return a
+}
+
+// New returns a logger writing to `w` in `format` ("text" or "json") at
+// `level` ("debug", "info", "warn" or "error"), which redacts secrets.
+func New(w io.Writer, format, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q: must be debug, info, warn or error", level)
+	}
+
+	opts := &slog.HandlerOptions{
+		Level:       lvl,
+		ReplaceAttr: Redact,
+	}
+
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q: must be text or json", format)
+	}
+}
@@ -0,0 +1,250 @@
+// Package metrics is a minimal set of labelled counters, gauges and histograms
+// that can be written out in the Prometheus text exposition format, so that
+// roast doesn't need to depend on a metrics client library.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Registry is a set of metrics that are written out together.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+type metric interface {
+	writeTo(w *bufio.Writer)
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+// WriteText writes every metric in `r` to `w` in the Prometheus text format.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	metrics := slices.Clone(r.metrics)
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.writeTo(bw)
+	}
+	return bw.Flush()
+}
+
+// family holds the values of one metric for each combination of label values
+// it has been used with.
+type family[V any] struct {
+	name, help, typ string
+	labels          []string
+
+	mu     sync.Mutex
+	values map[string]*V
+}
+
+func newFamily[V any](r *Registry, typ, name, help string, labels []string) *family[V] {
+	f := &family[V]{
+		name:   name,
+		help:   help,
+		typ:    typ,
+		labels: labels,
+		values: make(map[string]*V),
+	}
+	r.register(f)
+	return f
+}
+
+// get returns the value for `labelValues`, which must match the family's
+// labels, creating it if need be. The family's lock must be held.
+func (f *family[V]) get(labelValues []string) *V {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s has %d labels, got %d values", f.name, len(f.labels), len(labelValues)))
+	}
+
+	key := formatLabels(f.labels, labelValues)
+	v, ok := f.values[key]
+	if !ok {
+		v = new(V)
+		f.values[key] = v
+	}
+	return v
+}
+
+func (f *family[V]) writeTo(w *bufio.Writer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.typ)
+
+	keys := make([]string, 0, len(f.values))
+	for k := range f.values {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	for _, k := range keys {
+		switch v := any(f.values[k]).(type) {
+		case *float64:
+			fmt.Fprintf(w, "%s%s %s\n", f.name, braced(k), formatFloat(*v))
+		case *histogramValue:
+			v.writeTo(w, f.name, k)
+		}
+	}
+}
+
+// Counter is a value that only goes up, such as a count of events.
+type Counter struct {
+	f *family[float64]
+}
+
+// NewCounter registers a counter called `name` with `r`, which is labelled by
+// `labels`.
+func NewCounter(r *Registry, name, help string, labels ...string) *Counter {
+	return &Counter{newFamily[float64](r, "counter", name, help, labels)}
+}
+
+// Inc adds one to the counter for `labelValues`.
+func (c *Counter) Inc(labelValues ...string) {
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+	*c.f.get(labelValues)++
+}
+
+// Gauge is a value that can go up and down, such as a number of connections.
+type Gauge struct {
+	f *family[float64]
+}
+
+// NewGauge registers a gauge called `name` with `r`, which is labelled by
+// `labels`.
+func NewGauge(r *Registry, name, help string, labels ...string) *Gauge {
+	return &Gauge{newFamily[float64](r, "gauge", name, help, labels)}
+}
+
+// Add adds `delta` to the gauge for `labelValues`, dropping it once it gets
+// back to zero so short-lived label values don't build up.
+func (g *Gauge) Add(delta float64, labelValues ...string) {
+	g.f.mu.Lock()
+	defer g.f.mu.Unlock()
+
+	v := g.f.get(labelValues)
+	if *v += delta; *v == 0 {
+		delete(g.f.values, formatLabels(g.f.labels, labelValues))
+	}
+}
+
+// Histogram counts observations, such as latencies, into buckets.
+type Histogram struct {
+	f       *family[histogramValue]
+	buckets []float64
+}
+
+// DefBuckets are histogram buckets, in seconds, suitable for network calls.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// NewHistogram registers a histogram called `name` with `r`, which is labelled
+// by `labels` and counts observations into `buckets` (upper bounds, in
+// increasing order).
+func NewHistogram(r *Registry, name, help string, buckets []float64, labels ...string) *Histogram {
+	return &Histogram{
+		f:       newFamily[histogramValue](r, "histogram", name, help, labels),
+		buckets: buckets,
+	}
+}
+
+// Observe records `v` in the histogram for `labelValues`.
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.f.mu.Lock()
+	defer h.f.mu.Unlock()
+
+	hv := h.f.get(labelValues)
+	if hv.counts == nil {
+		hv.buckets = h.buckets
+		hv.counts = make([]uint64, len(h.buckets))
+	}
+
+	for i, upper := range hv.buckets {
+		if v <= upper {
+			hv.counts[i]++
+		}
+	}
+	hv.count++
+	hv.sum += v
+}
+
+type histogramValue struct {
+	buckets []float64
+	counts  []uint64 // cumulative
+	count   uint64
+	sum     float64
+}
+
+func (h *histogramValue) writeTo(w *bufio.Writer, name, labels string) {
+	for i, upper := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, braced(joinLabels(labels, formatLabels([]string{"le"}, []string{formatFloat(upper)}))), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket%s %d\n", name, braced(joinLabels(labels, `le="+Inf"`)), h.count)
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, braced(labels), formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, braced(labels), h.count)
+}
+
+// formatLabels renders label pairs as they appear between braces.
+func formatLabels(names, values []string) string {
+	var b strings.Builder
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(values[i]))
+		b.WriteByte('"')
+	}
+	return b.String()
+}
+
+func joinLabels(a, b string) string {
+	if a == "" {
+		return b
+	}
+	return a + "," + b
+}
+
+func braced(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
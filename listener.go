@@ -3,13 +3,14 @@ package roast
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws/arn"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/thomasdesr/roast/gcisigner"
-	"github.com/thomasdesr/roast/gcisigner/source_verifiers"
 	"github.com/thomasdesr/roast/internal/errorutil"
 )
 
@@ -19,11 +20,31 @@ type Listener struct {
 	Signer   gcisigner.Signer
 	Verifier gcisigner.Verifier
 
+	hs handshakeConfig
+
 	// Total time to allow clients to complete a handshake before abandoning the
 	// connection.
 	handshakeTimeout time.Duration
+
+	// admission, if set, limits the connections we take on
+	admission *admission
+
+	// onHandshakeError, if set, is told about every handshake that fails
+	onHandshakeError func(*HandshakeError)
+
+	// handshakedOnly makes Accept return only connections that have finished
+	// their handshake, which a background loop started by the first Accept
+	// hands over on ready.
+	handshakedOnly bool
+	acceptLoop     sync.Once
+	ready          chan *Conn
+	acceptDone     chan struct{}
+	acceptErr      error
 }
 
+// NewListener returns a Listener that accepts clients matching one of
+// `allowedClientRoles`: roles, which may be wildcarded, IAM users, federated
+// users or account roots, see source_verifiers.MatchesAnyPrincipal.
 func NewListener(l net.Listener, allowedClientRoles []arn.ARN, opts ...Option[Listener]) (*Listener, error) {
 	rl := &Listener{
 		Listener: l,
@@ -50,26 +71,58 @@ func NewListener(l net.Listener, allowedClientRoles []arn.ARN, opts ...Option[Li
 	}
 
 	if rl.Verifier == nil {
-		allowedClients, err := parseRolesToSources(allowedClientRoles)
+		sourceVerifier, err := rl.hs.defaultSourceVerifier(allowedClientRoles)
 		if err != nil {
 			return nil, errorutil.Wrap(err, "failed to parse allowed client roles")
 		}
 
-		rl.Verifier = gcisigner.NewVerifier(source_verifiers.MatchesAny(allowedClients), nil)
+		rl.Verifier = gcisigner.NewVerifier(sourceVerifier, nil, gcisigner.WithLogger(rl.hs.log()))
 	}
 
 	return rl, nil
 }
 
+// Accept waits for and returns the next connection to the Listener. Its
+// handshake runs in the background, and any error from it is returned by the
+// connection's first Read or Write, unless WithAcceptHandshakedOnly is set.
 func (l *Listener) Accept() (net.Conn, error) {
-	conn, err := l.Listener.Accept()
-	if err != nil {
-		return nil, err
+	if l.handshakedOnly {
+		return l.acceptHandshaked()
+	}
+
+	return l.accept()
+}
+
+func (l *Listener) accept() (*Conn, error) {
+	var conn net.Conn
+	for {
+		var err error
+		conn, err = l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		// Connections over our limits are turned away before we've spent
+		// anything on them
+		if l.admission == nil || l.admission.admit(conn) {
+			break
+		}
+		l.hs.log().Debug("connection rejected by admission control", "remote_addr", conn.RemoteAddr().String())
+		conn.Close()
+	}
+
+	handshakeFunc := l.UpgradeServerConn
+	if l.admission != nil {
+		handshakeFunc = l.admittedUpgrade
 	}
 
 	c := &Conn{
 		Conn:          conn,
-		handshakeFunc: l.UpgradeServerConn,
+		handshakeFunc: handshakeFunc,
+		side:          sideServer,
+		wrap: func(tlsConn *tls.Conn, peer *PeerMetadata) net.Conn {
+			return l.hs.reattest(tlsConn, peer, l.Signer, l.Verifier)
+		},
 	}
 
 	// Proactively trigger a handshake, and ignore any errors (they'll be
@@ -79,20 +132,142 @@ func (l *Listener) Accept() (net.Conn, error) {
 	return c, nil
 }
 
+// acceptHandshaked returns the next connection whose handshake succeeded,
+// or the error the underlying Listener failed with.
+func (l *Listener) acceptHandshaked() (net.Conn, error) {
+	l.acceptLoop.Do(func() {
+		l.ready = make(chan *Conn)
+		l.acceptDone = make(chan struct{})
+		go l.handshakeLoop()
+	})
+
+	select {
+	case c := <-l.ready:
+		return c, nil
+	case <-l.acceptDone:
+		return nil, l.acceptErr
+	}
+}
+
+// handshakeLoop accepts connections until the underlying Listener fails,
+// handing over those that complete their handshake and closing the rest.
+func (l *Listener) handshakeLoop() {
+	defer close(l.acceptDone)
+
+	for {
+		c, err := l.accept()
+		if err != nil {
+			l.acceptErr = err
+			return
+		}
+
+		go func() {
+			if err := c.HandshakeContext(context.Background()); err != nil {
+				c.Close()
+				return
+			}
+
+			select {
+			case l.ready <- c:
+			case <-l.acceptDone:
+				c.Close()
+			}
+		}()
+	}
+}
+
+// AdmissionStats returns the counters for the Listener's admission control,
+// which are all zero if it has none.
+func (l *Listener) AdmissionStats() AdmissionStats {
+	if l.admission == nil {
+		return AdmissionStats{}
+	}
+	return l.admission.stats()
+}
+
+// admittedUpgrade is UpgradeServerConn for connections that were admitted,
+// waiting for a free handshake slot first. The wait counts against the
+// handshake timeout.
+func (l *Listener) admittedUpgrade(ctx context.Context, c net.Conn) (tlsConn *tls.Conn, peer *PeerMetadata, err error) {
+	deadline := time.Now().Add(l.handshakeTimeout)
+	err = l.admission.handshake(ctx, deadline, func() error {
+		tlsConn, peer, err = l.upgradeServerConn(ctx, c, deadline)
+		return err
+	})
+
+	// Errors from the handshake itself have already been reported
+	var herr *HandshakeError
+	if err != nil && !errors.As(err, &herr) {
+		err = l.handshakeFailed(c, HandshakeStageAdmission, err)
+	}
+	return tlsConn, peer, err
+}
+
+// handshakeFailed reports a failed handshake with `c` to the error hook and
+// returns it as a HandshakeError.
+func (l *Listener) handshakeFailed(c net.Conn, stage HandshakeStage, err error) error {
+	herr := &HandshakeError{
+		RemoteAddr: c.RemoteAddr(),
+		Stage:      stage,
+		Err:        err,
+	}
+
+	if l.onHandshakeError != nil {
+		l.onHandshakeError(herr)
+	}
+
+	return herr
+}
+
 func (l *Listener) UpgradeServerConn(ctx context.Context, c net.Conn) (*tls.Conn, *PeerMetadata, error) {
+	return l.upgradeServerConn(ctx, c, time.Now().Add(l.handshakeTimeout))
+}
+
+// upgradeServerConn is UpgradeServerConn, giving up on the handshake at
+// `deadline`.
+func (l *Listener) upgradeServerConn(ctx context.Context, c net.Conn, deadline time.Time) (_ *tls.Conn, _ *PeerMetadata, err error) {
 	// Enforce the handshake timeout
-	c.SetDeadline(time.Now().Add(l.handshakeTimeout))
+	c.SetDeadline(deadline)
 	defer c.SetDeadline(time.Time{})
 
-	tlsConf, peerMetadata, err := serverHandshake(ctx, c, l.Signer, l.Verifier)
+	tr := l.hs.tracer(ctx)
+	doneHandshake := tr.stage(handshakeHooks)
+	defer func() { doneHandshake(err) }()
+
+	var (
+		started      = time.Now()
+		connID       = newConnectionID()
+		peerMetadata *PeerMetadata
+	)
+	handshakesStarted.Inc(sideServer)
+	defer func() {
+		var herr *HandshakeError
+		errors.As(err, &herr)
+		recordHandshake(sideServer, herr.stage(), err)
+		l.hs.logHandshake(ctx, sideServer, c, started, herr.stage(), peerMetadata, err)
+		l.hs.audit(ctx, sideServer, connID, c, herr.stage(), peerMetadata, err)
+	}()
+
+	tlsConf, peerMetadata, err := serverHandshake(ctx, c, l.Signer, l.Verifier, &l.hs)
+	if err != nil {
+		return nil, nil, l.handshakeFailed(c, roastHandshakeStage(err), errorutil.Wrap(err, "failed to complete a roast handshake"))
+	}
+
+	// Clients that reject our hello say why in place of their TLS ClientHello
+	tlsConn := tls.Server(&alertConn{Conn: c}, tlsConf)
+
+	doneTLS := tr.stage(tlsHooks)
+	err = tlsConn.HandshakeContext(ctx)
+	doneTLS(err)
 	if err != nil {
-		return nil, nil, errorutil.Wrap(err, "failed to complete a roast handshake")
+		return nil, nil, l.handshakeFailed(c, HandshakeStageTLS, errorutil.Wrap(err, "failed to complete a tls handshake"))
 	}
 
-	tlsConn := tls.Server(c, tlsConf)
+	l.hs.stampHandshake(peerMetadata)
+	peerMetadata.ConnectionID = connID
 
-	if err := tlsConn.HandshakeContext(ctx); err != nil {
-		return nil, nil, errorutil.Wrap(err, "failed to complete a tls handshake")
+	if l.hs.resumption != nil {
+		l.hs.resumption.remember("", tlsConn, peerMetadata)
 	}
 
 	return tlsConn, peerMetadata, nil
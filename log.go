@@ -0,0 +1,48 @@
+package roast
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/thomasdesr/roast/internal/logutil"
+)
+
+// log returns the logger to use, which discards everything if none was set
+// with WithLogger.
+func (hc *handshakeConfig) log() *slog.Logger {
+	return logutil.OrDiscard(hc.logger)
+}
+
+// logHandshake logs the outcome of a handshake over `c` that started at
+// `started`: failures, at `stage`, at Warn and successes at Debug.
+func (hc *handshakeConfig) logHandshake(ctx context.Context, side string, c net.Conn, started time.Time, stage HandshakeStage, peer *PeerMetadata, err error) {
+	attrs := []slog.Attr{
+		slog.String("side", side),
+		slog.String("remote_addr", c.RemoteAddr().String()),
+		slog.Duration("duration", time.Since(started)),
+	}
+
+	if err != nil {
+		hc.log().LogAttrs(ctx, slog.LevelWarn, "roast handshake failed", append(attrs,
+			slog.String("stage", string(stage)),
+			slog.Any("error", err),
+		)...)
+		return
+	}
+
+	hc.log().LogAttrs(ctx, slog.LevelDebug, "roast handshake completed", append(attrs, peerAttrs(peer)...)...)
+}
+
+// peerAttrs are the fields logged to identify a peer.
+func peerAttrs(peer *PeerMetadata) []slog.Attr {
+	return []slog.Attr{
+		slog.String("connection_id", peer.ConnectionID),
+		slog.String("peer_arn", peer.Role.String()),
+		slog.String("account", peer.AccountID),
+		slog.String("principal_type", string(peer.PrincipalType)),
+		slog.Int("protocol_version", int(peer.ProtocolVersion)),
+		slog.Bool("resumed", peer.Resumed),
+	}
+}
@@ -0,0 +1,77 @@
+package roast_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"testing"
+
+	roast "github.com/thomasdesr/roast"
+	"github.com/thomasdesr/roast/gcisigner"
+)
+
+func TestLogger(t *testing.T) {
+	l, d := localValidListenerAndDialer(t)
+
+	logs := &logBuffer{}
+	logger := slog.New(slog.NewJSONHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	if err := roast.WithLogger[roast.Listener](logger)(l); err != nil {
+		t.Fatal(err)
+	}
+
+	server, client := upgradePair(t, l.UpgradeServerConn, d.UpgradeClientConn)
+	if server.err != nil || client.err != nil {
+		t.Fatalf("handshake failed: server=%v client=%v", server.err, client.err)
+	}
+
+	l.Verifier = failingVerifier{gcisigner.ErrInvalidSource}
+	upgradePair(t, l.UpgradeServerConn, d.UpgradeClientConn)
+
+	records := logs.records(t)
+	if len(records) != 2 {
+		t.Fatalf("expected 2 log records, got %v", records)
+	}
+
+	completed, failed := records[0], records[1]
+	if completed["msg"] != "roast handshake completed" || completed["peer_arn"] != server.peer.Role.String() || completed["side"] != "server" {
+		t.Errorf("unexpected record for a completed handshake: %v", completed)
+	}
+	if failed["msg"] != "roast handshake failed" || failed["level"] != "WARN" || failed["stage"] != string(roast.HandshakeStageSource) {
+		t.Errorf("unexpected record for a failed handshake: %v", failed)
+	}
+	for _, record := range records {
+		if record["remote_addr"] == nil || record["duration"] == nil {
+			t.Errorf("expected every record to have a remote address and duration: %v", record)
+		}
+	}
+}
+
+// logBuffer collects the JSON records written by a slog.JSONHandler.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) records(t *testing.T) []map[string]any {
+	t.Helper()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var records []map[string]any
+	for dec := json.NewDecoder(bytes.NewReader(b.buf.Bytes())); dec.More(); {
+		var record map[string]any
+		if err := dec.Decode(&record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
@@ -0,0 +1,83 @@
+package roast
+
+import (
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/thomasdesr/roast/gcisigner"
+	"github.com/thomasdesr/roast/internal/metrics"
+)
+
+// The sides of a handshake or connection, as they appear in metric labels.
+const (
+	sideClient = "client"
+	sideServer = "server"
+)
+
+var metricsRegistry = &metrics.Registry{}
+
+var (
+	handshakesStarted = metrics.NewCounter(metricsRegistry,
+		"roast_handshakes_started_total",
+		"Handshakes started, by side (client or server).",
+		"side")
+
+	handshakesSucceeded = metrics.NewCounter(metricsRegistry,
+		"roast_handshakes_succeeded_total",
+		"Handshakes that succeeded, by side.",
+		"side")
+
+	handshakesFailed = metrics.NewCounter(metricsRegistry,
+		"roast_handshakes_failed_total",
+		"Handshakes that failed, by side and the stage they failed at.",
+		"side", "reason")
+
+	certificateGeneration = metrics.NewHistogram(metricsRegistry,
+		"roast_certificate_generation_seconds",
+		"How long generating each of our certificates took, by algorithm.",
+		[]float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1},
+		"algorithm")
+
+	activeConnections = metrics.NewGauge(metricsRegistry,
+		"roast_active_connections",
+		"Connections that have completed their handshake and not yet been closed, by side and the role of the peer.",
+		"side", "peer_role")
+)
+
+// WriteMetrics writes the metrics of this package and gcisigner to `w` in the
+// Prometheus text exposition format.
+func WriteMetrics(w io.Writer) error {
+	if err := metricsRegistry.WriteText(w); err != nil {
+		return err
+	}
+	return gcisigner.WriteMetrics(w)
+}
+
+// recordHandshake counts the outcome of a handshake that failed at `stage`
+// with `err`, or succeeded if `err` is nil.
+func recordHandshake(side string, stage HandshakeStage, err error) {
+	if err != nil {
+		handshakesFailed.Inc(side, string(stage))
+		return
+	}
+	handshakesSucceeded.Inc(side)
+}
+
+// trackActive counts a connection to `peer` as active until the returned
+// function is called.
+func trackActive(side string, peer *PeerMetadata) func() {
+	role := peerRoleLabel(peer.Role)
+	activeConnections.Add(1, side, role)
+	return func() { activeConnections.Add(-1, side, role) }
+}
+
+// peerRoleLabel is the role a peer connected as, without the session name
+// that makes every assumed-role ARN unique.
+func peerRoleLabel(role arn.ARN) string {
+	if name, ok := strings.CutPrefix(role.Resource, "assumed-role/"); ok {
+		name, _, _ = strings.Cut(name, "/")
+		role.Resource = "assumed-role/" + name
+	}
+	return role.String()
+}
@@ -0,0 +1,86 @@
+package roast_test
+
+import (
+	"bufio"
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+
+	roast "github.com/thomasdesr/roast"
+	"github.com/thomasdesr/roast/gcisigner"
+)
+
+func TestMetrics(t *testing.T) {
+	l, d := localValidListenerAndDialer(t)
+
+	const (
+		clientStarted   = `roast_handshakes_started_total{side="client"}`
+		serverSucceeded = `roast_handshakes_succeeded_total{side="server"}`
+		serverFailed    = `roast_handshakes_failed_total{side="server",reason="source verification"}`
+		certificates    = `roast_certificate_generation_seconds_count{algorithm="ecdsa-p256"}`
+
+		// Session names are left out so each role is one series
+		activeToServer = `roast_active_connections{side="client",peer_role="arn:aws:sts::1234567890:assumed-role/ServerRole"}`
+		activeToClient = `roast_active_connections{side="server",peer_role="arn:aws:sts::1234567890:assumed-role/ClientRole"}`
+	)
+	before := readMetrics(t)
+
+	server, client := dialPair(t, l, d)
+
+	during := readMetrics(t)
+	for series, want := range map[string]float64{
+		clientStarted:   1,
+		serverSucceeded: 1,
+		certificates:    4, // A CA and leaf on each side
+		activeToServer:  1,
+		activeToClient:  1,
+	} {
+		if got := during[series] - before[series]; got != want {
+			t.Errorf("expected %s to go up by %v, got %v", series, want, got)
+		}
+	}
+
+	client.Close()
+	server.Close()
+
+	after := readMetrics(t)
+	for _, series := range []string{activeToServer, activeToClient} {
+		if after[series] != before[series] {
+			t.Errorf("expected %s to go back to %v once closed, got %v", series, before[series], after[series])
+		}
+	}
+
+	l.Verifier = failingVerifier{gcisigner.ErrInvalidSource}
+	upgradePair(t, l.UpgradeServerConn, d.UpgradeClientConn)
+
+	if got := readMetrics(t)[serverFailed] - after[serverFailed]; got != 1 {
+		t.Errorf("expected %s to go up by 1, got %v", serverFailed, got)
+	}
+}
+
+// readMetrics returns the current value of every series roast.WriteMetrics
+// writes.
+func readMetrics(t *testing.T) map[string]float64 {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := roast.WriteMetrics(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	values := map[string]float64{}
+	for s := bufio.NewScanner(&buf); s.Scan(); {
+		if strings.HasPrefix(s.Text(), "#") {
+			continue
+		}
+
+		i := strings.LastIndexByte(s.Text(), ' ')
+		v, err := strconv.ParseFloat(s.Text()[i+1:], 64)
+		if err != nil {
+			t.Fatalf("bad metric line %q: %v", s.Text(), err)
+		}
+		values[s.Text()[:i]] = v
+	}
+	return values
+}
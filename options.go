@@ -1,19 +1,33 @@
 package roast
 
 import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
 	"github.com/thomasdesr/roast/gcisigner"
+	"github.com/thomasdesr/roast/gcisigner/source_verifiers"
 	"github.com/thomasdesr/roast/internal/errorutil"
 )
 
 type Option[T any] func(opt *T) error
 
-// WithAWSConfig sets the AWS config to be used for signing requests
+// WithAWSConfig sets the AWS config to be used for signing requests. Hellos
+// are signed for STS's FIPS endpoint if the config asks for FIPS endpoints,
+// e.g. with AWS_USE_FIPS_ENDPOINT.
 func WithAWSConfig[T Dialer | Listener](config *aws.Config) Option[T] {
 	return func(opt *T) error {
-		signer, err := gcisigner.NewSigner(config.Region, config.Credentials)
+		var signerOpts []gcisigner.SignerOption
+		if sts.NewFromConfig(*config).Options().EndpointOptions.UseFIPSEndpoint == aws.FIPSEndpointStateEnabled {
+			signerOpts = append(signerOpts, gcisigner.WithFIPSEndpoint())
+		}
+
+		signer, err := gcisigner.NewSigner(config.Region, config.Credentials, signerOpts...)
 		if err != nil {
 			return errorutil.Wrap(err, "failed to create signer from config")
 		}
@@ -52,3 +66,340 @@ func WithHandshakeTimeout[T Dialer | Listener](timeout time.Duration) Option[T]
 		return nil
 	}
 }
+
+// WithProtocolVersions restricts the Roast protocol versions that will be
+// offered and accepted during the handshake. By default every version this
+// package knows about is enabled, which allows Dialers and Listeners of
+// different ages to keep talking to each other during a rollout.
+//
+// Once every peer has been upgraded, dropping ProtocolVersion1 prevents a peer
+// from being talked down to the original, unversioned handshake.
+func WithProtocolVersions[T Dialer | Listener](versions ...ProtocolVersion) Option[T] {
+	return func(opt *T) error {
+		if len(versions) == 0 {
+			return fmt.Errorf("at least one protocol version must be enabled")
+		}
+
+		for _, v := range versions {
+			if !v.isKnown() {
+				return fmt.Errorf("unsupported protocol version: %v", v)
+			}
+		}
+
+		handshakeConfigOf(opt).versions = slices.Clone(versions)
+		return nil
+	}
+}
+
+// WithSessionResumption lets a Dialer resume its sessions with Listeners it
+// has recently completed a handshake with, and a Listener accept them, which
+// skips the STS round trips a full handshake costs on each side. It only takes
+// effect when both the Dialer and the Listener opt in.
+//
+// A session can be resumed until `lifetime` after the peer was last verified
+// with STS, or DefaultSessionResumptionLifetime if `lifetime` is zero. Until
+// then the peer keeps being accepted even if, for example, its credentials are
+// revoked in the meantime, so keep it short. A verifier set with
+// WithSourceVerifier is still run on every resumption, so rules about where
+// the peer connects from keep being enforced.
+func WithSessionResumption[T Dialer | Listener](lifetime time.Duration) Option[T] {
+	return func(opt *T) error {
+		if lifetime < 0 {
+			return fmt.Errorf("session resumption lifetime must not be negative: %v", lifetime)
+		}
+		if lifetime == 0 {
+			lifetime = DefaultSessionResumptionLifetime
+		}
+
+		hc := handshakeConfigOf(opt)
+		hc.resumption = newSessionCache(lifetime)
+		if !slices.Contains(hc.capabilities, CapabilitySessionResumption) {
+			hc.capabilities = append(hc.capabilities, CapabilitySessionResumption)
+		}
+		return nil
+	}
+}
+
+// WithCertificateAlgorithms sets the key algorithms used for the ephemeral
+// certificates each side generates for a connection. The first algorithm is
+// used for our own certificates, and any of them are accepted from the peer.
+//
+// By default ECDSA P-256 certificates are generated and P-256, P-384 and
+// Ed25519 ones are accepted. Peers that don't accept each other's algorithms
+// fail the handshake with ErrCertificateAlgorithmNotAccepted.
+func WithCertificateAlgorithms[T Dialer | Listener](algs ...CertificateAlgorithm) Option[T] {
+	return func(opt *T) error {
+		if len(algs) == 0 {
+			return fmt.Errorf("at least one certificate algorithm must be enabled")
+		}
+
+		for _, a := range algs {
+			if !a.isKnown() {
+				return fmt.Errorf("unsupported certificate algorithm: %q", a)
+			}
+		}
+
+		handshakeConfigOf(opt).certAlgorithms = slices.Clone(algs)
+		return nil
+	}
+}
+
+// WithKeyExchanges restricts the TLS key exchange groups a connection may use,
+// in order of preference. By default the hybrid post-quantum X25519MLKEM768 is
+// preferred, falling back to X25519, P-256 and P-384.
+//
+// Peers with no group in common fail the handshake with
+// ErrNoCommonKeyExchange.
+func WithKeyExchanges[T Dialer | Listener](groups ...tls.CurveID) Option[T] {
+	return func(opt *T) error {
+		if len(groups) == 0 {
+			return fmt.Errorf("at least one key exchange must be enabled")
+		}
+
+		for _, g := range groups {
+			if !slices.Contains(supportedKeyExchanges, g) {
+				return fmt.Errorf("unsupported key exchange: %v", g)
+			}
+		}
+
+		handshakeConfigOf(opt).keyExchangeGroups = slices.Clone(groups)
+		return nil
+	}
+}
+
+// WithMaxConnectionAge limits how long a connection may be used for after its
+// handshake, so that peers have to authenticate again every so often. Without
+// it a connection lives on even after the peer's role is removed from the
+// allowed list or its credentials are revoked.
+//
+// Once a Conn reaches `maxAge` it is closed, sending the peer a TLS
+// close_notify so it sees a clean EOF, and further reads and writes fail with
+// ErrConnectionExpired. PeerMetadata.ExpiresAt says when that will happen,
+// which gives protocols on top a chance to wind the connection down first.
+// Connections upgraded with UpgradeClientConn or UpgradeServerConn have
+// ExpiresAt set, but enforcing it is up to the caller.
+func WithMaxConnectionAge[T Dialer | Listener](maxAge time.Duration) Option[T] {
+	return func(opt *T) error {
+		if maxAge <= 0 {
+			return fmt.Errorf("maximum connection age must be positive: %v", maxAge)
+		}
+
+		handshakeConfigOf(opt).maxConnectionAge = maxAge
+		return nil
+	}
+}
+
+// WithReattestation makes peers prove their AWS identity again every
+// `interval` over the existing connection, with a freshly signed
+// GetCallerIdentity message checked by the same Verifier as the handshake. The
+// connection is closed if the peer doesn't answer in time, fails
+// verification, or comes back as a different identity, after which reads and
+// writes fail with ErrReattestationFailed or ErrPeerIdentityChanged.
+// `onReattested`, if not nil, is called each time the peer passes, with
+// metadata describing it as it just re-attested.
+//
+// A new session of the role the peer had doesn't count as a different
+// identity, as refreshed credentials usually come with a new session name.
+// The metadata given to `onReattested` then has the new session's ARN and
+// SessionName, while the connection's PeerMetadata keeps describing the peer
+// as it was at the handshake.
+//
+// Re-attestation only works between peers that both opt in. A peer that
+// doesn't is given until its first re-attestation would have been due, as if
+// WithMaxConnectionAge had been set to `interval`. It only applies to
+// connections from DialContext or Accept; connections upgraded with
+// UpgradeClientConn or UpgradeServerConn directly can't take part.
+func WithReattestation[T Dialer | Listener](interval time.Duration, onReattested func(peer *PeerMetadata)) Option[T] {
+	return func(opt *T) error {
+		if interval <= 0 {
+			return fmt.Errorf("re-attestation interval must be positive: %v", interval)
+		}
+
+		hc := handshakeConfigOf(opt)
+		hc.reattestation = &reattestation{interval: interval, onReattested: onReattested}
+		if !slices.Contains(hc.capabilities, CapabilityReattestation) {
+			hc.capabilities = append(hc.capabilities, CapabilityReattestation)
+		}
+		return nil
+	}
+}
+
+// WithNextProtos sets the application protocols offered with ALPN during the
+// TLS handshake, in order of preference, e.g. "h2" and "http/1.1". The
+// protocol the peers agree on is available from Conn.NegotiatedProtocol, which
+// lets a single Listener serve several protocols.
+//
+// A Listener configured with protocols still accepts Dialers that offer none,
+// in which case nothing is negotiated. If both sides offer protocols but none
+// in common, the TLS handshake fails, except that crypto/tls lets a Dialer
+// that only offers "http/1.1" through with no protocol.
+func WithNextProtos[T Dialer | Listener](protos ...string) Option[T] {
+	return func(opt *T) error {
+		if len(protos) == 0 {
+			return fmt.Errorf("at least one application protocol must be given")
+		}
+
+		for _, p := range protos {
+			if len(p) == 0 || len(p) > 255 {
+				return fmt.Errorf("application protocol names must be 1 to 255 bytes long: %q", p)
+			}
+		}
+
+		handshakeConfigOf(opt).nextProtos = slices.Clone(protos)
+		return nil
+	}
+}
+
+// WithClaims attaches application-defined claims, such as a service name,
+// build version or deployment environment, to our hellos. They are signed
+// along with the rest of the hello, and the peer sees them in
+// PeerMetadata.Claims once it has verified us. Signing only proves which role
+// made a claim, not that it's true: anyone with credentials for an allowed role
+// can claim anything, so claims can narrow down what a trusted role may do but
+// never widen it.
+//
+// Claims are limited to MaxClaims entries of at most MaxClaimKeySize and
+// MaxClaimValueSize bytes each, and MaxClaimsSize bytes in total. Keys may
+// only contain letters, digits, '-', '_' and '.', and must differ in more than
+// case. Values may not contain control characters such as CR or LF.
+func WithClaims[T Dialer | Listener](claims Claims) Option[T] {
+	return func(opt *T) error {
+		if err := claims.validate(); err != nil {
+			return err
+		}
+
+		handshakeConfigOf(opt).claims = maps.Clone(claims)
+		return nil
+	}
+}
+
+// WithMaxInFlightHandshakes limits how many handshakes a Listener runs at once,
+// which bounds the goroutines and STS calls unauthenticated connections can
+// cost it. Connections beyond the limit queue for a free slot, see
+// WithHandshakeQueueDepth. Time spent in the queue counts against the
+// handshake timeout, and connections that use it all up there are closed.
+func WithMaxInFlightHandshakes(n int) Option[Listener] {
+	return func(l *Listener) error {
+		if n <= 0 {
+			return fmt.Errorf("maximum in-flight handshakes must be positive: %d", n)
+		}
+
+		a := admissionOf(l)
+		a.slots = make(chan struct{}, n)
+		return nil
+	}
+}
+
+// WithHandshakeQueueDepth sets how many connections may wait for a handshake
+// slot when WithMaxInFlightHandshakes is set. Any more are closed as soon as
+// they're accepted. It defaults to zero, so connections are only accepted
+// while there is a slot free for them.
+func WithHandshakeQueueDepth(n int) Option[Listener] {
+	return func(l *Listener) error {
+		if n < 0 {
+			return fmt.Errorf("handshake queue depth must not be negative: %d", n)
+		}
+
+		admissionOf(l).queueDepth = n
+		return nil
+	}
+}
+
+// WithPerSourceRateLimit limits how often each source IP may open new
+// connections to a Listener, with a token bucket that allows `burst`
+// connections at once and refills at `rate` per second. Connections over the
+// limit are closed as soon as they're accepted. IPv6 sources share a bucket
+// per /64, as a single host can usually pick any address in one.
+func WithPerSourceRateLimit(rate float64, burst int) Option[Listener] {
+	return func(l *Listener) error {
+		if rate <= 0 || burst <= 0 {
+			return fmt.Errorf("per-source rate limit must have a positive rate and burst: %v, %d", rate, burst)
+		}
+
+		admissionOf(l).sources = newSourceLimiter(rate, burst)
+		return nil
+	}
+}
+
+// WithHandshakeErrorHook calls `hook` with every handshake a Listener fails,
+// saying which stage it failed at and who the connection was from. The hook
+// is called from the handshake's goroutine, so it must be safe to call
+// concurrently and shouldn't block.
+func WithHandshakeErrorHook(hook func(err *HandshakeError)) Option[Listener] {
+	return func(l *Listener) error {
+		l.onHandshakeError = hook
+		return nil
+	}
+}
+
+// WithAcceptHandshakedOnly makes Accept return only connections that have
+// completed their handshake. Connections that fail it are closed without
+// being returned, use WithHandshakeErrorHook to hear about them.
+func WithAcceptHandshakedOnly() Option[Listener] {
+	return func(l *Listener) error {
+		l.handshakedOnly = true
+		return nil
+	}
+}
+
+// WithSourceVerifier has the default Verifier accept the peers that `v`
+// does, such as a compiled policy.Policy, in place of the allowed roles given
+// to NewDialer or NewListener, which must then be empty.
+func WithSourceVerifier[T Dialer | Listener](v source_verifiers.Verifier) Option[T] {
+	return func(opt *T) error {
+		handshakeConfigOf(opt).sourceVerifier = v
+		return nil
+	}
+}
+
+// WithHandshakeTrace runs `trace`'s hooks for every handshake, see
+// HandshakeTrace. Use AttachHandshakeTraceToContext instead to trace
+// individual handshakes.
+func WithHandshakeTrace[T Dialer | Listener](trace *HandshakeTrace) Option[T] {
+	return func(opt *T) error {
+		handshakeConfigOf(opt).trace = trace
+		return nil
+	}
+}
+
+// WithLogger logs handshakes, and other events on connections, to `logger`:
+// failures at Warn and successes at Debug. It is also given to the default
+// Verifier, if one isn't set. Nothing is logged without it.
+func WithLogger[T Dialer | Listener](logger *slog.Logger) Option[T] {
+	return func(opt *T) error {
+		handshakeConfigOf(opt).logger = logger
+		return nil
+	}
+}
+
+// WithAuditSink records the authorization decision made by every handshake,
+// allowed or denied, with `sink`. See FileAuditSink for one that writes them
+// to a file.
+func WithAuditSink[T Dialer | Listener](sink AuditSink) Option[T] {
+	return func(opt *T) error {
+		handshakeConfigOf(opt).auditSink = sink
+		return nil
+	}
+}
+
+// admissionOf returns the Listener's admission control, setting it up if
+// this is the first option to configure it.
+func admissionOf(l *Listener) *admission {
+	if l.admission == nil {
+		l.admission = &admission{}
+	}
+	return l.admission
+}
+
+// handshakeConfigOf returns the handshakeConfig embedded in a Dialer or
+// Listener.
+func handshakeConfigOf[T Dialer | Listener](opt *T) *handshakeConfig {
+	switch v := any(opt).(type) {
+	case *Dialer:
+		return &v.hs
+	case *Listener:
+		return &v.hs
+	default:
+		panic("unsupported type, generics have failed somehow?")
+	}
+}
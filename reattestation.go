@@ -0,0 +1,623 @@
+package roast
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/thomasdesr/roast/gcisigner"
+	"github.com/thomasdesr/roast/gcisigner/source_verifiers"
+	"github.com/thomasdesr/roast/gcisigner/source_verifiers/sources"
+	"github.com/thomasdesr/roast/internal/errorutil"
+)
+
+// Re-attestation makes each side of a long-lived connection prove its AWS
+// identity again on a schedule, without tearing the connection down.
+//
+// When both sides advertise CapabilityReattestation, everything sent over the
+// TLS connection is framed: application data goes in data frames, and every
+// interval each side challenges the other with a fresh nonce. The peer answers
+// with a newly signed GetCallerIdentity message whose payload carries the
+// nonce and a value exported from the TLS session for it, so the answer can't
+// be replayed on another connection or for another challenge. The challenger
+// verifies it with the same Verifier used for the handshake, and closes the
+// connection if that fails, no answer arrives in time, or the identity isn't
+// the one the peer had when the connection was set up.
+//
+// Data frames are flow controlled: each side may only have
+// reattestationWindow bytes of data unread by the other's application at
+// once, and is granted more with window update frames as it's read. So an
+// application that stops reading holds up its peer's writes, but never the
+// challenges and answers behind them.
+
+// CapabilityReattestation is advertised by peers that have opted in to
+// re-attestation with WithReattestation.
+const CapabilityReattestation Capability = "reattestation"
+
+const (
+	frameTypeData         frameType = 5
+	frameTypeChallenge    frameType = 6
+	frameTypeAttestation  frameType = 7
+	frameTypeWindowUpdate frameType = 8
+
+	reattestationExporterLabel = "EXPORTER-roast-reattestation"
+	reattestationBindingSize   = 32
+
+	// maxReattestationTimeout bounds how long we wait for the peer to answer
+	// a challenge, which includes it signing its answer and us verifying it.
+	maxReattestationTimeout = 30 * time.Second
+
+	// reattestationWindow is how much data each side may send that the
+	// other's application hasn't read yet.
+	reattestationWindow = 1 << 20
+)
+
+var (
+	// ErrReattestationFailed is returned by reads and writes on a connection
+	// that was closed because the peer didn't prove its identity again in
+	// time.
+	ErrReattestationFailed = errors.New("peer failed to re-attest its identity")
+
+	// ErrPeerIdentityChanged is returned by reads and writes on a connection
+	// that was closed because the peer re-attested as someone else. A new
+	// session of the role the peer had doesn't count.
+	ErrPeerIdentityChanged = errors.New("peer re-attested with a different identity")
+)
+
+// reattestation is how often to challenge the peer, and who to tell when it
+// passes.
+type reattestation struct {
+	interval     time.Duration
+	onReattested func(peer *PeerMetadata)
+}
+
+// timeout is how long the peer has to answer a challenge.
+func (r *reattestation) timeout() time.Duration {
+	return min(r.interval, maxReattestationTimeout)
+}
+
+// attestation is the signed payload a peer answers a challenge with.
+type attestation struct {
+	Nonce []byte
+
+	// Binding is exported from the TLS session with the nonce as context.
+	Binding []byte
+}
+
+// attestedConn frames everything sent over a TLS connection so that it can
+// carry re-attestation challenges and answers alongside application data.
+type attestedConn struct {
+	*tls.Conn
+
+	signer   gcisigner.Signer
+	verifier gcisigner.Verifier
+	config   *reattestation
+	logger   *slog.Logger
+
+	// A read loop demultiplexes frames from the TLS connection, buffering
+	// application data for Read. flowMu guards the buffer and both sides'
+	// windows, and ready is closed and replaced whenever any of them change.
+	flowMu        sync.Mutex
+	ready         chan struct{}
+	recvBuf       bytes.Buffer
+	recvErr       error // returned once recvBuf is drained
+	recvCredit    int   // how much more data the peer may send
+	recvConsumed  int   // data read since we last granted the peer more
+	sendWindow    int   // how much more data we may send
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	// sendMu serializes Writes, and writeMu the frames within them and
+	// control frames.
+	sendMu  sync.Mutex
+	writeMu sync.Mutex
+
+	// answering is set while we're answering one of the peer's challenges
+	answering atomic.Bool
+
+	mu       sync.Mutex
+	awaiting chan []byte // receives the answer to our outstanding challenge
+	err      error
+
+	// peer is who the peer last proved to be. It's only replaced by
+	// challenge, which can read it without holding mu.
+	peer *PeerMetadata
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// reattest sets up re-attestation on `tlsConn` if it was negotiated, and
+// returns the conn to use from then on.
+func (hc *handshakeConfig) reattest(tlsConn *tls.Conn, peer *PeerMetadata, signer gcisigner.Signer, verifier gcisigner.Verifier) net.Conn {
+	if hc.reattestation == nil || !slices.Contains(peer.Capabilities, CapabilityReattestation) {
+		return tlsConn
+	}
+
+	c := &attestedConn{
+		Conn: tlsConn,
+
+		signer:   signer,
+		verifier: verifier,
+		peer:     peer,
+		config:   hc.reattestation,
+		logger:   hc.log(),
+
+		ready:      make(chan struct{}),
+		recvCredit: reattestationWindow,
+		sendWindow: reattestationWindow,
+
+		done: make(chan struct{}),
+	}
+
+	go c.readLoop()
+	go c.challengeLoop()
+
+	return c
+}
+
+func (c *attestedConn) Read(b []byte) (int, error) {
+	c.flowMu.Lock()
+	for c.recvBuf.Len() == 0 {
+		if c.recvErr != nil {
+			err := c.recvErr
+			c.flowMu.Unlock()
+			return 0, c.failure(err)
+		}
+		if expired(c.readDeadline) {
+			c.flowMu.Unlock()
+			return 0, os.ErrDeadlineExceeded
+		}
+		c.wait(c.readDeadline)
+	}
+
+	n, _ := c.recvBuf.Read(b)
+
+	// Let the peer send more once it's worth a frame to say so
+	var grant int
+	c.recvConsumed += n
+	if c.recvConsumed >= reattestationWindow/2 {
+		grant, c.recvConsumed = c.recvConsumed, 0
+		c.recvCredit += grant
+	}
+	c.flowMu.Unlock()
+
+	if grant > 0 {
+		if err := c.writeControl(frameTypeWindowUpdate, binary.BigEndian.AppendUint32(nil, uint32(grant))); err != nil {
+			c.fail(err)
+		}
+	}
+
+	return n, nil
+}
+
+func (c *attestedConn) Write(b []byte) (int, error) {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	var written int
+	for written < len(b) {
+		n, err := c.reserve(min(len(b)-written, maxFrameSize))
+		if err != nil {
+			return written, c.failure(err)
+		}
+
+		c.writeMu.Lock()
+		err = writeFrame(c.Conn, frameTypeData, b[written:written+n])
+		c.writeMu.Unlock()
+		if err != nil {
+			return written, c.failure(err)
+		}
+		written += n
+	}
+
+	return written, nil
+}
+
+// reserve waits until the peer will take more data, and takes up to `want`
+// bytes of its window.
+func (c *attestedConn) reserve(want int) (int, error) {
+	c.flowMu.Lock()
+	defer c.flowMu.Unlock()
+
+	for c.sendWindow == 0 {
+		if c.recvErr != nil {
+			// Nothing will ever grant us more
+			return 0, io.ErrClosedPipe
+		}
+		if expired(c.writeDeadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		c.wait(c.writeDeadline)
+	}
+
+	n := min(want, c.sendWindow)
+	c.sendWindow -= n
+	return n, nil
+}
+
+// received buffers data the peer sent for Read.
+func (c *attestedConn) received(payload []byte) error {
+	c.flowMu.Lock()
+	defer c.flowMu.Unlock()
+
+	if len(payload) > c.recvCredit {
+		return errorutil.Wrap(ErrMalformedFrame, "peer sent more data than its window allows")
+	}
+	c.recvCredit -= len(payload)
+	c.recvBuf.Write(payload)
+	c.changed()
+
+	return nil
+}
+
+// granted adds to how much data we may send.
+func (c *attestedConn) granted(payload []byte) error {
+	if len(payload) != 4 {
+		return errorutil.Wrapf(ErrMalformedFrame, "window update must be 4 bytes, got %d", len(payload))
+	}
+
+	c.flowMu.Lock()
+	defer c.flowMu.Unlock()
+
+	c.sendWindow += int(binary.BigEndian.Uint32(payload))
+	c.changed()
+
+	return nil
+}
+
+// stopReceiving makes Read return `err` once it has read everything before
+// it, and Writes waiting on the peer give up.
+func (c *attestedConn) stopReceiving(err error) {
+	c.flowMu.Lock()
+	defer c.flowMu.Unlock()
+
+	if c.recvErr == nil {
+		c.recvErr = err
+	}
+	c.changed()
+}
+
+// changed wakes everything waiting on flowMu's state. Call with it held.
+func (c *attestedConn) changed() {
+	close(c.ready)
+	c.ready = make(chan struct{})
+}
+
+// wait waits, with flowMu held, for its state to change or `deadline` to
+// pass.
+func (c *attestedConn) wait(deadline time.Time) {
+	ready := c.ready
+	c.flowMu.Unlock()
+	defer c.flowMu.Lock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		t := time.NewTimer(time.Until(deadline))
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case <-ready:
+	case <-timeout:
+	}
+}
+
+// expired reports whether `deadline` is set and has passed.
+func expired(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+func (c *attestedConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.done)
+
+		c.flowMu.Lock()
+		c.recvBuf.Reset()
+		c.recvErr = net.ErrClosed
+		c.changed()
+		c.flowMu.Unlock()
+
+		err = c.Conn.Close()
+	})
+	return err
+}
+
+func (c *attestedConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *attestedConn) SetReadDeadline(t time.Time) error {
+	c.flowMu.Lock()
+	defer c.flowMu.Unlock()
+
+	c.readDeadline = t
+	c.changed()
+	return nil
+}
+
+func (c *attestedConn) SetWriteDeadline(t time.Time) error {
+	c.flowMu.Lock()
+	c.writeDeadline = t
+	c.changed()
+	c.flowMu.Unlock()
+
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// fail closes the connection because of `err`, which later reads and writes
+// return.
+func (c *attestedConn) fail(err error) {
+	c.mu.Lock()
+	first := c.err == nil
+	if first {
+		c.err = err
+	}
+	peer := c.peer
+	c.mu.Unlock()
+
+	if first && (errors.Is(err, ErrReattestationFailed) || errors.Is(err, ErrPeerIdentityChanged)) {
+		c.logger.LogAttrs(context.Background(), slog.LevelWarn, "closing connection, peer failed re-attestation", append(peerAttrs(peer),
+			slog.String("remote_addr", c.RemoteAddr().String()),
+			slog.Any("error", err),
+		)...)
+	}
+
+	c.Close()
+}
+
+// failure replaces `err` with the reason the connection was failed, if any.
+func (c *attestedConn) failure(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return c.err
+	}
+	return err
+}
+
+func (c *attestedConn) readLoop() {
+	for {
+		typ, payload, err := readFrame(c.Conn)
+		if err != nil {
+			// Let the application see the peer's EOF once it has read what
+			// came before it.
+			c.stopReceiving(io.EOF)
+			return
+		}
+
+		switch typ {
+		case frameTypeData:
+			if err := c.received(payload); err != nil {
+				c.fail(err)
+				return
+			}
+		case frameTypeWindowUpdate:
+			if err := c.granted(payload); err != nil {
+				c.fail(err)
+				return
+			}
+		case frameTypeChallenge:
+			// Only answer one challenge at a time, a peer that sends them
+			// faster than that will see the extras time out.
+			if c.answering.CompareAndSwap(false, true) {
+				go func() {
+					defer c.answering.Store(false)
+					if err := c.answer(payload); err != nil {
+						c.fail(errorutil.Wrap(err, "failed to answer re-attestation challenge"))
+					}
+				}()
+			}
+		case frameTypeAttestation:
+			c.mu.Lock()
+			awaiting := c.awaiting
+			c.awaiting = nil
+			c.mu.Unlock()
+
+			if awaiting == nil {
+				c.fail(errorutil.Wrap(ErrReattestationFailed, "peer sent an attestation we didn't ask for"))
+				return
+			}
+			awaiting <- payload
+		default:
+			c.fail(errorutil.Wrapf(ErrMalformedFrame, "unexpected frame type %d on a re-attesting connection", typ))
+			return
+		}
+	}
+}
+
+func (c *attestedConn) challengeLoop() {
+	ticker := time.NewTicker(c.config.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+
+		if err := c.challenge(); err != nil {
+			c.fail(err)
+			return
+		}
+	}
+}
+
+// challenge asks the peer to prove its identity again and checks its answer.
+func (c *attestedConn) challenge() error {
+	nonce := newNonce()
+	answers := make(chan []byte, 1)
+
+	c.mu.Lock()
+	c.awaiting = answers
+	c.mu.Unlock()
+
+	if err := c.writeControl(frameTypeChallenge, nonce); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.config.timeout())
+	defer cancel()
+
+	var answer []byte
+	select {
+	case <-c.done:
+		return nil
+	case <-ctx.Done():
+		return errorutil.Wrap(ErrReattestationFailed, "timed out waiting for the peer to answer")
+	case answer = <-answers:
+	}
+
+	var unverified gcisigner.UnverifiedMessage
+	if err := json.Unmarshal(answer, &unverified); err != nil {
+		return fmt.Errorf("%w: %w", ErrReattestationFailed, err)
+	}
+
+	verified, err := c.verifier.Verify(source_verifiers.WithSourceAddr(ctx, c.RemoteAddr()), &unverified)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrReattestationFailed, err)
+	}
+
+	var a attestation
+	if err := json.Unmarshal(verified.Payload, &a); err != nil {
+		return fmt.Errorf("%w: %w", ErrReattestationFailed, err)
+	}
+
+	binding, err := c.binding(nonce)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(a.Nonce, nonce) != 1 || subtle.ConstantTimeCompare(a.Binding, binding) != 1 {
+		return errorutil.Wrap(ErrReattestationFailed, "attestation isn't for this challenge")
+	}
+
+	peerARN, err := arn.Parse(verified.CallerIdentity.Arn)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrReattestationFailed, err)
+	}
+	if !samePrincipal(peerARN, c.peer.Role) || verified.CallerIdentity.Account != c.peer.AccountID {
+		return fmt.Errorf("%w: was %v, now %v", ErrPeerIdentityChanged, c.peer.Role, peerARN)
+	}
+
+	// The peer may have come back as a new session of its role, so describe
+	// it afresh rather than vouching for the session it had
+	peer := c.peer.reverified(peerARN, verified)
+	c.mu.Lock()
+	c.peer = peer
+	c.mu.Unlock()
+
+	c.logger.LogAttrs(context.Background(), slog.LevelDebug, "peer re-attested", append(peerAttrs(peer),
+		slog.String("remote_addr", c.RemoteAddr().String()),
+	)...)
+
+	if c.config.onReattested != nil {
+		c.config.onReattested(peer)
+	}
+
+	return nil
+}
+
+// reverified returns a copy of `p` describing the peer as `verified` says it
+// now is, as `role`.
+func (p *PeerMetadata) reverified(role arn.ARN, verified *gcisigner.VerifiedMessage) *PeerMetadata {
+	fresh := *p
+	fresh.Role = role
+	fresh.verifiedAt, fresh.identity = time.Now(), verifiedIdentityOf(verified)
+
+	fresh.SessionName, fresh.SSOUserName, fresh.PermissionSet = "", "", ""
+	fresh.describePrincipal()
+
+	return &fresh
+}
+
+// samePrincipal reports whether `a` and `b` are the same principal. Sessions
+// of the same role count as the same, as refreshed credentials usually come
+// with a new session name, e.g. for CI jobs or Lambda functions.
+func samePrincipal(a, b arn.ARN) bool {
+	aRole, aErr := sources.FromARN[sources.AssumedRole](a)
+	bRole, bErr := sources.FromARN[sources.AssumedRole](b)
+	if aErr != nil || bErr != nil {
+		return a == b
+	}
+
+	aIssuer, aErr := aRole.SessionIssuer()
+	bIssuer, bErr := bRole.SessionIssuer()
+	return aErr == nil && bErr == nil && aIssuer.Is(bIssuer)
+}
+
+// answer proves our identity in response to the peer's challenge.
+func (c *attestedConn) answer(nonce []byte) error {
+	if len(nonce) != nonceSize {
+		return errorutil.Wrapf(ErrMalformedFrame, "challenge nonce must be %d bytes, got %d", nonceSize, len(nonce))
+	}
+
+	binding, err := c.binding(nonce)
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(attestation{Nonce: nonce, Binding: binding})
+	if err != nil {
+		return errorutil.Wrap(err, "failed to marshal attestation")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.config.timeout())
+	defer cancel()
+
+	signed, err := c.signer.Sign(ctx, payload)
+	if err != nil {
+		return errorutil.Wrap(err, "failed to sign attestation")
+	}
+
+	signedBytes, err := json.Marshal(signed)
+	if err != nil {
+		return errorutil.Wrap(err, "failed to marshal signed attestation")
+	}
+
+	return c.writeControl(frameTypeAttestation, signedBytes)
+}
+
+// binding ties an attestation to both this TLS session and `nonce`.
+func (c *attestedConn) binding(nonce []byte) ([]byte, error) {
+	cs := c.ConnectionState()
+	binding, err := cs.ExportKeyingMaterial(reattestationExporterLabel, nonce, reattestationBindingSize)
+	if err != nil {
+		return nil, errorutil.Wrap(err, "failed to export attestation binding")
+	}
+	return binding, nil
+}
+
+func (c *attestedConn) writeControl(typ frameType, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if err := writeFrame(c.Conn, typ, payload); err != nil {
+		return errorutil.Wrap(err, "failed to write re-attestation frame")
+	}
+	return nil
+}
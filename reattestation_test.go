@@ -0,0 +1,236 @@
+package roast_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	roast "github.com/thomasdesr/roast"
+	"github.com/thomasdesr/roast/gcisigner"
+)
+
+func TestReattestation(t *testing.T) {
+	const interval = 100 * time.Millisecond
+
+	var serverReattested, clientReattested atomic.Int32
+	l, d := localValidListenerAndDialer(t)
+	if err := roast.WithReattestation[roast.Listener](interval, func(*roast.PeerMetadata) { serverReattested.Add(1) })(l); err != nil {
+		t.Fatal(err)
+	}
+	if err := roast.WithReattestation[roast.Dialer](interval, func(*roast.PeerMetadata) { clientReattested.Add(1) })(d); err != nil {
+		t.Fatal(err)
+	}
+
+	server, client := dialPair(t, l, d)
+	go io.Copy(server, server)
+
+	// Application data keeps flowing, in frames of any size, while both sides
+	// re-attest underneath it.
+	message := make([]byte, 100<<10)
+	rand.Read(message)
+
+	deadline := time.Now().Add(5 * interval)
+	for time.Now().Before(deadline) {
+		go client.Write(message)
+
+		echoed := make([]byte, len(message))
+		if _, err := io.ReadFull(client, echoed); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(echoed, message) {
+			t.Fatal("echoed data doesn't match what was sent")
+		}
+	}
+
+	if n := serverReattested.Load(); n < 2 {
+		t.Errorf("expected the server to see the client re-attest at least twice, got %d", n)
+	}
+	if n := clientReattested.Load(); n < 2 {
+		t.Errorf("expected the client to see the server re-attest at least twice, got %d", n)
+	}
+}
+
+func TestReattestationWithIdleReader(t *testing.T) {
+	const interval = 100 * time.Millisecond
+
+	var serverReattested atomic.Int32
+	l, d := localValidListenerAndDialer(t)
+	if err := roast.WithReattestation[roast.Listener](interval, func(*roast.PeerMetadata) { serverReattested.Add(1) })(l); err != nil {
+		t.Fatal(err)
+	}
+	if err := roast.WithReattestation[roast.Dialer](interval, nil)(d); err != nil {
+		t.Fatal(err)
+	}
+
+	server, client := dialPair(t, l, d)
+
+	// The server sends a little, then more than the client will buffer, while
+	// the client doesn't read for several intervals
+	small := []byte("a message that sits unread for a while")
+	large := make([]byte, 4<<20)
+	rand.Read(large)
+
+	writeErr := make(chan error, 1)
+	go func() {
+		if _, err := server.Write(small); err != nil {
+			writeErr <- err
+			return
+		}
+		_, err := server.Write(large)
+		writeErr <- err
+	}()
+
+	time.Sleep(5 * interval)
+	if n := serverReattested.Load(); n < 2 {
+		t.Errorf("expected the client to keep re-attesting while idle, got %d re-attestations", n)
+	}
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got := make([]byte, len(small)+len(large))
+	if _, err := io.ReadFull(client, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, append(small, large...)) {
+		t.Error("data read after idling doesn't match what was sent")
+	}
+	if err := <-writeErr; err != nil {
+		t.Errorf("expected the server's writes to succeed once the client read, got %v", err)
+	}
+}
+
+func TestReattestationClosesOnIdentityChange(t *testing.T) {
+	const interval = 100 * time.Millisecond
+
+	l, d := localValidListenerAndDialer(t)
+	if err := roast.WithReattestation[roast.Listener](interval, nil)(l); err != nil {
+		t.Fatal(err)
+	}
+	if err := roast.WithReattestation[roast.Dialer](interval, nil)(d); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the handshake is done, the client starts showing up as someone else
+	var handshakeDone atomic.Bool
+	serverVerifier := l.Verifier
+	l.Verifier = verifierFunc(func(ctx context.Context, msg *gcisigner.UnverifiedMessage) (*gcisigner.VerifiedMessage, error) {
+		verified, err := serverVerifier.Verify(ctx, msg)
+		if err == nil && handshakeDone.Load() {
+			verified.CallerIdentity.Arn = "arn:aws:sts::1234567890:assumed-role/SomeoneElse/Session"
+		}
+		return verified, err
+	})
+
+	server, client := dialPair(t, l, d)
+	handshakeDone.Store(true)
+
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := server.Read(make([]byte, 1)); !errors.Is(err, roast.ErrPeerIdentityChanged) {
+		t.Errorf("expected server to fail with %v, got %v", roast.ErrPeerIdentityChanged, err)
+	}
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Error("expected the client's connection to be closed")
+	}
+}
+
+func TestReattestationAllowsNewSessionOfSameRole(t *testing.T) {
+	const (
+		interval  = 100 * time.Millisecond
+		refreshed = "arn:aws:sts::1234567890:assumed-role/ClientRole/RefreshedSession"
+	)
+
+	var (
+		serverReattested atomic.Int32
+		lastReattested   atomic.Pointer[roast.PeerMetadata]
+	)
+	l, d := localValidListenerAndDialer(t)
+	if err := roast.WithReattestation[roast.Listener](interval, func(peer *roast.PeerMetadata) {
+		serverReattested.Add(1)
+		lastReattested.Store(peer)
+	})(l); err != nil {
+		t.Fatal(err)
+	}
+	if err := roast.WithReattestation[roast.Dialer](interval, nil)(d); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the handshake is done, the client's credentials are refreshed
+	// into a new session of the same role
+	var handshakeDone atomic.Bool
+	serverVerifier := l.Verifier
+	l.Verifier = verifierFunc(func(ctx context.Context, msg *gcisigner.UnverifiedMessage) (*gcisigner.VerifiedMessage, error) {
+		verified, err := serverVerifier.Verify(ctx, msg)
+		if err == nil && handshakeDone.Load() {
+			verified.CallerIdentity.Arn = refreshed
+		}
+		return verified, err
+	})
+
+	server, _ := dialPair(t, l, d)
+	handshakeDone.Store(true)
+
+	server.SetReadDeadline(time.Now().Add(5 * interval))
+	if _, err := server.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected the connection to stay open, got %v", err)
+	}
+	if n := serverReattested.Load(); n < 2 {
+		t.Fatalf("expected the client to re-attest with its new session, got %d re-attestations", n)
+	}
+
+	// The application hears who the peer is now, not who it was
+	if peer := lastReattested.Load(); peer.Role.String() != refreshed || peer.SessionName != "RefreshedSession" {
+		t.Errorf("expected re-attestation to report the new session %s, got %s (session %q)", refreshed, peer.Role, peer.SessionName)
+	}
+}
+
+func TestReattestationClosesWhenVerificationFails(t *testing.T) {
+	const interval = 100 * time.Millisecond
+
+	l, d := localValidListenerAndDialer(t)
+	if err := roast.WithReattestation[roast.Listener](interval, nil)(l); err != nil {
+		t.Fatal(err)
+	}
+	if err := roast.WithReattestation[roast.Dialer](interval, nil)(d); err != nil {
+		t.Fatal(err)
+	}
+
+	var handshakeDone atomic.Bool
+	clientVerifier := d.Verifier
+	d.Verifier = verifierFunc(func(ctx context.Context, msg *gcisigner.UnverifiedMessage) (*gcisigner.VerifiedMessage, error) {
+		if handshakeDone.Load() {
+			return nil, gcisigner.ErrSignatureInvalid
+		}
+		return clientVerifier.Verify(ctx, msg)
+	})
+
+	_, client := dialPair(t, l, d)
+	handshakeDone.Store(true)
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); !errors.Is(err, roast.ErrReattestationFailed) || !errors.Is(err, gcisigner.ErrSignatureInvalid) {
+		t.Errorf("expected client to fail with %v, got %v", roast.ErrReattestationFailed, err)
+	}
+}
+
+func TestReattestationPeerWithoutSupportExpires(t *testing.T) {
+	const interval = time.Hour
+
+	l, d := localValidListenerAndDialer(t)
+	if err := roast.WithReattestation[roast.Dialer](interval, nil)(d); err != nil {
+		t.Fatal(err)
+	}
+
+	_, client := dialPair(t, l, d)
+
+	peer := client.(*roast.Conn).Peer
+	if peer.ExpiresAt != peer.HandshakeTime.Add(interval) {
+		t.Errorf("expected a server that can't re-attest to expire after %v, got %v", interval, peer.ExpiresAt.Sub(peer.HandshakeTime))
+	}
+}
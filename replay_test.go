@@ -0,0 +1,133 @@
+package roast_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	roast "github.com/thomasdesr/roast"
+	"github.com/thomasdesr/roast/internal/testutils"
+)
+
+func TestReplayedServerHelloIsRejected(t *testing.T) {
+	l, d := localValidListenerAndDialer(t)
+
+	captured := captureServerHello(t, l.UpgradeServerConn, d.UpgradeClientConn)
+
+	err := replayServerHello(t, captured, d.UpgradeClientConn)
+	if !errors.Is(err, roast.ErrTranscriptMismatch) {
+		t.Fatalf("expected replayed server hello to fail with %v, got %v", roast.ErrTranscriptMismatch, err)
+	}
+}
+
+func TestReplayedServerHelloUnframedIsRejected(t *testing.T) {
+	l, d := localValidListenerAndDialer(t)
+
+	captured := captureServerHello(t, l.UpgradeServerConn, d.UpgradeClientConn)
+	if !captured.framed {
+		t.Fatal("expected a default Dialer to be answered with a framed hello")
+	}
+
+	// Default Dialers accept unframed answers for the sake of legacy servers,
+	// which mustn't let a bound hello shed its binding by being re-sent
+	// without its frame
+	captured.framed = false
+
+	err := replayServerHello(t, captured, d.UpgradeClientConn)
+	if !errors.Is(err, roast.ErrTranscriptMismatch) {
+		t.Fatalf("expected unframed replay to fail with %v, got %v", roast.ErrTranscriptMismatch, err)
+	}
+}
+
+func TestReplayedLegacyServerHelloIsRejected(t *testing.T) {
+	l, d := localValidListenerAndDialer(t)
+
+	legacyServer := func(ctx context.Context, c net.Conn) (*tls.Conn, *roast.PeerMetadata, error) {
+		tlsConn, err := roast.LegacyUpgradeServerConn(ctx, c, l.Signer, l.Verifier)
+		return tlsConn, nil, err
+	}
+	captured := captureServerHello(t, legacyServer, pinnedDialer(t, d, roast.ProtocolVersion1).UpgradeClientConn)
+
+	// Legacy server hellos carry no binding, so a Dialer that no longer
+	// offers ProtocolVersion1 must refuse to be answered with one. Dialers that
+	// still do accept them, as legacy servers can't answer any other way, and
+	// replaying one to them gets no further than TLS, for want of the server
+	// CA's key.
+	err := replayServerHello(t, captured, pinnedDialer(t, d, roast.ProtocolVersion2).UpgradeClientConn)
+	if !errors.Is(err, roast.ErrMalformedFrame) {
+		t.Fatalf("expected replayed legacy server hello to fail with %v, got %v", roast.ErrMalformedFrame, err)
+	}
+}
+
+// captureServerHello runs a successful handshake and returns the server's
+// signed hello along with whether it was framed.
+func captureServerHello(t testing.TB, serverUpgrade, clientUpgrade upgradeFunc) capturedHello {
+	t.Helper()
+
+	var recorder *testutils.RecordingConn
+	recordingServer := func(ctx context.Context, c net.Conn) (*tls.Conn, *roast.PeerMetadata, error) {
+		recorder = &testutils.RecordingConn{Conn: c}
+		return serverUpgrade(ctx, recorder)
+	}
+
+	server, client := upgradePair(t, recordingServer, clientUpgrade)
+	if server.err != nil || client.err != nil {
+		t.Fatalf("handshake failed: server=%v client=%v", server.err, client.err)
+	}
+
+	// Legacy hellos are followed by the TLS handshake, so cut them off at
+	// their newline; frames know their own length.
+	sent := recorder.DataSent
+	if sent[0] == '{' {
+		sent, _, _ = bytes.Cut(sent, []byte("\n"))
+		sent = append(sent, '\n')
+	}
+
+	signedHello, framed, err := roast.ReadHello(bytes.NewReader(sent))
+	if err != nil {
+		t.Fatalf("didn't find a server hello in the recorded data: %v", err)
+	}
+
+	return capturedHello{signedHello: signedHello, framed: framed}
+}
+
+type capturedHello struct {
+	signedHello []byte
+	framed      bool
+}
+
+// replayServerHello answers a fresh client hello with `captured` and returns
+// the error the client handshake failed with.
+func replayServerHello(t testing.TB, captured capturedHello, clientUpgrade upgradeFunc) error {
+	t.Helper()
+
+	left, right := testutils.ConnPipe(t)
+	defer left.Close()
+
+	go func() {
+		defer right.Close()
+
+		// Wait for the client to say hello, then answer with an old server hello
+		if _, _, err := roast.ReadHello(right); err != nil {
+			return
+		}
+		if err := roast.WriteHello(right, captured.signedHello, captured.framed); err != nil {
+			return
+		}
+
+		// Hold the conn open until the client gives up on it
+		io.Copy(io.Discard, right)
+	}()
+
+	tlsConn, _, err := clientUpgrade(context.Background(), left)
+	if err == nil {
+		tlsConn.Close()
+		t.Fatal("client accepted a replayed server hello")
+	}
+
+	return err
+}
@@ -0,0 +1,378 @@
+package roast
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/thomasdesr/roast/gcisigner"
+	"github.com/thomasdesr/roast/gcisigner/awsapi"
+	"github.com/thomasdesr/roast/gcisigner/source_verifiers"
+	"github.com/thomasdesr/roast/internal/errorutil"
+)
+
+// Session resumption lets a Dialer that reconnects to a Listener it recently
+// completed a handshake with skip both STS round trips.
+//
+// After a full handshake in which both sides advertised
+// CapabilitySessionResumption, each side derives the same ticket ID and secret
+// from the TLS session's exporter, without sending anything. On its next
+// connection to the same address the client sends the ticket ID, its fresh CA
+// and a nonce, MAC'd with the secret. Only the server that took part in that
+// TLS session knows the secret, so it can both check the client's request and
+// MAC a reply carrying its own fresh CA. TLS then proceeds as normal.
+//
+// Tickets are single use: every resumed connection derives a new one, but it
+// still expires a fixed time after the peer was last verified with STS, so a
+// chain of resumptions can't keep an identity alive forever.
+//
+// Resuming skips STS, not the source verifier: where the peer connects from
+// may have changed since it was verified, so a verifier set with
+// WithSourceVerifier is run again against the identity it was verified as.
+
+// CapabilitySessionResumption is advertised by peers that have opted in to
+// session resumption with WithSessionResumption.
+const CapabilitySessionResumption Capability = "session-resumption"
+
+// DefaultSessionResumptionLifetime is how long after a peer was verified with
+// STS its sessions may be resumed, when WithSessionResumption isn't given one.
+const DefaultSessionResumptionLifetime = 5 * time.Minute
+
+const (
+	// maxResumptionTickets bounds how many tickets a Dialer or Listener holds.
+	maxResumptionTickets = 1 << 12
+
+	resumptionExporterLabel = "EXPORTER-roast-session-resumption"
+	resumptionIDSize        = 32
+	resumptionSecretSize    = 32
+
+	resumeRequestMACLabel = "roast resume request"
+	resumeAcceptMACLabel  = "roast resume accept"
+)
+
+// errResumptionRejected is returned when a ticket can't be used, in which case
+// the handshake falls back to a full one.
+var errResumptionRejected = errors.New("session resumption rejected")
+
+type resumptionTicket struct {
+	id      []byte
+	secret  []byte
+	peer    PeerMetadata
+	expires time.Time
+}
+
+// sessionCache holds resumption tickets. Dialers key them by the remote
+// address they were issued for, Listeners by ticket ID.
+type sessionCache struct {
+	lifetime time.Duration
+	nowFunc  func() time.Time
+
+	mu      sync.Mutex
+	tickets map[string]*resumptionTicket
+}
+
+func newSessionCache(lifetime time.Duration) *sessionCache {
+	return &sessionCache{
+		lifetime: lifetime,
+		nowFunc:  time.Now,
+		tickets:  make(map[string]*resumptionTicket),
+	}
+}
+
+// remember derives a ticket from `tlsConn` for `peer` and stores it under
+// `key`, or under the ticket ID if `key` is empty. Resumption is only ever an
+// optimisation, so if no ticket can be derived the next connection will just
+// do a full handshake.
+func (sc *sessionCache) remember(key string, tlsConn *tls.Conn, peer *PeerMetadata) {
+	if !slices.Contains(peer.Capabilities, CapabilitySessionResumption) {
+		return
+	}
+
+	cs := tlsConn.ConnectionState()
+	keyingMaterial, err := cs.ExportKeyingMaterial(resumptionExporterLabel, nil, resumptionIDSize+resumptionSecretSize)
+	if err != nil {
+		return
+	}
+
+	t := &resumptionTicket{
+		id:      keyingMaterial[:resumptionIDSize],
+		secret:  keyingMaterial[resumptionIDSize:],
+		peer:    *peer,
+		expires: peer.verifiedAt.Add(sc.lifetime),
+	}
+	t.peer.Resumed = false
+
+	if key == "" {
+		key = string(t.id)
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	now := sc.nowFunc()
+	if !now.Before(t.expires) {
+		return
+	}
+
+	if len(sc.tickets) >= maxResumptionTickets {
+		for k, old := range sc.tickets {
+			if !now.Before(old.expires) {
+				delete(sc.tickets, k)
+			}
+		}
+	}
+	if len(sc.tickets) >= maxResumptionTickets {
+		// Still full of live tickets, make room by dropping an arbitrary one
+		for k := range sc.tickets {
+			delete(sc.tickets, k)
+			break
+		}
+	}
+
+	sc.tickets[key] = t
+}
+
+// take removes and returns the unexpired ticket stored under `key`, if any.
+func (sc *sessionCache) take(key string) *resumptionTicket {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	t, ok := sc.tickets[key]
+	if !ok {
+		return nil
+	}
+	delete(sc.tickets, key)
+
+	if !sc.nowFunc().Before(t.expires) {
+		return nil
+	}
+	return t
+}
+
+// peek returns the unexpired ticket stored under `key` without removing it.
+func (sc *sessionCache) peek(key string) *resumptionTicket {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	t, ok := sc.tickets[key]
+	if !ok || !sc.nowFunc().Before(t.expires) {
+		return nil
+	}
+	return t
+}
+
+// recheckSource runs the source verifier set by WithSourceVerifier, if any,
+// against the identity `peer` was verified as, from wherever `ctx` says it
+// now connects from (see source_verifiers.WithSourceAddr). The rule that
+// matched may differ from last time, so `peer` is updated to match.
+func (hc *handshakeConfig) recheckSource(ctx context.Context, peer *PeerMetadata) error {
+	if hc.sourceVerifier == nil {
+		return nil
+	}
+
+	gcir := awsapi.GetCallerIdentityResult{
+		Arn:     peer.Role.String(),
+		UserId:  peer.identity.userID,
+		Account: peer.AccountID,
+	}
+
+	rule, ok, err := source_verifiers.Match(ctx, hc.sourceVerifier, &gcir)
+	if err != nil || !ok {
+		return &gcisigner.SourceError{CallerIdentity: gcir, RequestID: peer.identity.requestID, Rule: rule, Err: err}
+	}
+
+	peer.identity.matchedRule = rule
+	peer.SSOUserName, peer.PermissionSet = "", ""
+	peer.describePrincipal()
+
+	return nil
+}
+
+// resumeEnvelope carries a resumeRequest or resumeAccept along with a MAC of
+// it keyed with the ticket's secret.
+type resumeEnvelope struct {
+	Body []byte
+	MAC  []byte
+}
+
+type resumeRequest struct {
+	TicketID        []byte
+	ClientCA        []byte   // PEM-encoded
+	ServerHostnames []string // DNS names or IP addresses
+	Nonce           []byte
+}
+
+type resumeAccept struct {
+	ServerCA []byte // PEM-encoded
+	Nonce    []byte
+
+	// RequestHash is the transcriptHash of the resume request this accepts.
+	RequestHash []byte
+}
+
+func sealResume(secret []byte, label string, body any) ([]byte, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(resumeEnvelope{Body: b, MAC: resumeMAC(secret, label, b)})
+}
+
+// openResume reports whether an envelope's MAC is valid for `secret`.
+func openResume(secret []byte, label string, envelope resumeEnvelope) bool {
+	return hmac.Equal(envelope.MAC, resumeMAC(secret, label, envelope.Body))
+}
+
+func resumeMAC(secret []byte, label string, body []byte) []byte {
+	m := hmac.New(sha256.New, secret)
+	m.Write([]byte(label))
+	m.Write(body)
+	return m.Sum(nil)
+}
+
+// clientResume tries to resume the session `t` belongs to. It returns
+// errResumptionRejected if the server won't, after which the connection is
+// ready for a full handshake.
+func clientResume(conn net.Conn, localCA *caBundle, remoteHost string, t *resumptionTicket, params tlsParams) (*tls.Config, *PeerMetadata, error) {
+	request, err := sealResume(t.secret, resumeRequestMACLabel, resumeRequest{
+		TicketID:        t.id,
+		ClientCA:        localCA.certPEM,
+		ServerHostnames: []string{remoteHost},
+		Nonce:           newNonce(),
+	})
+	if err != nil {
+		return nil, nil, errorutil.Wrap(err, "failed to marshal resume request")
+	}
+
+	if err := writeFrame(conn, frameTypeResume, request); err != nil {
+		return nil, nil, errorutil.Wrap(err, "failed to write resume request")
+	}
+
+	typ, payload, err := readFrame(conn)
+	if err != nil {
+		return nil, nil, errorutil.Wrap(err, "failed to read resume response")
+	}
+
+	switch typ {
+	case frameTypeResume:
+	case frameTypeResumeRejected:
+		return nil, nil, errResumptionRejected
+	case frameTypeAlert:
+		return nil, nil, parseAlert(payload)
+	default:
+		return nil, nil, errorutil.Wrapf(ErrMalformedFrame, "expected a resume response, got frame type %d", typ)
+	}
+
+	var envelope resumeEnvelope
+	if err := json.Unmarshal(payload, &envelope); err != nil {
+		return nil, nil, errorutil.Wrap(err, "failed to unmarshal resume response")
+	}
+
+	// Only the server we resumed from knows the secret, anything else is an
+	// attack rather than a miss, so don't fall back to a full handshake.
+	if !openResume(t.secret, resumeAcceptMACLabel, envelope) {
+		return nil, nil, errorutil.Wrap(ErrTranscriptMismatch, "resume accept has a bad MAC")
+	}
+
+	var accept resumeAccept
+	if err := json.Unmarshal(envelope.Body, &accept); err != nil {
+		return nil, nil, errorutil.Wrap(err, "failed to unmarshal resume accept")
+	}
+
+	if subtle.ConstantTimeCompare(accept.RequestHash, transcriptHash(request)) != 1 {
+		return nil, nil, errorutil.Wrap(ErrTranscriptMismatch, "resume accept is for a different request")
+	}
+
+	tlsConfig, err := makeClientConfig(*localCA, remoteHost, serverHello{ServerCA: accept.ServerCA}, params)
+	if err != nil {
+		return nil, nil, errorutil.Wrap(err, "failed to make client config")
+	}
+
+	peer := t.peer
+	peer.Resumed = true
+
+	return tlsConfig, &peer, nil
+}
+
+// serverResume answers a resume request. It returns errResumptionRejected if
+// we don't hold a matching ticket, in which case the caller should tell the
+// client and carry on with a full handshake.
+func serverResume(ctx context.Context, conn net.Conn, request []byte, hc *handshakeConfig) (*tls.Config, *PeerMetadata, error) {
+	sc := hc.resumption
+	if sc == nil {
+		return nil, nil, errResumptionRejected
+	}
+
+	var envelope resumeEnvelope
+	if err := json.Unmarshal(request, &envelope); err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", errResumptionRejected, err)
+	}
+
+	// We need the ticket ID to find the secret, which means reading it before
+	// the MAC has been checked. Nothing else is looked at until it has.
+	var rr resumeRequest
+	if err := json.Unmarshal(envelope.Body, &rr); err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", errResumptionRejected, err)
+	}
+
+	t := sc.peek(string(rr.TicketID))
+	if t == nil {
+		return nil, nil, errResumptionRejected
+	}
+
+	if !openResume(t.secret, resumeRequestMACLabel, envelope) {
+		return nil, nil, errorutil.Wrap(errResumptionRejected, "resume request has a bad MAC")
+	}
+
+	// Tickets are single use, if someone else beat us to it then it's gone
+	if sc.take(string(t.id)) != t {
+		return nil, nil, errResumptionRejected
+	}
+
+	// If the client is no longer allowed in from where it is, the full
+	// handshake it falls back to will say so.
+	peer := t.peer
+	if err := hc.recheckSource(ctx, &peer); err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", errResumptionRejected, err)
+	}
+
+	localCA, err := makeLocalCA(hc.certificateAlgorithm())
+	if err != nil {
+		return nil, nil, errorutil.Wrap(err, "failed to make a local CA")
+	}
+
+	accept, err := sealResume(t.secret, resumeAcceptMACLabel, resumeAccept{
+		ServerCA:    localCA.certPEM,
+		Nonce:       newNonce(),
+		RequestHash: transcriptHash(request),
+	})
+	if err != nil {
+		return nil, nil, errorutil.Wrap(err, "failed to marshal resume accept")
+	}
+
+	if err := writeFrame(conn, frameTypeResume, accept); err != nil {
+		return nil, nil, errorutil.Wrap(err, "failed to write resume accept")
+	}
+
+	tlsConfig, err := makeServerConfig(*localCA, clientHello{
+		ClientCA:        rr.ClientCA,
+		ServerHostnames: rr.ServerHostnames,
+	}, hc.localTLSParams())
+	if err != nil {
+		return nil, nil, errorutil.Wrap(err, "failed to make server config")
+	}
+
+	peer.Resumed = true
+
+	return tlsConfig, &peer, nil
+}
@@ -0,0 +1,269 @@
+package roast_test
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	roast "github.com/thomasdesr/roast"
+	"github.com/thomasdesr/roast/gcisigner"
+	"github.com/thomasdesr/roast/gcisigner/awsapi"
+	"github.com/thomasdesr/roast/gcisigner/source_verifiers"
+	"github.com/thomasdesr/roast/internal/testutils"
+)
+
+func TestSessionResumptionSkipsSTS(t *testing.T) {
+	pipe := newSameAddrPipe(t)
+	l, d, verifies := resumingListenerAndDialer(t, time.Minute, true)
+
+	first, firstClient := pipe.upgrade(t, l.UpgradeServerConn, d.UpgradeClientConn)
+	if first.err != nil || firstClient.err != nil {
+		t.Fatalf("handshake failed: server=%v client=%v", first.err, firstClient.err)
+	}
+	if first.peer.Resumed || firstClient.peer.Resumed {
+		t.Fatal("first handshake can't have been resumed")
+	}
+	if n := verifies.Load(); n != 2 {
+		t.Fatalf("expected a full handshake to verify both hellos, got %d verifications", n)
+	}
+
+	// Tickets are single use, but each resumption issues a new one
+	for i := 0; i < 3; i++ {
+		server, client := pipe.upgrade(t, l.UpgradeServerConn, d.UpgradeClientConn)
+		if server.err != nil || client.err != nil {
+			t.Fatalf("resumed handshake %d failed: server=%v client=%v", i, server.err, client.err)
+		}
+
+		if n := verifies.Load(); n != 2 {
+			t.Fatalf("expected resumed handshake %d not to verify anything, got %d verifications", i, n)
+		}
+
+		checkResumedPeer(t, server.peer, first.peer)
+		checkResumedPeer(t, client.peer, firstClient.peer)
+	}
+}
+
+func TestSessionResumptionFallsBackToFullHandshake(t *testing.T) {
+	pipe := newSameAddrPipe(t)
+	l, d, _ := resumingListenerAndDialer(t, time.Minute, true)
+
+	server, client := pipe.upgrade(t, l.UpgradeServerConn, d.UpgradeClientConn)
+	if server.err != nil || client.err != nil {
+		t.Fatalf("handshake failed: server=%v client=%v", server.err, client.err)
+	}
+
+	// A different Listener (e.g. after a restart) doesn't know our ticket
+	restarted, _, verifies := resumingListenerAndDialer(t, time.Minute, true)
+	restarted.Signer, restarted.Verifier = l.Signer, countingVerifier(l.Verifier, verifies)
+
+	server, client = pipe.upgrade(t, restarted.UpgradeServerConn, d.UpgradeClientConn)
+	if server.err != nil || client.err != nil {
+		t.Fatalf("fallback handshake failed: server=%v client=%v", server.err, client.err)
+	}
+	if server.peer.Resumed || client.peer.Resumed {
+		t.Error("expected a full handshake")
+	}
+	if n := verifies.Load(); n != 1 {
+		t.Errorf("expected the new Listener to verify the client, got %d verifications", n)
+	}
+}
+
+func TestSessionResumptionExpires(t *testing.T) {
+	pipe := newSameAddrPipe(t)
+	const lifetime = 200 * time.Millisecond
+
+	l, d, verifies := resumingListenerAndDialer(t, lifetime, true)
+
+	server, client := pipe.upgrade(t, l.UpgradeServerConn, d.UpgradeClientConn)
+	if server.err != nil || client.err != nil {
+		t.Fatalf("handshake failed: server=%v client=%v", server.err, client.err)
+	}
+
+	time.Sleep(lifetime)
+
+	server, client = pipe.upgrade(t, l.UpgradeServerConn, d.UpgradeClientConn)
+	if server.err != nil || client.err != nil {
+		t.Fatalf("handshake failed: server=%v client=%v", server.err, client.err)
+	}
+	if server.peer.Resumed || client.peer.Resumed {
+		t.Error("expected an expired session not to be resumed")
+	}
+	if n := verifies.Load(); n != 4 {
+		t.Errorf("expected two full handshakes, got %d verifications", n)
+	}
+}
+
+func TestSessionResumptionRequiresBothSides(t *testing.T) {
+	pipe := newSameAddrPipe(t)
+	l, d, verifies := resumingListenerAndDialer(t, time.Minute, false)
+
+	for i := 0; i < 2; i++ {
+		server, client := pipe.upgrade(t, l.UpgradeServerConn, d.UpgradeClientConn)
+		if server.err != nil || client.err != nil {
+			t.Fatalf("handshake failed: server=%v client=%v", server.err, client.err)
+		}
+		if server.peer.Resumed || client.peer.Resumed {
+			t.Fatal("expected a full handshake")
+		}
+	}
+
+	if n := verifies.Load(); n != 4 {
+		t.Errorf("expected two full handshakes, got %d verifications", n)
+	}
+}
+
+func TestSessionResumptionRechecksSourceAddr(t *testing.T) {
+	pipe := newSameAddrPipe(t)
+	l, d := localValidListenerAndDialer(t)
+
+	// Only let clients in from loopback, whether they've been verified before
+	// or not
+	loopbackOnly := source_verifiers.MatchFunc(func(ctx context.Context, _ *awsapi.GetCallerIdentityResult) (string, bool, error) {
+		addr, ok := source_verifiers.SourceAddrFrom(ctx)
+		return "loopback", ok && addr.IsLoopback(), nil
+	})
+
+	rl, err := roast.NewListener(nil, nil,
+		roast.WithSessionResumption[roast.Listener](time.Minute),
+		roast.WithSourceVerifier[roast.Listener](loopbackOnly),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rd, err := roast.NewDialer(nil, roast.WithSessionResumption[roast.Dialer](time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The fake STS doesn't run source verifiers, so do it ourselves
+	rl.Signer, rl.Verifier = l.Signer, verifierFunc(func(ctx context.Context, msg *gcisigner.UnverifiedMessage) (*gcisigner.VerifiedMessage, error) {
+		verified, err := l.Verifier.Verify(ctx, msg)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok, _ := source_verifiers.Match(ctx, loopbackOnly, &verified.CallerIdentity); !ok {
+			return nil, &gcisigner.SourceError{CallerIdentity: verified.CallerIdentity}
+		}
+		return verified, nil
+	})
+	rd.Dialer, rd.Signer, rd.Verifier = d.Dialer, d.Signer, d.Verifier
+
+	server, client := pipe.upgrade(t, rl.UpgradeServerConn, rd.UpgradeClientConn)
+	if server.err != nil || client.err != nil {
+		t.Fatalf("handshake failed: server=%v client=%v", server.err, client.err)
+	}
+
+	// The client comes back with its ticket from somewhere it isn't allowed
+	fromElsewhere := func(ctx context.Context, c net.Conn) (*tls.Conn, *roast.PeerMetadata, error) {
+		return rl.UpgradeServerConn(ctx, &remoteAddrConn{Conn: c, remote: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 443}})
+	}
+
+	server, _ = pipe.upgrade(t, fromElsewhere, rd.UpgradeClientConn)
+	if !errors.Is(server.err, gcisigner.ErrInvalidSource) {
+		t.Fatalf("expected server to refuse the client with %v, got %v", gcisigner.ErrInvalidSource, server.err)
+	}
+}
+
+// remoteAddrConn is a net.Conn that claims to be from `remote`.
+type remoteAddrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *remoteAddrConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// sameAddrPipe hands out connected conns whose client end always has the
+// same remote address, as when reconnecting to the same Listener.
+type sameAddrPipe struct {
+	listener net.Listener
+	dial     func(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+func newSameAddrPipe(t testing.TB) *sameAddrPipe {
+	listener, dial := testutils.ListenerDialer(t)
+	t.Cleanup(func() { listener.Close() })
+
+	return &sameAddrPipe{listener: listener, dial: dial}
+}
+
+// upgrade is upgradePair over a new connection from the pipe.
+func (p *sameAddrPipe) upgrade(t testing.TB, serverUpgrade, clientUpgrade upgradeFunc) (server, client upgradeResult) {
+	t.Helper()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := p.listener.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- c
+	}()
+
+	clientConn, err := p.dial(context.Background(), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverConn, ok := <-accepted
+	if !ok {
+		t.Fatal("failed to accept")
+	}
+
+	return upgradeConns(t, serverConn, clientConn, serverUpgrade, clientUpgrade)
+}
+
+// resumingListenerAndDialer returns a Dialer with session resumption enabled
+// and a Listener which has it enabled if `listenerResumes` is set, along with
+// a count of the hellos either has verified.
+func resumingListenerAndDialer(t testing.TB, lifetime time.Duration, listenerResumes bool) (*roast.Listener, *roast.Dialer, *atomic.Int32) {
+	t.Helper()
+
+	l, d := localValidListenerAndDialer(t)
+
+	var listenerOpts []roast.Option[roast.Listener]
+	if listenerResumes {
+		listenerOpts = append(listenerOpts, roast.WithSessionResumption[roast.Listener](lifetime))
+	}
+
+	rl, err := roast.NewListener(nil, nil, listenerOpts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rd, err := roast.NewDialer(nil, roast.WithSessionResumption[roast.Dialer](lifetime))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifies := new(atomic.Int32)
+	rl.Signer, rl.Verifier = l.Signer, countingVerifier(l.Verifier, verifies)
+	rd.Dialer, rd.Signer, rd.Verifier = d.Dialer, d.Signer, countingVerifier(d.Verifier, verifies)
+
+	return rl, rd, verifies
+}
+
+func countingVerifier(v gcisigner.Verifier, calls *atomic.Int32) gcisigner.Verifier {
+	return verifierFunc(func(ctx context.Context, msg *gcisigner.UnverifiedMessage) (*gcisigner.VerifiedMessage, error) {
+		calls.Add(1)
+		return v.Verify(ctx, msg)
+	})
+}
+
+func checkResumedPeer(t testing.TB, got, original *roast.PeerMetadata) {
+	t.Helper()
+
+	if !got.Resumed {
+		t.Errorf("expected peer metadata to be marked as resumed")
+	}
+
+	if got.Role != original.Role || got.AccountID != original.AccountID || got.ProtocolVersion != original.ProtocolVersion {
+		t.Errorf("resumed peer %+v doesn't match original peer %+v", got, original)
+	}
+}
@@ -4,10 +4,12 @@ import (
 	"net/http"
 
 	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/thomasdesr/roast"
 )
 
-func Client(allowedRoles []arn.ARN) (*http.Client, error) {
-	tr, err := Transport(allowedRoles)
+// Client returns an HTTP client that uses Transport.
+func Client(allowedRoles []arn.ARN, opts ...roast.Option[roast.Dialer]) (*http.Client, error) {
+	tr, err := Transport(allowedRoles, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -1,9 +1,10 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
@@ -12,12 +13,21 @@ import (
 
 	"github.com/aws/aws-sdk-go-v2/aws/arn"
 	"github.com/elazarl/goproxy"
+	"github.com/thomasdesr/roast"
+	"github.com/thomasdesr/roast/gcisigner/source_verifiers"
+	"github.com/thomasdesr/roast/gcisigner/source_verifiers/policy"
+	"github.com/thomasdesr/roast/internal/logutil"
 	"github.com/thomasdesr/roast/rhttp2"
 )
 
 var (
 	socketPath   = flag.String("socket", getEnvWithDefault("ROAST_SOCKET", os.ExpandEnv("$HOME/.roast/proxy.sock")), "Unix socket path to listen on")
-	allowedRoles = flag.String("roles", getEnvWithDefault("ROAST_PEER_ROLES", ""), "Comma-separated list of allowed peer roles")
+	allowedRoles = flag.String("roles", getEnvWithDefault("ROAST_PEER_ROLES", ""), "Comma-separated list of allowed peer roles, whose names may use * wildcards (e.g. arn:aws:iam::123456789012:role/payments-*, or role/* for any role in the account), IAM users, federated users or account roots. Any IAM user in the account allowed sts:GetFederationToken can become any federated user, so only allow those where that permission is as privileged as this proxy")
+	metricsAddr  = flag.String("metrics-addr", getEnvWithDefault("ROAST_METRICS_ADDR", ""), "Address to serve Prometheus metrics on at /metrics (disabled if empty)")
+	logFormat    = flag.String("log-format", getEnvWithDefault("ROAST_LOG_FORMAT", "text"), "Log format: text or json")
+	logLevel     = flag.String("log-level", getEnvWithDefault("ROAST_LOG_LEVEL", "info"), "Log level: debug, info, warn or error")
+	auditLog     = flag.String("audit-log", getEnvWithDefault("ROAST_AUDIT_LOG", ""), "File to append an audit record of every handshake to (disabled if empty)")
+	policyFile   = flag.String("policy", getEnvWithDefault("ROAST_POLICY", ""), "Policy file deciding which peers are allowed, in place of --roles")
 )
 
 // getEnvWithDefault returns the value of the environment variable if set, otherwise returns the default value
@@ -32,6 +42,10 @@ func getEnvWithDefault(key, defaultValue string) string {
 type config struct {
 	socketPath   string
 	allowedRoles []arn.ARN
+	metricsAddr  string
+	auditLog     string
+	policy       *policy.Policy
+	logger       *slog.Logger
 }
 
 // parseFlags parses command line flags and returns a config struct
@@ -51,6 +65,12 @@ func parseFlags() (*config, error) {
 		}
 	}
 
+	// Roles may be wildcarded, but only in ways that are plainly intended, so
+	// check now rather than when we first dial out
+	if _, err := source_verifiers.MatchesAnyPrincipal(roles); err != nil {
+		return nil, fmt.Errorf("invalid roles: %v", err)
+	}
+
 	// Ensure socket path is absolute
 	if !filepath.IsAbs(*socketPath) {
 		abs, err := filepath.Abs(*socketPath)
@@ -60,27 +80,80 @@ func parseFlags() (*config, error) {
 		*socketPath = abs
 	}
 
+	// A policy replaces the list of roles, rather than adding to it, so it
+	// must be clear which one is in charge
+	var pol *policy.Policy
+	if *policyFile != "" {
+		if len(roles) > 0 {
+			return nil, fmt.Errorf("--policy and --roles can't be used together")
+		}
+
+		var err error
+		if pol, err = policy.Load(*policyFile); err != nil {
+			return nil, err
+		}
+	}
+
+	logger, err := logutil.New(os.Stderr, *logFormat, *logLevel)
+	if err != nil {
+		return nil, err
+	}
+
 	return &config{
 		socketPath:   *socketPath,
 		allowedRoles: roles,
+		metricsAddr:  *metricsAddr,
+		auditLog:     *auditLog,
+		policy:       pol,
+		logger:       logger,
 	}, nil
 }
 
 func main() {
+	if err := run(); err != nil {
+		slog.Error("Exiting", "error", err)
+		os.Exit(1)
+	}
+}
+
+// run runs the proxy until it or its metrics server fails. Everything it
+// defers, like closing the audit log, runs before main exits.
+func run() error {
 	cfg, err := parseFlags()
 	if err != nil {
-		log.Fatalf("Failed to parse flags: %v", err)
+		return fmt.Errorf("failed to parse flags: %v", err)
+	}
+	slog.SetDefault(cfg.logger)
+
+	// Whichever of the proxy and the metrics server fails first stops us
+	errs := make(chan error, 2)
+	if cfg.metricsAddr != "" {
+		go func() { errs <- serveMetrics(cfg.metricsAddr) }()
 	}
 
 	// Use Roast for outbound connections
-	tr, err := rhttp2.Transport(cfg.allowedRoles)
+	dialerOpts := []roast.Option[roast.Dialer]{roast.WithLogger[roast.Dialer](cfg.logger)}
+	if cfg.policy != nil {
+		dialerOpts = append(dialerOpts, roast.WithSourceVerifier[roast.Dialer](cfg.policy))
+	}
+	if cfg.auditLog != "" {
+		sink, err := openAuditLog(cfg.auditLog)
+		if err != nil {
+			return err
+		}
+		defer sink.Close()
+		dialerOpts = append(dialerOpts, roast.WithAuditSink[roast.Dialer](sink))
+	}
+
+	tr, err := rhttp2.Transport(cfg.allowedRoles, dialerOpts...)
 	if err != nil {
-		log.Fatalf("Failed to create transport: %v", err)
+		return fmt.Errorf("failed to create transport: %v", err)
 	}
 
-	// Create the forward proxy server
+	// Create the forward proxy server, which logs every request at debug
 	proxy := goproxy.NewProxyHttpServer()
-	proxy.Verbose = true
+	proxy.Verbose = cfg.logger.Enabled(context.Background(), slog.LevelDebug)
+	proxy.Logger = slog.NewLogLogger(cfg.logger.Handler(), slog.LevelDebug)
 
 	// Regardless of what the URL passed to us said, going forward it'll be over
 	// HTTPS (which is what roast is doing and also what `http2.Transport` requires`)
@@ -106,31 +179,63 @@ func main() {
 
 	// Remove existing socket if it exists
 	if err := os.RemoveAll(cfg.socketPath); err != nil {
-		log.Fatalf("Failed to remove existing socket: %v", err)
+		return fmt.Errorf("failed to remove existing socket: %v", err)
 	}
 
 	// Create the directory for the socket if it doesn't exist
 	socketDir := filepath.Dir(cfg.socketPath)
 	if err := os.MkdirAll(socketDir, 0700); err != nil {
-		log.Fatalf("Failed to create socket directory: %v", err)
+		return fmt.Errorf("failed to create socket directory: %v", err)
 	}
 
 	// Start listening on the Unix socket
 	listener, err := net.Listen("unix", cfg.socketPath)
 	if err != nil {
-		log.Fatalf("Failed to listen on %s: %v", cfg.socketPath, err)
+		return fmt.Errorf("failed to listen on %q: %v", cfg.socketPath, err)
 	}
 
-	log.Printf("Starting forward proxy on %s", cfg.socketPath)
+	slog.Info("Starting forward proxy", "socket", cfg.socketPath)
 
 	// Start serving
 	server := &http.Server{
 		Handler: handleRawRequests(proxy),
 	}
 
-	if err := server.Serve(listener); err != nil {
-		log.Fatalf("Failed to serve: %v", err)
+	go func() { errs <- server.Serve(listener) }()
+	if err := <-errs; err != nil {
+		return fmt.Errorf("failed to serve: %v", err)
+	}
+	return nil
+}
+
+// serveMetrics serves roast's metrics on `addr` until that fails.
+func serveMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", rhttp2.MetricsHandler())
+
+	slog.Info("Serving metrics", "addr", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		return fmt.Errorf("failed to serve metrics on %q: %v", addr, err)
 	}
+	return nil
+}
+
+// Audit logs are rotated once they reach auditLogMaxSize, keeping
+// auditLogMaxBackups old ones.
+const (
+	auditLogMaxSize    = 100 << 20
+	auditLogMaxBackups = 10
+)
+
+// openAuditLog opens the audit log at `path`.
+func openAuditLog(path string) (*roast.FileAuditSink, error) {
+	sink, err := roast.NewFileAuditSink(path, auditLogMaxSize, auditLogMaxBackups)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Info("Writing audit log", "path", path)
+	return sink, nil
 }
 
 // handleRawRequests recognizes requests that aren't speaking HTTP_PROXY
@@ -3,19 +3,28 @@ package main
 import (
 	"flag"
 	"fmt"
+	"log/slog"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/thomasdesr/roast/gcisigner/source_verifiers"
+	"github.com/thomasdesr/roast/gcisigner/source_verifiers/policy"
 	"github.com/thomasdesr/roast/internal/errorutil"
+	"github.com/thomasdesr/roast/internal/logutil"
 )
 
 var (
 	bindAddr     = flag.String("bind", getEnvWithDefault("ROAST_BIND", ":8443"), "Address to bind the reverse proxy to")
 	targetAddr   = flag.String("target", getEnvWithDefault("ROAST_TARGET", "http://localhost:8080"), "Target address to forward traffic to (http:// or http+unix://)")
-	allowedRoles = flag.String("roles", getEnvWithDefault("ROAST_PEER_ROLES", ""), "Comma-separated list of allowed peer roles")
+	allowedRoles = flag.String("roles", getEnvWithDefault("ROAST_PEER_ROLES", ""), "Comma-separated list of allowed peer roles, whose names may use * wildcards (e.g. arn:aws:iam::123456789012:role/payments-*, or role/* for any role in the account), IAM users, federated users or account roots. Any IAM user in the account allowed sts:GetFederationToken can become any federated user, so only allow those where that permission is as privileged as this proxy")
+	metricsAddr  = flag.String("metrics-addr", getEnvWithDefault("ROAST_METRICS_ADDR", ""), "Address to serve Prometheus metrics on at /metrics (disabled if empty)")
+	logFormat    = flag.String("log-format", getEnvWithDefault("ROAST_LOG_FORMAT", "text"), "Log format: text or json")
+	logLevel     = flag.String("log-level", getEnvWithDefault("ROAST_LOG_LEVEL", "info"), "Log level: debug, info, warn or error")
+	auditLog     = flag.String("audit-log", getEnvWithDefault("ROAST_AUDIT_LOG", ""), "File to append an audit record of every handshake to (disabled if empty)")
+	policyFile   = flag.String("policy", getEnvWithDefault("ROAST_POLICY", ""), "Policy file deciding which peers are allowed, in place of --roles")
 )
 
 // getEnvWithDefault returns the value of the environment variable if set, otherwise returns the default value
@@ -31,6 +40,10 @@ type config struct {
 	bindAddr     string
 	targetURL    *url.URL
 	allowedRoles []arn.ARN
+	metricsAddr  string
+	auditLog     string
+	policy       *policy.Policy
+	logger       *slog.Logger
 }
 
 // parseFlags parses command line flags and returns a config struct
@@ -50,6 +63,12 @@ func parseFlags() (*config, error) {
 		}
 	}
 
+	// Roles may be wildcarded, but only in ways that are plainly intended, so
+	// check now rather than when we start serving
+	if _, err := source_verifiers.MatchesAnyPrincipal(roles); err != nil {
+		return nil, errorutil.Wrap(err, "invalid roles")
+	}
+
 	// Parse target URL
 	targetURL, err := url.Parse(*targetAddr)
 	if err != nil {
@@ -82,9 +101,32 @@ func parseFlags() (*config, error) {
 		return nil, fmt.Errorf("unsupported target scheme %q, must be http://, https://, or unix://", targetURL.Scheme)
 	}
 
+	// A policy replaces the list of roles, rather than adding to it, so it
+	// must be clear which one is in charge
+	var pol *policy.Policy
+	if *policyFile != "" {
+		if len(roles) > 0 {
+			return nil, fmt.Errorf("--policy and --roles can't be used together")
+		}
+
+		var err error
+		if pol, err = policy.Load(*policyFile); err != nil {
+			return nil, err
+		}
+	}
+
+	logger, err := logutil.New(os.Stderr, *logFormat, *logLevel)
+	if err != nil {
+		return nil, err
+	}
+
 	return &config{
 		bindAddr:     *bindAddr,
 		targetURL:    targetURL,
 		allowedRoles: roles,
+		metricsAddr:  *metricsAddr,
+		auditLog:     *auditLog,
+		policy:       pol,
+		logger:       logger,
 	}, nil
 }
@@ -1,11 +1,11 @@
 module github.com/thomasdesr/roast/rhttp2/cmd/roast-auth-reverseproxy
 
-go 1.23.4
+go 1.24.0
 
 require (
 	github.com/aws/aws-sdk-go-v2 v1.36.3
 	github.com/aws/aws-sdk-go-v2/service/sts v1.29.1
-	github.com/thomasdesr/roast v0.0.0-20250503041409-91722d8bf9dd
+	github.com/thomasdesr/roast v0.0.0-00010101000000-000000000000
 )
 
 require (
@@ -25,3 +25,5 @@ require (
 	golang.org/x/sys v0.22.0 // indirect
 	golang.org/x/text v0.16.0 // indirect
 )
+
+replace github.com/thomasdesr/roast => ../../../
@@ -3,38 +3,101 @@ package main
 import (
 	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
 
 	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/thomasdesr/roast"
 	"github.com/thomasdesr/roast/rhttp2"
 )
 
 func main() {
+	if err := run(); err != nil {
+		slog.Error("Exiting", "error", err)
+		os.Exit(1)
+	}
+}
+
+// run runs the proxy until it or its metrics server fails. Everything it
+// defers, like closing the audit log, runs before main exits.
+func run() error {
 	cfg, err := parseFlags()
 	if err != nil {
-		log.Fatalf("Failed to parse flags: %v", err)
+		return fmt.Errorf("failed to parse flags: %v", err)
+	}
+	slog.SetDefault(cfg.logger)
+
+	// Whichever of the proxy and the metrics server fails first stops us
+	errs := make(chan error, 2)
+	if cfg.metricsAddr != "" {
+		go func() { errs <- serveMetrics(cfg.metricsAddr) }()
 	}
 
 	// Create the reverse proxy
 	proxy, err := createReverseProxy(cfg)
 	if err != nil {
-		log.Fatalf("Failed to create reverse proxy: %v", err)
+		return fmt.Errorf("failed to create reverse proxy: %v", err)
+	}
+	proxy.Logger = cfg.logger
+	if cfg.policy != nil {
+		proxy.SourceVerifier = cfg.policy
+	}
+
+	if cfg.auditLog != "" {
+		sink, err := openAuditLog(cfg.auditLog)
+		if err != nil {
+			return err
+		}
+		defer sink.Close()
+		proxy.AuditSink = sink
 	}
 
 	// Start listening
 	listener, err := net.Listen("tcp", cfg.bindAddr)
 	if err != nil {
-		log.Fatalf("Failed to listen on %s: %v", cfg.bindAddr, err)
+		return fmt.Errorf("failed to listen on %q: %v", cfg.bindAddr, err)
 	}
 
-	log.Printf("Starting reverse proxy on %s, forwarding to %s for roles %s", cfg.bindAddr, cfg.targetURL, cfg.allowedRoles)
+	slog.Info("Starting reverse proxy", "bind", cfg.bindAddr, "target", cfg.targetURL.String(), "roles", cfg.allowedRoles)
 
-	if err := proxy.Serve(listener); err != nil {
-		log.Fatalf("Failed to serve: %v", err)
+	go func() { errs <- proxy.Serve(listener) }()
+	if err := <-errs; err != nil {
+		return fmt.Errorf("failed to serve: %v", err)
 	}
+	return nil
+}
+
+// serveMetrics serves roast's metrics on `addr` until that fails.
+func serveMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", rhttp2.MetricsHandler())
+
+	slog.Info("Serving metrics", "addr", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		return fmt.Errorf("failed to serve metrics on %q: %v", addr, err)
+	}
+	return nil
+}
+
+// Audit logs are rotated once they reach auditLogMaxSize, keeping
+// auditLogMaxBackups old ones.
+const (
+	auditLogMaxSize    = 100 << 20
+	auditLogMaxBackups = 10
+)
+
+// openAuditLog opens the audit log at `path`.
+func openAuditLog(path string) (*roast.FileAuditSink, error) {
+	sink, err := roast.NewFileAuditSink(path, auditLogMaxSize, auditLogMaxBackups)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Info("Writing audit log", "path", path)
+	return sink, nil
 }
 
 // createReverseProxy creates a reverse proxy configured for the target scheme.
@@ -0,0 +1,23 @@
+package rhttp2
+
+import (
+	"bytes"
+	"net/http"
+
+	"github.com/thomasdesr/roast"
+)
+
+// MetricsHandler serves roast's metrics, see roast.WriteMetrics, in the
+// Prometheus text exposition format.
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		if err := roast.WriteMetrics(&buf); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		buf.WriteTo(w)
+	})
+}
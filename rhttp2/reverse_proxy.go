@@ -3,9 +3,12 @@ package rhttp2
 import (
 	"encoding/json"
 	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws/arn"
 	"github.com/thomasdesr/roast"
@@ -54,6 +57,16 @@ func NewReverseProxy(target *url.URL, allowedRoles []arn.ARN) (*ReverseProxy, er
 	}, nil
 }
 
+// Serve is Server.Serve, also logging the proxy's errors to the Logger if
+// one is set.
+func (p *ReverseProxy) Serve(l net.Listener) error {
+	if p.Logger != nil && p.ReverseProxy.ErrorLog == nil {
+		p.ReverseProxy.ErrorLog = slog.NewLogLogger(p.Logger.Handler(), slog.LevelError)
+	}
+
+	return p.Server.Serve(l)
+}
+
 // ReverseProxyHandler creates a new httputil.ReverseProxy configured to
 // extracts peer information from the request context and adds it as HTTP
 // headers in the forwarded request.
@@ -80,6 +93,17 @@ const (
 	roastHTTPPeerMetadataIdentityHeader = "X-Roast-Peer-Identity"
 	roastHTTPPeerRoleARNHeader          = "X-Roast-Peer-Role-ARN"
 	roastHTTPPeerAWSAccountIDHeader     = "X-Roast-Peer-AWS-Account-ID"
+	roastHTTPPeerSessionNameHeader      = "X-Roast-Peer-Session-Name"
+	roastHTTPPeerSSOUserNameHeader      = "X-Roast-Peer-SSO-User-Name"
+	roastHTTPPeerPermissionSetHeader    = "X-Roast-Peer-Permission-Set"
+
+	// roastHTTPPeerClaimHeaderPrefix is followed by a claim's key, and the
+	// header holds its value.
+	roastHTTPPeerClaimHeaderPrefix = "X-Roast-Peer-Claim-"
+
+	// roastHTTPPeerHeaderPrefix is shared by every header we set. Anything
+	// with it that the client sent itself is stripped.
+	roastHTTPPeerHeaderPrefix = "X-Roast-Peer-"
 )
 
 // ParsePeerMetadataFromRequest extracts peer metadata information from an HTTP
@@ -105,7 +129,8 @@ func ParsePeerMetadataFromRequest(r *http.Request) (roast.PeerMetadata, error) {
 
 // setRoastHTTPPeerMetadataHeaders adds peer metadata information to the HTTP
 // request headers. It marshals the peer metadata to JSON and sets it in the
-// X-Roast-Peer-Identity header.
+// X-Roast-Peer-Identity header, and sets each of the peer's claims in an
+// X-Roast-Peer-Claim-<key> header.
 //
 // Panics if the peer metadata cannot be marshaled to JSON, as this indicates a
 // serious internal error that should not occur with valid peer metadata.
@@ -119,7 +144,27 @@ func setRoastHTTPPeerMetadataHeaders(r *http.Request, peerMetadata *roast.PeerMe
 		panic(err)
 	}
 
+	// Clients mustn't be able to pass off headers of their own as ours
+	for k := range r.Header {
+		if strings.HasPrefix(http.CanonicalHeaderKey(k), roastHTTPPeerHeaderPrefix) {
+			r.Header.Del(k)
+		}
+	}
+
 	r.Header.Set(roastHTTPPeerMetadataIdentityHeader, string(peerMetadataJSON))
 	r.Header.Set(roastHTTPPeerRoleARNHeader, peerMetadata.Role.String())
 	r.Header.Set(roastHTTPPeerAWSAccountIDHeader, peerMetadata.AccountID)
+	if peerMetadata.SessionName != "" {
+		r.Header.Set(roastHTTPPeerSessionNameHeader, peerMetadata.SessionName)
+	}
+	if peerMetadata.SSOUserName != "" {
+		r.Header.Set(roastHTTPPeerSSOUserNameHeader, peerMetadata.SSOUserName)
+		r.Header.Set(roastHTTPPeerPermissionSetHeader, peerMetadata.PermissionSet)
+	}
+
+	// The handshake only accepts claims whose keys can't collide once
+	// canonicalized and whose values can't smuggle in headers of their own
+	for k, v := range peerMetadata.Claims {
+		r.Header.Set(roastHTTPPeerClaimHeaderPrefix+k, v)
+	}
 }
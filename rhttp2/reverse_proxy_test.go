@@ -67,3 +67,52 @@ func TestReverseProxyHasHeaders(t *testing.T) {
 		t.Errorf("expected account ID %q, got %q", roleARN.AccountID, peerMetadata.AccountID)
 	}
 }
+
+func TestReverseProxyClaimHeaders(t *testing.T) {
+	roleARN, err := arn.Parse("arn:aws:iam::123456789012:role/test-role")
+	if err != nil {
+		t.Fatalf("failed to parse role ARN: %v", err)
+	}
+	ctx := roast.AttachPeerMetadataToContext(context.Background(), &roast.Conn{
+		Peer: &roast.PeerMetadata{
+			Role:      roleARN,
+			AccountID: roleARN.AccountID,
+			Claims:    roast.Claims{"service": "worker"},
+		},
+	})
+
+	// The client tries to pass off some claims of its own
+	req := httptest.NewRequestWithContext(ctx, "GET", "/test", nil)
+	req.Header.Set("X-Roast-Peer-Claim-Service", "admin")
+	req.Header.Set("X-Roast-Peer-Claim-Env", "prod")
+
+	receivedHeaders := make(chan http.Header, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedHeaders <- r.Header
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	targetURL, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatalf("failed to parse test server URL: %v", err)
+	}
+
+	ReverseProxyHandler(targetURL).ServeHTTP(httptest.NewRecorder(), req)
+	headers := <-receivedHeaders
+
+	if got := headers.Get(roastHTTPPeerClaimHeaderPrefix + "service"); got != "worker" {
+		t.Errorf("expected service claim header %q, got %q", "worker", got)
+	}
+	if got := headers.Values(roastHTTPPeerClaimHeaderPrefix + "env"); len(got) != 0 {
+		t.Errorf("expected the client's own claim header to be stripped, got %q", got)
+	}
+
+	peerMetadata, err := ParsePeerMetadataFromRequest(&http.Request{Header: headers})
+	if err != nil {
+		t.Fatalf("failed to parse peer metadata: %v", err)
+	}
+	if got, _ := peerMetadata.Claims.Get("service"); got != "worker" {
+		t.Errorf("expected service claim %q, got %q", "worker", got)
+	}
+}
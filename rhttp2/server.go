@@ -2,11 +2,14 @@ package rhttp2
 
 import (
 	"context"
+	"log/slog"
 	"net"
 	"net/http"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws/arn"
 	"github.com/thomasdesr/roast"
+	"github.com/thomasdesr/roast/gcisigner/source_verifiers"
 	"golang.org/x/net/http2"
 )
 
@@ -14,24 +17,100 @@ type Server struct {
 	Server *http.Server
 
 	AllowedRoles []arn.ARN
+
+	// SourceVerifier, if set, decides which clients are allowed in place of
+	// AllowedRoles, which must then be empty. See roast.WithSourceVerifier.
+	SourceVerifier source_verifiers.Verifier
+
+	// MaxConnectionAge, if set, limits how long a client's connection may be
+	// used before it has to reconnect, and so authenticate again.
+	MaxConnectionAge time.Duration
+
+	// MaxConnectionAgeGrace is how long before MaxConnectionAge is up that the
+	// server sends a GOAWAY, after which clients open new connections for new
+	// requests while in-flight ones finish on the old one. It defaults to a
+	// tenth of MaxConnectionAge.
+	MaxConnectionAgeGrace time.Duration
+
+	// Logger, if set, is where handshakes and errors are logged. It is used
+	// for the http.Server's ErrorLog too, unless that's already set.
+	Logger *slog.Logger
+
+	// AuditSink, if set, records the authorization decision made by every
+	// handshake, see roast.WithAuditSink.
+	AuditSink roast.AuditSink
 }
 
 func (s *Server) Serve(l net.Listener) error {
-	rl, err := roast.NewListener(l, s.AllowedRoles)
+	opts := []roast.Option[roast.Listener]{
+		// Peers that predate ALPN don't negotiate anything, but can only be
+		// speaking HTTP/2 to us too.
+		roast.WithNextProtos[roast.Listener](http2.NextProtoTLS),
+	}
+	if s.MaxConnectionAge > 0 {
+		opts = append(opts, roast.WithMaxConnectionAge[roast.Listener](s.MaxConnectionAge))
+	}
+	if s.Logger != nil {
+		opts = append(opts, roast.WithLogger[roast.Listener](s.Logger))
+		if s.Server.ErrorLog == nil {
+			s.Server.ErrorLog = slog.NewLogLogger(s.Logger.Handler(), slog.LevelError)
+		}
+	}
+	if s.SourceVerifier != nil {
+		opts = append(opts, roast.WithSourceVerifier[roast.Listener](s.SourceVerifier))
+	}
+	if s.AuditSink != nil {
+		opts = append(opts, roast.WithAuditSink[roast.Listener](s.AuditSink))
+	}
+
+	rl, err := roast.NewListener(l, s.AllowedRoles, opts...)
 	if err != nil {
 		return err
 	}
 
-	h2srv := &http2.Server{}
 	for {
 		conn, err := rl.Accept()
 		if err != nil {
 			return err
 		}
 
-		go h2srv.ServeConn(conn, &http2.ServeConnOpts{
-			Context:    roast.AttachPeerMetadataToContext(context.Background(), conn),
-			BaseConfig: s.Server,
+		go s.serveConn(conn.(*roast.Conn))
+	}
+}
+
+// serveConn serves HTTP/2 on `conn` until it's closed, sending a GOAWAY in
+// time for in-flight requests to finish before the connection expires.
+func (s *Server) serveConn(conn *roast.Conn) {
+	// Each connection gets its own http2.Server so that it can be shut down
+	// gracefully on its own, via a throwaway http.Server it's registered with.
+	h2srv := &http2.Server{}
+	shutdown := &http.Server{}
+	if err := http2.ConfigureServer(shutdown, h2srv); err != nil {
+		conn.Close()
+		return
+	}
+
+	if err := conn.HandshakeContext(context.Background()); err != nil {
+		conn.Close()
+		return
+	}
+
+	if expiresAt := conn.Peer.ExpiresAt; !expiresAt.IsZero() {
+		goAway := time.AfterFunc(time.Until(expiresAt.Add(-s.maxConnectionAgeGrace())), func() {
+			shutdown.Shutdown(context.Background())
 		})
+		defer goAway.Stop()
+	}
+
+	h2srv.ServeConn(conn, &http2.ServeConnOpts{
+		Context:    roast.AttachPeerMetadataToContext(context.Background(), conn),
+		BaseConfig: s.Server,
+	})
+}
+
+func (s *Server) maxConnectionAgeGrace() time.Duration {
+	if s.MaxConnectionAgeGrace > 0 {
+		return s.MaxConnectionAgeGrace
 	}
+	return s.MaxConnectionAge / 10
 }
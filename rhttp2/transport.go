@@ -11,8 +11,13 @@ import (
 	"golang.org/x/net/http2"
 )
 
-func Transport(allowedRoles []arn.ARN) (*http2.Transport, error) {
-	d, err := roast.NewDialer(allowedRoles)
+// Transport returns an HTTP/2 transport that connects to servers with one of
+// `allowedRoles` over Roast. Any `opts` are applied to its Dialer, e.g.
+// roast.WithLogger.
+func Transport(allowedRoles []arn.ARN, opts ...roast.Option[roast.Dialer]) (*http2.Transport, error) {
+	opts = append([]roast.Option[roast.Dialer]{roast.WithNextProtos[roast.Dialer](http2.NextProtoTLS)}, opts...)
+
+	d, err := roast.NewDialer(allowedRoles, opts...)
 	if err != nil {
 		return nil, errorutil.Wrap(err, "failed to create dialer")
 	}
@@ -0,0 +1,191 @@
+package roast
+
+import (
+	"context"
+	"time"
+
+	"github.com/thomasdesr/roast/gcisigner"
+)
+
+// HandshakeTrace is a set of hooks to run at each stage of a Dialer's or
+// Listener's handshakes, in the spirit of net/http/httptrace. Attach one with
+// WithHandshakeTrace or AttachHandshakeTraceToContext. Any of the hooks may be
+// nil.
+//
+// Hooks for different stages may run concurrently, e.g. a server generates
+// certificates and signs its hello while the client's is being verified, so
+// they must be safe to call from multiple goroutines.
+type HandshakeTrace struct {
+	// HandshakeStart is called when a handshake begins, and HandshakeDone when
+	// it has finished, TLS and all.
+	HandshakeStart func()
+	HandshakeDone  func(TraceResult)
+
+	// GetCredentialsStart and GotCredentials surround retrieving the AWS
+	// credentials our hello is signed with. They are only called for signers
+	// that support gcisigner.SignTrace.
+	GetCredentialsStart func()
+	GotCredentials      func(TraceResult)
+
+	// SignStart and SignDone surround signing our hello, including
+	// retrieving credentials.
+	SignStart func()
+	SignDone  func(TraceResult)
+
+	// VerifyStart and VerifyDone surround verifying the peer's hello, which
+	// is usually a round trip to STS.
+	VerifyStart func()
+	VerifyDone  func(TraceResult)
+
+	// GenerateCertificateStart and GenerateCertificateDone surround
+	// generating each of our certificates: our local CA, then the leaf
+	// certificate it signs.
+	GenerateCertificateStart func()
+	GenerateCertificateDone  func(TraceResult)
+
+	// TLSHandshakeStart and TLSHandshakeDone surround the TLS handshake that
+	// follows the Roast one.
+	TLSHandshakeStart func()
+	TLSHandshakeDone  func(TraceResult)
+}
+
+// TraceResult describes how a traced stage of a handshake went.
+type TraceResult struct {
+	// Duration is how long the stage took.
+	Duration time.Duration
+	// Err is why the stage failed, or nil if it succeeded.
+	Err error
+}
+
+type handshakeTraceContextKey struct{}
+
+// AttachHandshakeTraceToContext returns a context that runs `trace`'s hooks
+// for handshakes using it, such as those started by Dialer.DialContext or
+// Conn.HandshakeContext. Traces attached to a context that already has some
+// run after them. A Listener starts handshakes as soon as it accepts
+// connections, without a context of the caller's, so use WithHandshakeTrace
+// to trace those.
+func AttachHandshakeTraceToContext(ctx context.Context, trace *HandshakeTrace) context.Context {
+	traces := contextTraces(ctx)
+	return context.WithValue(ctx, handshakeTraceContextKey{}, append(traces[:len(traces):len(traces)], trace))
+}
+
+func contextTraces(ctx context.Context) []*HandshakeTrace {
+	traces, _ := ctx.Value(handshakeTraceContextKey{}).([]*HandshakeTrace)
+	return traces
+}
+
+// tracer runs the hooks of every trace that applies to a handshake.
+type tracer []*HandshakeTrace
+
+// tracer returns the traces for a handshake using `ctx`: the configured one
+// first, then any attached to the context.
+func (hc *handshakeConfig) tracer(ctx context.Context) tracer {
+	var t tracer
+	if hc.trace != nil {
+		t = append(t, hc.trace)
+	}
+	return append(t, contextTraces(ctx)...)
+}
+
+// traceHooks picks the start and done hooks for one stage out of a trace.
+type traceHooks func(*HandshakeTrace) (start func(), done func(TraceResult))
+
+func handshakeHooks(t *HandshakeTrace) (func(), func(TraceResult)) {
+	return t.HandshakeStart, t.HandshakeDone
+}
+
+func credentialsHooks(t *HandshakeTrace) (func(), func(TraceResult)) {
+	return t.GetCredentialsStart, t.GotCredentials
+}
+
+func signHooks(t *HandshakeTrace) (func(), func(TraceResult)) {
+	return t.SignStart, t.SignDone
+}
+
+func verifyHooks(t *HandshakeTrace) (func(), func(TraceResult)) {
+	return t.VerifyStart, t.VerifyDone
+}
+
+func certificateHooks(t *HandshakeTrace) (func(), func(TraceResult)) {
+	return t.GenerateCertificateStart, t.GenerateCertificateDone
+}
+
+func tlsHooks(t *HandshakeTrace) (func(), func(TraceResult)) {
+	return t.TLSHandshakeStart, t.TLSHandshakeDone
+}
+
+// stage calls the start hooks picked by `hooks` and returns a function that
+// calls the matching done hooks with how long the stage took.
+func (t tracer) stage(hooks traceHooks) func(err error) {
+	if len(t) == 0 {
+		return func(error) {}
+	}
+
+	for _, trace := range t {
+		if start, _ := hooks(trace); start != nil {
+			start()
+		}
+	}
+
+	started := time.Now()
+	return func(err error) {
+		result := TraceResult{Duration: time.Since(started), Err: err}
+		for _, trace := range t {
+			if _, done := hooks(trace); done != nil {
+				done(result)
+			}
+		}
+	}
+}
+
+// sign signs `payload`, tracing it and the credential retrieval within it.
+func (t tracer) sign(ctx context.Context, signer gcisigner.Signer, payload []byte) (*gcisigner.SignedMessage, error) {
+	if len(t) > 0 {
+		var gotCredentials func(error)
+		ctx = gcisigner.WithSignTrace(ctx, &gcisigner.SignTrace{
+			GetCredentialsStart: func() { gotCredentials = t.stage(credentialsHooks) },
+			GotCredentials: func(err error) {
+				if gotCredentials != nil {
+					gotCredentials(err)
+				}
+			},
+		})
+	}
+
+	done := t.stage(signHooks)
+	signed, err := signer.Sign(ctx, payload)
+	done(err)
+
+	return signed, err
+}
+
+// verify verifies `msg`, tracing it.
+func (t tracer) verify(ctx context.Context, verifier gcisigner.Verifier, msg *gcisigner.UnverifiedMessage) (*gcisigner.VerifiedMessage, error) {
+	done := t.stage(verifyHooks)
+	verified, err := verifier.Verify(ctx, msg)
+	done(err)
+
+	return verified, err
+}
+
+// certificate starts tracing, and timing, the generation of a certificate
+// with `alg`, and returns a function that finishes doing so.
+func (t tracer) certificate(alg CertificateAlgorithm) func(err error) {
+	done := t.stage(certificateHooks)
+	started := time.Now()
+
+	return func(err error) {
+		certificateGeneration.Observe(time.Since(started).Seconds(), string(alg))
+		done(err)
+	}
+}
+
+// makeLocalCA is makeLocalCA, traced.
+func (t tracer) makeLocalCA(alg CertificateAlgorithm) (*caBundle, error) {
+	done := t.certificate(alg)
+	localCA, err := makeLocalCA(alg)
+	done(err)
+
+	return localCA, err
+}
@@ -0,0 +1,138 @@
+package roast_test
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+
+	roast "github.com/thomasdesr/roast"
+	"github.com/thomasdesr/roast/gcisigner"
+)
+
+func TestHandshakeTrace(t *testing.T) {
+	l, d := localValidListenerAndDialer(t)
+
+	serverEvents := &traceRecorder{}
+	if err := roast.WithHandshakeTrace[roast.Listener](serverEvents.trace())(l); err != nil {
+		t.Fatal(err)
+	}
+	clientEvents := &traceRecorder{}
+	ctx := roast.AttachHandshakeTraceToContext(context.Background(), clientEvents.trace())
+
+	server, client := upgradePair(t, l.UpgradeServerConn, func(_ context.Context, c net.Conn) (*tls.Conn, *roast.PeerMetadata, error) {
+		return d.UpgradeClientConn(ctx, c)
+	})
+	if server.err != nil || client.err != nil {
+		t.Fatalf("handshake failed: server=%v client=%v", server.err, client.err)
+	}
+
+	want := []string{
+		"handshake start",
+		"certificate start", "certificate done",
+		"sign start", "sign done",
+		"verify start", "verify done",
+		"certificate start", "certificate done",
+		"tls start", "tls done",
+		"handshake done",
+	}
+	if got := clientEvents.get(); !slices.Equal(got, want) {
+		t.Errorf("expected client events %v, got %v", want, got)
+	}
+
+	// The server verifies the client's hello while it gets on with its own,
+	// so only check it saw every stage.
+	got := serverEvents.get()
+	slices.Sort(got)
+	slices.Sort(want)
+	if !slices.Equal(got, want) {
+		t.Errorf("expected server events %v, got %v", want, got)
+	}
+}
+
+func TestHandshakeTraceFailure(t *testing.T) {
+	l, d := localValidListenerAndDialer(t)
+	l.Verifier = failingVerifier{gcisigner.ErrInvalidSource}
+
+	var (
+		mu       sync.Mutex
+		verified error
+		finished error
+	)
+	if err := roast.WithHandshakeTrace[roast.Listener](&roast.HandshakeTrace{
+		VerifyDone: func(r roast.TraceResult) {
+			mu.Lock()
+			defer mu.Unlock()
+			verified = r.Err
+		},
+		HandshakeDone: func(r roast.TraceResult) {
+			mu.Lock()
+			defer mu.Unlock()
+			finished = r.Err
+		},
+	})(l); err != nil {
+		t.Fatal(err)
+	}
+
+	upgradePair(t, l.UpgradeServerConn, d.UpgradeClientConn)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !errors.Is(verified, gcisigner.ErrInvalidSource) {
+		t.Errorf("expected verification to fail with %v, got %v", gcisigner.ErrInvalidSource, verified)
+	}
+	if !errors.Is(finished, gcisigner.ErrInvalidSource) {
+		t.Errorf("expected the handshake to fail with %v, got %v", gcisigner.ErrInvalidSource, finished)
+	}
+}
+
+// traceRecorder records the stages a HandshakeTrace sees, in order.
+type traceRecorder struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (r *traceRecorder) trace() *roast.HandshakeTrace {
+	start := func(stage string) func() {
+		return func() { r.record(stage + " start") }
+	}
+	done := func(stage string) func(roast.TraceResult) {
+		return func(res roast.TraceResult) {
+			if res.Err != nil || res.Duration < 0 {
+				r.record(stage + " failed")
+				return
+			}
+			r.record(stage + " done")
+		}
+	}
+
+	return &roast.HandshakeTrace{
+		HandshakeStart:           start("handshake"),
+		HandshakeDone:            done("handshake"),
+		GetCredentialsStart:      start("credentials"),
+		GotCredentials:           done("credentials"),
+		SignStart:                start("sign"),
+		SignDone:                 done("sign"),
+		VerifyStart:              start("verify"),
+		VerifyDone:               done("verify"),
+		GenerateCertificateStart: start("certificate"),
+		GenerateCertificateDone:  done("certificate"),
+		TLSHandshakeStart:        start("tls"),
+		TLSHandshakeDone:         done("tls"),
+	}
+}
+
+func (r *traceRecorder) record(event string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+}
+
+func (r *traceRecorder) get() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.events)
+}
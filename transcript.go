@@ -0,0 +1,48 @@
+package roast
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+)
+
+// nonceSize is the number of random bytes each side contributes to a
+// handshake.
+const nonceSize = 32
+
+// ErrTranscriptMismatch is returned by a client when the server hello it
+// received was not produced in response to the client hello it sent, e.g.
+// because it was captured from another connection and replayed.
+var ErrTranscriptMismatch = errors.New("server hello is not bound to this handshake")
+
+func newNonce() []byte {
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	return nonce
+}
+
+// transcriptHash returns the hash of a signed client hello exactly as it
+// appeared on the wire. Servers echo it back inside their own signed hello so
+// the client can tell the response was minted for it.
+func transcriptHash(signedClientHello []byte) []byte {
+	h := sha256.Sum256(signedClientHello)
+	return h[:]
+}
+
+// verifyBinding checks that `sh` was produced in response to
+// `signedClientHello`.
+func (sh *serverHello) verifyBinding(signedClientHello []byte) error {
+	if len(sh.Nonce) != nonceSize {
+		return fmt.Errorf("%w: server nonce must be %d bytes, got %d", ErrTranscriptMismatch, nonceSize, len(sh.Nonce))
+	}
+
+	if subtle.ConstantTimeCompare(sh.ClientHelloHash, transcriptHash(signedClientHello)) != 1 {
+		return fmt.Errorf("%w: client hello hash does not match", ErrTranscriptMismatch)
+	}
+
+	return nil
+}
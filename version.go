@@ -0,0 +1,81 @@
+package roast
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/thomasdesr/roast/internal/errorutil"
+)
+
+// ProtocolVersion identifies a revision of the Roast handshake. Both sides
+// advertise the versions they support in their signed hellos and the highest
+// version they have in common is used for the rest of the connection.
+type ProtocolVersion uint16
+
+const (
+	// ProtocolVersion1 is the original, unversioned handshake. Hellos from
+	// peers that predate version negotiation carry no version information and
+	// are always treated as ProtocolVersion1.
+	ProtocolVersion1 ProtocolVersion = 1
+
+	// ProtocolVersion2 carries explicit version and capability negotiation in
+	// the signed hellos.
+	ProtocolVersion2 ProtocolVersion = 2
+)
+
+// defaultProtocolVersions is the set of versions Dialers and Listeners
+// advertise unless configured otherwise with WithProtocolVersions, ordered from
+// most to least preferred.
+var defaultProtocolVersions = []ProtocolVersion{ProtocolVersion2, ProtocolVersion1}
+
+func (v ProtocolVersion) String() string {
+	return fmt.Sprintf("roast/%d", uint16(v))
+}
+
+func (v ProtocolVersion) isKnown() bool {
+	return slices.Contains(defaultProtocolVersions, v)
+}
+
+// Capability names an optional protocol feature a peer is willing to use.
+// Capabilities are advertised in the hellos alongside the protocol version,
+// and a capability is only used when both sides advertise it.
+type Capability string
+
+// ErrNoCommonProtocolVersion is returned when the local and remote sides of a
+// handshake do not share any protocol version.
+var ErrNoCommonProtocolVersion = errors.New("no protocol version in common with peer")
+
+// negotiateVersion returns the highest version present in both `local` and
+// `offered`. An empty `offered` means the peer predates version negotiation
+// and only speaks ProtocolVersion1.
+func negotiateVersion(local, offered []ProtocolVersion) (ProtocolVersion, error) {
+	if len(offered) == 0 {
+		offered = []ProtocolVersion{ProtocolVersion1}
+	}
+
+	var selected ProtocolVersion
+	for _, v := range offered {
+		if v > selected && slices.Contains(local, v) {
+			selected = v
+		}
+	}
+
+	if selected == 0 {
+		return 0, errorutil.Wrapf(ErrNoCommonProtocolVersion, "local supports %v, peer offered %v", local, offered)
+	}
+
+	return selected, nil
+}
+
+// negotiateCapabilities returns the capabilities present in both `local` and
+// `offered`, in the order of `local`.
+func negotiateCapabilities(local, offered []Capability) []Capability {
+	var common []Capability
+	for _, c := range local {
+		if slices.Contains(offered, c) {
+			common = append(common, c)
+		}
+	}
+	return common
+}